@@ -7,6 +7,7 @@ TODOS:
 */
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -17,9 +18,23 @@ import (
 )
 
 func main() {
+	// cgw config validate checks a config without starting the gateway
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "validate" {
+		os.Exit(validateConfig(os.Args[3:]))
+	}
+
 	// find the config file path
 	cfgPath := flag.String("cfg", "/etc/cgw/config.yaml", "Path for configuration file")
 	logLevel := flag.Int("loglevel", 1, "Set log level (trace=-1, debug=0, info=1, warn=2, error=3)")
+	printCfg := flag.Bool("print-config", false, "Print the effective configuration with secrets redacted and exit")
+	// every config field has a flag named after its yaml path
+	overrides := cgw.RegisterConfigFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "config values are read from the config file, then %s environment variables, "+
+			"then flags, later sources take precedence\n", cgw.EnvPrefix)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	// set log time format
@@ -27,15 +42,82 @@ func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	zerolog.SetGlobalLevel(zerolog.Level(*logLevel))
 
+	if *printCfg {
+		cfg, err := cgw.LoadConfig(*cfgPath, overrides)
+		if err != nil {
+			cgw.ErrorLog("can't load config, %s", err)
+			os.Exit(1)
+		}
+		dump, err := cgw.DumpConfig(cfg)
+		if err != nil {
+			cgw.ErrorLog("can't print config, %s", err)
+			os.Exit(1)
+		}
+		fmt.Print(string(dump))
+		return
+	}
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	gw, err := cgw.NewCAASGateway(*cfgPath, cgw.RedisStore{}, nil)
+	gw, err := cgw.NewCAASGateway(*cfgPath, overrides, nil, nil)
 	if err != nil {
 		cgw.ErrorLog("can't create new gateway, %s", err)
 		return
 	}
+	// SIGHUP reloads the settings that can change without a restart
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+
 	go gw.StartServer()
-	<-sigs
-	gw.StopSignal <- struct{}{}
+	for {
+		select {
+		case <-hups:
+			report, err := gw.Reload()
+			if err != nil {
+				cgw.ErrorLog("unable to reload configuration, keeping the current one, %s", err)
+				continue
+			}
+			log.Info().Msgf("reloaded configuration, applied: %v, restart required: %v",
+				report.Applied, report.RestartRequired)
+		case <-sigs:
+			gw.StopSignal <- struct{}{}
+			return
+		}
+	}
+}
+
+// validateConfig reports every problem in the config and returns the exit code,
+// it doesn't connect to anything so it can run in ci before the config is deployed.
+// Referenced files are checked like they are at startup, ci runs where the secrets
+// aren't mounted have to pass -check-files=false and skip those checks
+func validateConfig(args []string) int {
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	cfgPath := fs.String("cfg", "/etc/cgw/config.yaml", "Path for configuration file")
+	checkFiles := fs.Bool("check-files", true, "Check the files referenced by the config exist, "+
+		"set to false where they aren't mounted")
+	overrides := cgw.RegisterConfigFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s config validate:\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "checks the config with %s environment variables and flags applied, "+
+			"every problem is printed with its yaml path\n", cgw.EnvPrefix)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	cfg, err := cgw.ReadConfig(*cfgPath, overrides)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *cfgPath, err)
+		return 1
+	}
+	err = cgw.ValidateConfig(cfg, *checkFiles)
+	if ve, ok := err.(*cgw.ValidationError); ok {
+		for _, p := range ve.Problems {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *cfgPath, p)
+		}
+		return 1
+	}
+	fmt.Printf("%s: ok\n", *cfgPath)
+	return 0
 }
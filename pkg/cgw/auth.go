@@ -0,0 +1,213 @@
+package cgw
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// route names used in authorization policies
+const (
+	CreateRoute     = "create"
+	ValidateRoute   = "validate"
+	RefreshRoute    = "refresh"
+	DisconnectRoute = "disconnect"
+	DebugRoute      = "debug"
+	HandoverRoute   = "handover"
+	BulkRoute       = "bulk"
+	EntitiesRoute   = "entities"
+	CAASRoute       = "caas"
+)
+
+// selfRule allows callers to act on their own entity pair
+const selfRule = "self"
+
+// CallerIdentity is the ctx key for the authenticated caller
+const CallerIdentity ctxKey = 1
+
+// defaultPolicy is used for routes that are not in the configured policy
+var defaultPolicy = map[string][]string{
+	CreateRoute:     {"admin", "sw", selfRule},
+	ValidateRoute:   {"admin", "sw"},
+	RefreshRoute:    {"admin", selfRule},
+	DisconnectRoute: {"admin"},
+	DebugRoute:      {"admin"},
+	HandoverRoute:   {"admin"},
+	BulkRoute:       {"admin"},
+	EntitiesRoute:   {"admin"},
+	CAASRoute:       {"admin"},
+}
+
+// AuthSettings represents settings for authenticating callers
+// TokensFile has one "entity entityid token" entry per line,
+// MTLS uses the "entity-entityid" common name of verified client certificates
+type AuthSettings struct {
+	Enabled    bool                `yaml:"enabled"`
+	TokensFile string              `yaml:"tokensFile"`
+	MTLS       bool                `yaml:"mtls"`
+	Policy     map[string][]string `yaml:"policy"`
+}
+
+// validate checks the auth fields are consistent
+func (as AuthSettings) validate() error {
+	if !as.Enabled {
+		return nil
+	}
+	if IsEmpty(as.TokensFile) && !as.MTLS {
+		return errors.New("tokens file or mtls is required")
+	}
+	for route, rules := range as.Policy {
+		if _, ok := defaultPolicy[route]; !ok {
+			return fmt.Errorf("route is not supported, %s", route)
+		}
+		for _, rule := range rules {
+			if rule != selfRule && !IsValidEntity(rule) {
+				return fmt.Errorf("rule is not supported, %s", rule)
+			}
+		}
+	}
+	return nil
+}
+
+// Authenticator identifies callers and checks them against the policy
+type Authenticator struct {
+	tokens map[string]EntityPair
+	mtls   bool
+	policy map[string][]string
+}
+
+// NewAuthenticator creates a new authenticator from settings
+func NewAuthenticator(settings AuthSettings) (*Authenticator, error) {
+	auth := &Authenticator{
+		tokens: map[string]EntityPair{},
+		mtls:   settings.MTLS,
+		policy: map[string][]string{},
+	}
+	for route, rules := range defaultPolicy {
+		auth.policy[route] = rules
+	}
+	for route, rules := range settings.Policy {
+		auth.policy[route] = rules
+	}
+	if IsEmpty(settings.TokensFile) {
+		return auth, nil
+	}
+
+	file, err := os.Open(settings.TokensFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			ErrorLog("malformed entry on line %d of %s", line, settings.TokensFile)
+			return nil, fmt.Errorf("malformed tokens file entry on line %d", line)
+		}
+		ep := EntityPair{Entity: fields[0], EntityID: fields[1]}
+		if !ep.IsValid() {
+			return nil, fmt.Errorf("invalid entity on line %d", line)
+		}
+		auth.tokens[hashCallerToken(fields[2])] = ep
+	}
+	return auth, scanner.Err()
+}
+
+// hashCallerToken hashes tokens so lookups don't leak timing on the raw token
+func hashCallerToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// identify finds the caller from the bearer token or the client certificate,
+// the certificate is still tried when the bearer token isn't known
+func (auth *Authenticator) identify(req *http.Request) (EntityPair, bool) {
+	header := req.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		if ep, ok := auth.tokens[hashCallerToken(strings.TrimPrefix(header, "Bearer "))]; ok {
+			return ep, true
+		}
+	}
+	if auth.mtls && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		cn := req.TLS.VerifiedChains[0][0].Subject.CommonName
+		parts := strings.SplitN(cn, "-", 2)
+		if len(parts) != 2 {
+			return EntityPair{}, false
+		}
+		ep := EntityPair{Entity: parts[0], EntityID: parts[1]}
+		return ep, ep.IsValid()
+	}
+	return EntityPair{}, false
+}
+
+// allowed checks if the caller can access route for the target entity pair
+func (auth *Authenticator) allowed(route string, caller EntityPair, target *EntityPair) bool {
+	for _, rule := range auth.policy[route] {
+		if rule == selfRule {
+			if target != nil && caller.CreateKey() == target.CreateKey() {
+				return true
+			}
+		} else if strings.ToLower(caller.Entity) == strings.ToLower(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateHandler rejects callers that can't be identified and stores the caller in the context
+func authenticateHandler(auth *Authenticator, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if auth == nil {
+			next(w, req)
+			return
+		}
+		caller, ok := auth.identify(req)
+		if !ok {
+			ErrorLog("unable to authenticate caller for %s", req.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		newCtx := context.WithValue(req.Context(), CallerIdentity, caller)
+		next(w, req.WithContext(newCtx))
+	}
+}
+
+// authorizeHandler checks the caller against the policy for the route,
+// must run after the request has been decoded so the target entity is known
+func authorizeHandler(auth *Authenticator, route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if auth == nil {
+			next(w, req)
+			return
+		}
+		ctx := req.Context()
+		caller, ok := ctx.Value(CallerIdentity).(EntityPair)
+		if !ok {
+			ErrorLog("unable to retrieve caller from ctx")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var target *EntityPair
+		if eid, ok := ctx.Value(DecodedJSON).(EntityIdentifier); ok {
+			target = eid.GetEntityPair()
+		}
+		if !auth.allowed(route, caller, target) {
+			ErrorLog("caller %s is not allowed on %s", caller.CreateKey(), route)
+			http.Error(w, "Caller is not authorized", http.StatusForbidden)
+			return
+		}
+		next(w, req)
+	}
+}
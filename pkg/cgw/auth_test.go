@@ -0,0 +1,130 @@
+package cgw
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestNewAuthenticator(t *testing.T) {
+	auth, err := NewAuthenticator(AuthSettings{
+		Enabled:    true,
+		TokensFile: "./test/auth/callers",
+		Policy: map[string][]string{
+			ValidateRoute: {"admin"},
+		},
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, len(auth.tokens), 3)
+	assert.DeepEqual(t, auth.policy[ValidateRoute], []string{"admin"})
+	assert.DeepEqual(t, auth.policy[DisconnectRoute], defaultPolicy[DisconnectRoute])
+
+	_, err = NewAuthenticator(AuthSettings{Enabled: true, TokensFile: "./test/auth/authFile"})
+	assert.Error(t, err, "malformed tokens file entry on line 1")
+}
+
+func TestAuthSettingsValidate(t *testing.T) {
+	assert.NilError(t, AuthSettings{}.validate())
+	testTable := map[string]AuthSettings{
+		"tokens file or mtls is required": {Enabled: true},
+		"route is not supported, flush": {
+			Enabled: true, MTLS: true, Policy: map[string][]string{"flush": {"admin"}},
+		},
+		"rule is not supported, car": {
+			Enabled: true, MTLS: true, Policy: map[string][]string{RefreshRoute: {"car"}},
+		},
+	}
+	for k, v := range testTable {
+		assert.Error(t, v.validate(), k)
+	}
+}
+
+func TestAuthHandlers(t *testing.T) {
+	auth, err := NewAuthenticator(AuthSettings{
+		Enabled:    true,
+		TokensFile: "./test/auth/callers",
+		MTLS:       true,
+	})
+	assert.NilError(t, err)
+
+	etr := &EntityTokenRequest{
+		EntityPair: EntityPair{
+			Entity:   "veh",
+			EntityID: "1234",
+		},
+		Token: "test.test",
+	}
+	// run a request with the target already decoded in the ctx
+	run := func(route string, bearer string, target interface{}) int {
+		called := false
+		handler := authenticateHandler(auth, func(w http.ResponseWriter, req *http.Request) {
+			ctx := context.WithValue(req.Context(), DecodedJSON, target)
+			authorizeHandler(auth, route, func(w http.ResponseWriter, req *http.Request) {
+				called = true
+				w.WriteHeader(http.StatusOK)
+			})(w, req.WithContext(ctx))
+		})
+		req := createTestRequest(t, nil, nil)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		assert.Equal(t, called, w.Code == http.StatusOK)
+		return w.Code
+	}
+
+	t.Run("authentication", func(t *testing.T) {
+		assert.Equal(t, run(RefreshRoute, "", etr), http.StatusUnauthorized)
+		assert.Equal(t, run(RefreshRoute, "bad.token", etr), http.StatusUnauthorized)
+		assert.Equal(t, run(RefreshRoute, "admin.token", etr), http.StatusOK)
+	})
+
+	t.Run("authorization", func(t *testing.T) {
+		// only admins can disconnect
+		dr := &DisconnectRequest{EntityPair: etr.EntityPair, ReasonCode: Reauthenticate}
+		assert.Equal(t, run(DisconnectRoute, "admin.token", dr), http.StatusOK)
+		assert.Equal(t, run(DisconnectRoute, "sw.token", dr), http.StatusForbidden)
+		assert.Equal(t, run(DisconnectRoute, "veh.token", dr), http.StatusForbidden)
+
+		// vehicles can only refresh themselves
+		assert.Equal(t, run(RefreshRoute, "veh.token", etr), http.StatusOK)
+		other := *etr
+		other.EntityID = "5678"
+		assert.Equal(t, run(RefreshRoute, "veh.token", &other), http.StatusForbidden)
+		assert.Equal(t, run(RefreshRoute, "sw.token", etr), http.StatusForbidden)
+	})
+
+	t.Run("mtls", func(t *testing.T) {
+		req := createTestRequest(t, nil, nil)
+		req.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{
+				{Subject: pkix.Name{CommonName: "veh-1234"}},
+			}},
+		}
+		caller, ok := auth.identify(req)
+		assert.Assert(t, ok)
+		assert.Equal(t, caller, etr.EntityPair)
+
+		// unknown bearer tokens fall back to the certificate, known ones take precedence
+		req.Header.Set("Authorization", "Bearer bad.token")
+		caller, ok = auth.identify(req)
+		assert.Assert(t, ok)
+		assert.Equal(t, caller, etr.EntityPair)
+		req.Header.Set("Authorization", "Bearer admin.token")
+		caller, ok = auth.identify(req)
+		assert.Assert(t, ok)
+		assert.Equal(t, caller.Entity, "admin")
+		req.Header.Del("Authorization")
+
+		req.TLS.VerifiedChains[0][0].Subject.CommonName = "bus-1234"
+		_, ok = auth.identify(req)
+		assert.Assert(t, !ok)
+	})
+}
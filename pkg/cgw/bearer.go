@@ -0,0 +1,279 @@
+package cgw
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default bearer token renewal values
+const (
+	defaultTokenWatchInterval  = 10 * time.Second
+	defaultOAuth2RenewBefore   = 60 * time.Second
+	defaultOAuth2RetryInterval = 5 * time.Second
+	defaultOAuth2Lifetime      = time.Hour
+)
+
+// OAuth2Settings represents settings for getting the caas bearer token with the oauth2
+// client credentials flow instead of reading it from the token file
+// ClientSecretFile has the client secret and is read on every request so it can be rotated,
+// RenewBefore is how long (seconds) before the token expires a new one is requested,
+// RetryInterval is how long (seconds) to wait before trying again after a failed request
+type OAuth2Settings struct {
+	Enabled          bool     `yaml:"enabled"`
+	TokenURL         string   `yaml:"tokenURL"`
+	ClientID         string   `yaml:"clientID"`
+	ClientSecretFile string   `yaml:"clientSecretFile"`
+	Scopes           []string `yaml:"scopes"`
+	RenewBefore      int      `yaml:"renewBefore"`
+	RetryInterval    int      `yaml:"retryInterval"`
+}
+
+// validate checks the oauth2 fields are consistent
+func (oa OAuth2Settings) validate() error {
+	if !oa.Enabled {
+		return nil
+	}
+	u, err := url.Parse(oa.TokenURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid token url, %s", oa.TokenURL)
+	}
+	if IsEmpty(oa.ClientID) || IsEmpty(oa.ClientSecretFile) {
+		return errors.New("client id and client secret file are required")
+	}
+	if oa.RenewBefore < 0 || oa.RetryInterval < 0 {
+		return errors.New("renew before and retry interval can't be negative")
+	}
+	return nil
+}
+
+// tokenSource gets the bearer token, token is empty if it hasn't changed since
+// the last fetch and next is how long to wait before fetching again
+type tokenSource interface {
+	fetch(ctx context.Context) (token string, next time.Duration, err error)
+}
+
+// BearerToken is the token the gateway presents to caas, it's kept up to date
+// from its source in the background and is safe for concurrent use
+type BearerToken struct {
+	mu      sync.RWMutex
+	token   string
+	source  tokenSource
+	next    time.Duration
+	changed chan struct{}
+}
+
+// NewBearerToken gets the first token from the token file, or from the oauth2
+// token url when oauth2 is enabled
+func NewBearerToken(cfg Config) (*BearerToken, error) {
+	var source tokenSource
+	if cfg.OAuth2.Enabled {
+		source = newOAuth2TokenSource(cfg.OAuth2)
+	} else {
+		interval := defaultTokenWatchInterval
+		if cfg.TokenWatchInterval > 0 {
+			interval = time.Duration(cfg.TokenWatchInterval) * time.Second
+		}
+		source = &fileTokenSource{path: cfg.TokenFile, interval: interval}
+	}
+	token, next, err := source.fetch(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &BearerToken{
+		token:   token,
+		source:  source,
+		next:    next,
+		changed: make(chan struct{}, 1),
+	}, nil
+}
+
+// Get returns the current token
+func (bt *BearerToken) Get() string {
+	bt.mu.RLock()
+	defer bt.mu.RUnlock()
+	return bt.token
+}
+
+// Set overrides the token until the source renews it
+func (bt *BearerToken) Set(token string) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.token = token
+}
+
+// replace switches to the token and source of other, used when the settings change
+func (bt *BearerToken) replace(other *BearerToken) {
+	bt.mu.Lock()
+	bt.token = other.token
+	bt.source = other.source
+	bt.next = other.next
+	bt.mu.Unlock()
+	select {
+	case bt.changed <- struct{}{}:
+	default:
+	}
+}
+
+// watch renews the token from its source until ctx is done
+func (bt *BearerToken) watch(ctx context.Context) {
+	if bt.source == nil {
+		return
+	}
+	bt.mu.RLock()
+	timer := time.NewTimer(bt.next)
+	bt.mu.RUnlock()
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			bt.mu.RLock()
+			source := bt.source
+			bt.mu.RUnlock()
+			token, next, err := source.fetch(ctx)
+			if err != nil {
+				ErrorLog("unable to renew bearer token, %s", err)
+			} else if !IsEmpty(token) {
+				bt.mu.Lock()
+				// the source may have been replaced while we were fetching
+				if bt.source == source {
+					bt.token = token
+					DebugLog("bearer token renewed")
+				}
+				bt.mu.Unlock()
+			}
+			timer.Reset(next)
+		case <-bt.changed:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			bt.mu.RLock()
+			timer.Reset(bt.next)
+			bt.mu.RUnlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fileTokenSource reads the token file again whenever it's modified,
+// kubernetes updates mounted secrets in place when they're rotated
+type fileTokenSource struct {
+	path     string
+	interval time.Duration
+	modTime  time.Time
+}
+
+// fetch reads the token file if it changed since the last read
+func (fs *fileTokenSource) fetch(ctx context.Context) (string, time.Duration, error) {
+	info, err := os.Stat(fs.path)
+	if err != nil {
+		return "", fs.interval, fmt.Errorf("can't read the token file, %s", fs.path)
+	}
+	if info.ModTime().Equal(fs.modTime) {
+		return "", fs.interval, nil
+	}
+	token, err := readTokenFile(fs.path)
+	if err != nil {
+		return "", fs.interval, err
+	}
+	fs.modTime = info.ModTime()
+	return token, fs.interval, nil
+}
+
+// readTokenFile reads the bearer token used with caas
+func readTokenFile(path string) (string, error) {
+	tBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("can't read the token file, %s", path)
+	}
+	if IsEmpty(string(tBytes)) {
+		return "", errors.New("token is empty")
+	}
+	return string(tBytes), nil
+}
+
+// oauth2TokenSource requests tokens with the client credentials grant
+type oauth2TokenSource struct {
+	settings    OAuth2Settings
+	renewBefore time.Duration
+	retry       time.Duration
+	client      *http.Client
+}
+
+// oauth2Token is the successful response from the token url
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// newOAuth2TokenSource creates the source from settings
+func newOAuth2TokenSource(settings OAuth2Settings) *oauth2TokenSource {
+	ots := &oauth2TokenSource{
+		settings:    settings,
+		renewBefore: defaultOAuth2RenewBefore,
+		retry:       defaultOAuth2RetryInterval,
+		client:      defaultHTTPClient,
+	}
+	if settings.RenewBefore > 0 {
+		ots.renewBefore = time.Duration(settings.RenewBefore) * time.Second
+	}
+	if settings.RetryInterval > 0 {
+		ots.retry = time.Duration(settings.RetryInterval) * time.Second
+	}
+	return ots
+}
+
+// fetch requests a new token, it's renewed renewBefore ahead of its expiry
+func (ots *oauth2TokenSource) fetch(ctx context.Context) (string, time.Duration, error) {
+	secret, err := ioutil.ReadFile(ots.settings.ClientSecretFile)
+	if err != nil {
+		return "", ots.retry, fmt.Errorf("can't read the client secret file, %s", ots.settings.ClientSecretFile)
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(ots.settings.Scopes) > 0 {
+		form.Set("scope", strings.Join(ots.settings.Scopes, " "))
+	}
+	// client credentials are form encoded before they're joined, see rfc 6749 2.3.1
+	creds := url.QueryEscape(ots.settings.ClientID) + ":" + url.QueryEscape(strings.TrimSpace(string(secret)))
+	header := map[string]string{
+		"Content-Type":  "application/x-www-form-urlencoded",
+		"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(creds)),
+	}
+	resp, err := doHTTPRequest(ctx, ots.client, "POST", ots.settings.TokenURL, header, nil,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", ots.retry, err
+	}
+	if resp.status != http.StatusOK {
+		DebugLog("body response from token url %s", resp.body)
+		return "", ots.retry, fmt.Errorf("bad response from token url, %d", resp.status)
+	}
+	token := oauth2Token{}
+	if err := json.Unmarshal(resp.body, &token); err != nil {
+		return "", ots.retry, fmt.Errorf("decoding json response from token url failed, %s", err)
+	}
+	if IsEmpty(token.AccessToken) {
+		return "", ots.retry, errors.New("token url returned an empty access token")
+	}
+	lifetime := defaultOAuth2Lifetime
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+	// don't hammer the token url when tokens are short lived
+	next := lifetime - ots.renewBefore
+	if next < lifetime/2 {
+		next = lifetime / 2
+	}
+	return token.AccessToken, next, nil
+}
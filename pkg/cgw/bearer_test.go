@@ -0,0 +1,98 @@
+package cgw
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestOAuth2Settings(t *testing.T) {
+	testTable := map[string]OAuth2Settings{
+		"invalid token url":                {Enabled: true, TokenURL: "token"},
+		"client id and client secret file": {Enabled: true, TokenURL: "http://localhost/token", ClientID: "cgw"},
+		"retry interval can't be negative": {Enabled: true, TokenURL: "http://localhost/token", ClientID: "cgw", ClientSecretFile: "secret", RetryInterval: -1},
+	}
+	for k, v := range testTable {
+		assert.ErrorContains(t, v.validate(), k)
+	}
+	assert.NilError(t, OAuth2Settings{TokenURL: "token"}.validate())
+}
+
+func TestFileBearerToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgw")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	assert.NilError(t, ioutil.WriteFile(path, []byte("first.test"), 0644))
+
+	bt, err := NewBearerToken(Config{TokenFile: path, TokenWatchInterval: 1})
+	assert.NilError(t, err)
+	assert.Equal(t, bt.Get(), "first.test")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bt.watch(ctx)
+
+	// rotated tokens are picked up once the file changes
+	modTime := time.Now().Add(time.Minute)
+	assert.NilError(t, ioutil.WriteFile(path, []byte("second.test"), 0644))
+	assert.NilError(t, os.Chtimes(path, modTime, modTime))
+	for i := 0; i < 30 && bt.Get() != "second.test"; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, bt.Get(), "second.test")
+
+	_, err = NewBearerToken(Config{TokenFile: filepath.Join(dir, "missing")})
+	assert.ErrorContains(t, err, "can't read the token file")
+}
+
+func TestOAuth2BearerToken(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id, secret, ok := req.BasicAuth()
+		if !ok || id != "cgw" || secret != "test.test" || req.FormValue("grant_type") != "client_credentials" ||
+			req.FormValue("scope") != "caas.write caas.read" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// expires straight away so it's renewed
+			json.NewEncoder(w).Encode(oauth2Token{AccessToken: "first.test", TokenType: "bearer", ExpiresIn: 1})
+			return
+		}
+		json.NewEncoder(w).Encode(oauth2Token{AccessToken: "second.test", TokenType: "bearer", ExpiresIn: 3600})
+	}))
+	defer srv.Close()
+	settings := OAuth2Settings{
+		Enabled:          true,
+		TokenURL:         srv.URL,
+		ClientID:         "cgw",
+		ClientSecretFile: "./test/auth/tokenFile",
+		Scopes:           []string{"caas.write", "caas.read"},
+	}
+
+	bt, err := NewBearerToken(Config{OAuth2: settings})
+	assert.NilError(t, err)
+	assert.Equal(t, bt.Get(), "first.test")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bt.watch(ctx)
+	for i := 0; i < 30 && bt.Get() != "second.test"; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, bt.Get(), "second.test")
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(2))
+
+	// bad credentials are reported
+	settings.ClientID = "other"
+	_, err = NewBearerToken(Config{OAuth2: settings})
+	assert.ErrorContains(t, err, "bad response from token url, 401")
+}
@@ -0,0 +1,264 @@
+package cgw
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// BulkDisconnectEndpoint is where bulk disconnect jobs are created and polled
+const BulkDisconnectEndpoint = "/cgw/v1/disconnect/bulk"
+
+// defaults for bulk disconnects
+const (
+	defaultBulkConcurrency = 8
+	defaultBulkRetain      = time.Hour
+	bulkJobIDLength        = 8
+)
+
+// BulkSettings represents settings for bulk disconnects
+// Concurrency is the number of entities disconnected at the same time,
+// Retain is how long (seconds) finished jobs can still be polled
+type BulkSettings struct {
+	Concurrency int `yaml:"concurrency"`
+	Retain      int `yaml:"retain"`
+}
+
+// validate checks the bulk fields are consistent
+func (bs BulkSettings) validate() error {
+	if bs.Concurrency < 0 || bs.Retain < 0 {
+		return fmt.Errorf("values can't be negative; concurrency: %d, retain: %d", bs.Concurrency, bs.Retain)
+	}
+	return nil
+}
+
+// Different bulk job and entity statuses
+const (
+	BulkJobRunning = "running"
+	BulkJobDone    = "done"
+	BulkJobFailed  = "failed"
+	BulkSuccess    = "success"
+	BulkFailure    = "failure"
+	BulkNotFound   = "not_found"
+)
+
+// BulkResult is the outcome of disconnecting one entity in a bulk job
+type BulkResult struct {
+	EntityPair
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BulkJob is the progress of a bulk disconnect
+type BulkJob struct {
+	ID         string       `json:"id"`
+	Status     string       `json:"status"`
+	ReasonCode ReasonCode   `json:"reasonCode"`
+	Total      int          `json:"total"`
+	Succeeded  int          `json:"succeeded"`
+	Failed     int          `json:"failed"`
+	Error      string       `json:"error,omitempty"`
+	StartedAt  int64        `json:"startedAt"`
+	FinishedAt int64        `json:"finishedAt,omitempty"`
+	Results    []BulkResult `json:"results"`
+}
+
+// BulkJobs keeps track of bulk disconnect jobs on this gateway
+type BulkJobs struct {
+	mu     sync.Mutex
+	jobs   map[string]*BulkJob
+	retain time.Duration
+}
+
+// NewBulkJobs creates a job tracker
+func NewBulkJobs(settings BulkSettings) *BulkJobs {
+	bj := &BulkJobs{
+		jobs:   map[string]*BulkJob{},
+		retain: defaultBulkRetain,
+	}
+	if settings.Retain > 0 {
+		bj.retain = time.Duration(settings.Retain) * time.Second
+	}
+	return bj
+}
+
+// create starts tracking a new job and drops finished jobs past retention
+func (bj *BulkJobs) create(rc ReasonCode) (string, error) {
+	b := make([]byte, bulkJobIDLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	bj.mu.Lock()
+	defer bj.mu.Unlock()
+	for id, job := range bj.jobs {
+		if job.FinishedAt != 0 && now.Sub(time.Unix(job.FinishedAt, 0)) > bj.retain {
+			delete(bj.jobs, id)
+		}
+	}
+	id := hex.EncodeToString(b)
+	bj.jobs[id] = &BulkJob{
+		ID:         id,
+		Status:     BulkJobRunning,
+		ReasonCode: rc,
+		StartedAt:  now.Unix(),
+		Results:    []BulkResult{},
+	}
+	return id, nil
+}
+
+// get returns a copy of the job
+func (bj *BulkJobs) get(id string) (BulkJob, bool) {
+	bj.mu.Lock()
+	defer bj.mu.Unlock()
+	job, ok := bj.jobs[id]
+	if !ok {
+		return BulkJob{}, false
+	}
+	cp := *job
+	cp.Results = append([]BulkResult{}, job.Results...)
+	return cp, true
+}
+
+// update changes the job under the lock
+func (bj *BulkJobs) update(id string, fn func(*BulkJob)) {
+	bj.mu.Lock()
+	defer bj.mu.Unlock()
+	if job, ok := bj.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+// record adds the outcome of one entity to the job
+func (bj *BulkJobs) record(id string, result BulkResult) {
+	bj.update(id, func(job *BulkJob) {
+		if result.Status == BulkFailure {
+			job.Failed++
+		} else {
+			job.Succeeded++
+		}
+		job.Results = append(job.Results, result)
+	})
+}
+
+// finish marks the job as done, or failed if err is set
+func (bj *BulkJobs) finish(id string, err error) {
+	bj.update(id, func(job *BulkJob) {
+		job.Status = BulkJobDone
+		if err != nil {
+			job.Status = BulkJobFailed
+			job.Error = err.Error()
+		}
+		job.FinishedAt = time.Now().Unix()
+	})
+}
+
+// selectEntities resolves the selector in the request to entity pairs
+func selectEntities(ctx context.Context, kv KeyValueStore, req BulkDisconnectRequest) ([]EntityPair, error) {
+	if len(req.Entities) > 0 {
+		return req.Entities, nil
+	}
+	entities := entityTypes
+	if !IsEmpty(req.Entity) {
+		entities = []string{strings.ToLower(req.Entity)}
+	}
+	selected := []EntityPair{}
+	for _, entity := range entities {
+		err := scanRecords(ctx, kv, entity, func(rec EntityRecord) {
+			if strings.HasPrefix(rec.EntityID, req.EntityIDPrefix) {
+				selected = append(selected, rec.EntityPair)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return selected, nil
+}
+
+// runBulkDisconnect disconnects the selected entities with bounded concurrency
+func (cgw *CAASGateway) runBulkDisconnect(ctx context.Context, id string, req BulkDisconnectRequest) {
+	eps, err := selectEntities(ctx, cgw.kv, req)
+	if err != nil {
+		ErrorLog("unable to select entities for bulk job %s, %s", id, err)
+		cgw.bulkJobs.finish(id, err)
+		return
+	}
+	cgw.bulkJobs.update(id, func(job *BulkJob) {
+		job.Total = len(eps)
+	})
+	DebugLog("bulk job %s disconnecting %d entities", id, len(eps))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, cgw.bulkConcurrency)
+	for _, ep := range eps {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(ep EntityPair) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			result := BulkResult{EntityPair: ep, Status: BulkSuccess}
+			found, err := cgw.removeEntity(ctx, ep, req.ReasonCode, nil)
+			if err != nil {
+				ErrorLog("bulk job %s unable to disconnect %s, %s", id, ep.CreateKey(), err)
+				result.Status = BulkFailure
+				result.Error = err.Error()
+			} else if !found {
+				result.Status = BulkNotFound
+			}
+			cgw.bulkJobs.record(id, result)
+		}(ep)
+	}
+	wg.Wait()
+	cgw.bulkJobs.finish(id, nil)
+}
+
+// bulkDisconnectHandler starts a bulk disconnect job
+// returns 202 with the job id, progress is polled on the job endpoint
+func bulkDisconnectHandler(jobs *BulkJobs, run func(string, BulkDisconnectRequest)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		bReq := &BulkDisconnectRequest{}
+		if !getReqFromContext(req.Context(), w, BulkDisconnectReq, bReq) {
+			return
+		}
+		id, err := jobs.create(bReq.ReasonCode)
+		if err != nil {
+			ErrorLog("unable to create bulk job, %s", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		DebugLog("bulk job %s created, %+v", id, bReq)
+		go run(id, *bReq)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", BulkDisconnectEndpoint+"/"+id)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"id": id, "status": BulkJobRunning})
+	}
+}
+
+// bulkJobHandler reports the progress and results of a bulk job
+// returns 404 if the job doesn't exist or is past retention
+func bulkJobHandler(jobs *BulkJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := mux.Vars(req)["id"]
+		job, ok := jobs.get(id)
+		if !ok {
+			ErrorLog("bulk job does not exist, %s", id)
+			http.Error(w, "Job does not exist", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(job)
+	}
+}
@@ -0,0 +1,196 @@
+package cgw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrCAASNotFound is returned when caas doesn't have the entity/token mapping
+var ErrCAASNotFound = errors.New("entity/token mapping not found in caas")
+
+// ConflictError is returned when caas already maps the token, Existing is the
+// entity pair caas has for it
+type ConflictError struct {
+	Existing EntityPair
+}
+
+// Error describes the conflict
+func (ce *ConflictError) Error() string {
+	return fmt.Sprintf("token already exists in caas for %s", ce.Existing.CreateKey())
+}
+
+// UpstreamError is returned when caas answers with an unexpected status
+type UpstreamError struct {
+	Status int
+	Body   []byte
+}
+
+// Error describes the response
+func (ue *UpstreamError) Error() string {
+	return fmt.Sprintf("bad response from caas, %d", ue.Status)
+}
+
+// CAASClient is the api gateways use to keep caas in sync with their tokens,
+// bearerToken authenticates the gateway with caas
+type CAASClient interface {
+	// CreateToken maps the token to the entity pair, returns *ConflictError if the token is taken
+	CreateToken(ctx context.Context, req ValidateTokenRequest, bearerToken string) error
+	// DeleteEntity removes the mapping, returns ErrCAASNotFound if caas doesn't have it
+	DeleteEntity(ctx context.Context, req ValidateTokenRequest, bearerToken string) error
+}
+
+// BreakerReporter is implemented by caas clients that fail fast behind a circuit breaker
+type BreakerReporter interface {
+	Breaker() BreakerStatus
+}
+
+// CAASAPIVersion represents the caas api the gateway talks to
+type CAASAPIVersion string
+
+// Different caas api versions
+const (
+	// CAASv1 posts json entity/token requests to the create and delete endpoints
+	CAASv1 CAASAPIVersion = "v1"
+)
+
+// NewCAASClient creates the client for the configured caas api version
+func NewCAASClient(settings CAASSettings) (CAASClient, error) {
+	switch settings.APIVersion {
+	case CAASv1, "":
+		return newCAASv1Client(settings)
+	}
+	return nil, fmt.Errorf("caas api version is not supported, %s", settings.APIVersion)
+}
+
+// caasV1Client talks to the v1 caas api
+type caasV1Client struct {
+	upstream  *UpstreamClient
+	createURL string
+	deleteURL string
+}
+
+// newCAASv1Client creates a v1 client with its own upstream client
+func newCAASv1Client(settings CAASSettings) (*caasV1Client, error) {
+	upstream, err := NewUpstreamClient(settings)
+	if err != nil {
+		return nil, err
+	}
+	cc := &caasV1Client{upstream: upstream}
+	cc.createURL, err = URLJoin(settings.Server, settings.CreateEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("unable to join caas create url, %s", err)
+	}
+	cc.deleteURL, err = URLJoin(settings.Server, settings.DeleteEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("unable to join caas delete entityid url, %s", err)
+	}
+	return cc, nil
+}
+
+// CreateToken posts the mapping to the create endpoint
+func (cc *caasV1Client) CreateToken(ctx context.Context, req ValidateTokenRequest, bearerToken string) error {
+	// creating a token isn't idempotent, a repeat gets a conflict
+	resp, err := cc.upstream.Post(ctx, "create", cc.createURL, bearerToken, req, false)
+	if err != nil {
+		return err
+	}
+	switch resp.status {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		// we should only get here if the tokens match
+		// check if json is formed correctly and not empty
+		existing := EntityPair{}
+		if err := json.Unmarshal(resp.body, &existing); err != nil {
+			return fmt.Errorf("decoding json response from caas failed, %s", err)
+		}
+		if !existing.IsValid() {
+			return errors.New("received empty response from caas, entity exists")
+		}
+		return &ConflictError{Existing: existing}
+	}
+	DebugLog("body response from caas %s", resp.body)
+	return &UpstreamError{Status: resp.status, Body: resp.body}
+}
+
+// DeleteEntity posts the mapping to the delete endpoint
+func (cc *caasV1Client) DeleteEntity(ctx context.Context, req ValidateTokenRequest, bearerToken string) error {
+	// deleting is idempotent since a missing mapping is already gone
+	resp, err := cc.upstream.Post(ctx, "delete", cc.deleteURL, bearerToken, req, true)
+	if err != nil {
+		return err
+	}
+	switch resp.status {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return ErrCAASNotFound
+	}
+	return &UpstreamError{Status: resp.status, Body: resp.body}
+}
+
+// Breaker returns the state of the circuit breaker in front of caas
+func (cc *caasV1Client) Breaker() BreakerStatus {
+	return cc.upstream.Breaker()
+}
+
+// caasDeleteEntity removes the entity/token mapping from caas
+// returns true if caas didn't have the mapping
+func caasDeleteEntity(ctx context.Context, caas CAASClient,
+	ep EntityPair, token string, mecID string, bearerToken string) (bool, error) {
+	DebugLog("sending delete to caas for %s", ep.CreateKey())
+	err := caas.DeleteEntity(ctx, ValidateTokenRequest{
+		EntityTokenRequest: EntityTokenRequest{
+			EntityPair: ep,
+			Token:      token,
+		},
+		MEC: mecID,
+	}, bearerToken)
+	if err == ErrCAASNotFound {
+		// if entityid/token mapping is not found, swallow the error for now since its gone already
+		ErrorLog("unable to find entityid in caas, %s", ep.CreateKey())
+		return true, nil
+	}
+	var upErr *UpstreamError
+	if errors.As(err, &upErr) {
+		ErrorLog("bad response from caas, got back %d from caas, %s", upErr.Status, upErr.Body)
+	}
+	return false, err
+}
+
+// caasRotateToken registers the new token with caas then removes the old mapping,
+// the new mapping is removed again if the old one can't be so a retry isn't a conflict
+func caasRotateToken(caas CAASClient, mecID readMECCb, bearerToken readTokenCb) rotateTokenCb {
+	return func(ctx context.Context, ep EntityPair, oldToken string, newToken string) error {
+		err := caas.CreateToken(ctx, ValidateTokenRequest{
+			EntityTokenRequest: EntityTokenRequest{
+				EntityPair: ep,
+				Token:      newToken,
+			},
+			MEC: mecID(),
+		}, bearerToken())
+		if err != nil {
+			return err
+		}
+		_, err = caasDeleteEntity(ctx, caas, ep, oldToken, mecID(), bearerToken())
+		if err != nil {
+			// the caller might have given up already, the client timeout bounds the rollback
+			_, rbErr := caasDeleteEntity(context.Background(), caas, ep, newToken, mecID(), bearerToken())
+			if rbErr != nil {
+				ErrorLog("unable to roll back new token for %s, %s", ep.CreateKey(), rbErr)
+			}
+		}
+		return err
+	}
+}
+
+// caasStatusCode is the status returned to clients when a caas call fails
+func caasStatusCode(err error) int {
+	if err == ErrCircuitOpen {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,155 @@
+package cgw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// fakeCAAS returns err from every call and records the requests
+type fakeCAAS struct {
+	err      error
+	requests []ValidateTokenRequest
+}
+
+func (fc *fakeCAAS) CreateToken(ctx context.Context, req ValidateTokenRequest, bearerToken string) error {
+	fc.requests = append(fc.requests, req)
+	return fc.err
+}
+
+func (fc *fakeCAAS) DeleteEntity(ctx context.Context, req ValidateTokenRequest, bearerToken string) error {
+	fc.requests = append(fc.requests, req)
+	return fc.err
+}
+
+// failDeleteCAAS fails deletes of a single token
+type failDeleteCAAS struct {
+	fakeCAAS
+	token string
+}
+
+func (fc *failDeleteCAAS) DeleteEntity(ctx context.Context, req ValidateTokenRequest, bearerToken string) error {
+	fc.requests = append(fc.requests, req)
+	if req.Token == fc.token {
+		return errors.New("delete failed")
+	}
+	return nil
+}
+
+func TestCAASRotateToken(t *testing.T) {
+	ctx := context.Background()
+	ep := EntityPair{"veh", "1234"}
+	caas := &failDeleteCAAS{token: "old.test"}
+	rotate := caasRotateToken(caas, gw.GetMEC, gw.GetToken)
+
+	// the new token is dropped again when the old one can't be
+	assert.ErrorContains(t, rotate(ctx, ep, "old.test", "new.test"), "delete failed")
+	tokens := []string{}
+	for _, req := range caas.requests {
+		tokens = append(tokens, req.Token)
+	}
+	assert.DeepEqual(t, tokens, []string{"new.test", "old.test", "new.test"})
+
+	caas.requests = nil
+	caas.token = ""
+	assert.NilError(t, rotate(ctx, ep, "old.test", "new.test"))
+	assert.Equal(t, len(caas.requests), 2)
+}
+
+func TestNewCAASClient(t *testing.T) {
+	_, err := NewCAASClient(CAASSettings{APIVersion: "v2", Server: "http://localhost:9090"})
+	assert.ErrorContains(t, err, "caas api version is not supported, v2")
+	_, err = NewCAASClient(CAASSettings{Server: "localhost:9090"})
+	assert.ErrorContains(t, err, "unable to join caas create url")
+}
+
+func TestCAASv1Client(t *testing.T) {
+	ctx := context.Background()
+	defer sm.ClearDB()
+	req := ValidateTokenRequest{
+		EntityTokenRequest: EntityTokenRequest{
+			EntityPair: EntityPair{"veh", "1234"},
+			Token:      "test.test",
+		},
+		MEC: "local.mec",
+	}
+	assert.NilError(t, gw.settings().caas.CreateToken(ctx, req, gw.GetToken()))
+
+	// the same token can't be mapped twice
+	taken := req
+	taken.EntityID = "5678"
+	err := gw.settings().caas.CreateToken(ctx, taken, gw.GetToken())
+	conflict := &ConflictError{}
+	assert.Assert(t, errors.As(err, &conflict))
+	assert.Equal(t, conflict.Existing, req.EntityPair)
+
+	failed := req
+	failed.Token = "fail.test"
+	err = gw.settings().caas.CreateToken(ctx, failed, gw.GetToken())
+	upErr := &UpstreamError{}
+	assert.Assert(t, errors.As(err, &upErr))
+	assert.Equal(t, upErr.Status, http.StatusBadRequest)
+
+	assert.NilError(t, gw.settings().caas.DeleteEntity(ctx, req, gw.GetToken()))
+	assert.Equal(t, gw.settings().caas.DeleteEntity(ctx, req, gw.GetToken()), ErrCAASNotFound)
+}
+
+func TestCreateTokenCAASErrors(t *testing.T) {
+	etr := &EntityTokenRequest{
+		EntityPair: EntityPair{"veh", "1234"},
+		Token:      "test.test",
+	}
+	testTable := map[string]struct {
+		err    error
+		status int
+	}{
+		"conflict":     {&ConflictError{Existing: EntityPair{"veh", "5678"}}, http.StatusConflict},
+		"upstream":     {&UpstreamError{Status: http.StatusBadRequest}, http.StatusBadRequest},
+		"circuit_open": {ErrCircuitOpen, http.StatusServiceUnavailable},
+		"unreachable":  {errors.New("connection refused"), http.StatusInternalServerError},
+	}
+	for name, tc := range testTable {
+		t.Run(name, func(t *testing.T) {
+			ms := NewMemoryStore()
+			caas := &fakeCAAS{err: tc.err}
+			w := httptest.NewRecorder()
+			createNewTokenHandler(ms, ExpirySettings{}, nil, caas, gw.GetMEC, gw.GetToken)(w,
+				createTestRequest(t, nil, etr))
+			assert.Equal(t, w.Code, tc.status)
+			assert.Equal(t, len(caas.requests), 1)
+			assert.Equal(t, caas.requests[0].MEC, "local.mec")
+			_, err := ms.Get(context.Background(), etr.CreateKey())
+			assert.Equal(t, err, ErrKeyNotFound)
+		})
+	}
+
+	// the conflicting entity is returned to the caller
+	w := httptest.NewRecorder()
+	createNewTokenHandler(NewMemoryStore(), ExpirySettings{}, nil, &fakeCAAS{err: testTable["conflict"].err},
+		gw.GetMEC, gw.GetToken)(w, createTestRequest(t, nil, etr))
+	existing := EntityPair{}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &existing))
+	assert.Equal(t, existing, EntityPair{"veh", "5678"})
+}
+
+func TestDisconnectCAASNotFound(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore()
+	ep := EntityPair{"veh", "1234"}
+	assert.NilError(t, setRecord(ctx, ms, EntityRecord{EntityPair: ep, Token: "test.test"}))
+	caas := &fakeCAAS{err: ErrCAASNotFound}
+	w := httptest.NewRecorder()
+	disconnectHandler(&recordingDisconnecter{}, ms, caas, map[ReasonCode]bool{NotAuthorized: true},
+		gw.GetMEC, gw.GetToken, nil, nil)(w, createTestRequest(t, nil, &DisconnectRequest{
+		EntityPair: ep,
+		ReasonCode: NotAuthorized,
+	}))
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("caas-verification"), "skipped")
+	assert.Equal(t, caas.requests[0].Token, "test.test")
+}
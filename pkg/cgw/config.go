@@ -2,28 +2,44 @@ package cgw
 
 import (
 	"bytes"
-	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
-	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 // Config represents the configuration file
 type Config struct {
-	MECID              string        `yaml:"mecID"`
-	MaxHeaderBytes     int           `yaml:"maxHeaderBytes"`
-	ReadTimeout        int           `yaml:"readTimeout"`
-	WriteTimeout       int           `yaml:"writeTimeout"`
-	HandlerTimeout     int           `yaml:"handlerTimeout"`
-	Port               string        `yaml:"port"`
-	TokenFile          string        `yaml:"tokenFile"`
-	UpstreamReasonCode []ReasonCode  `yaml:"upstreamReasonCode"`
-	MQTT               MQTTSettings  `yaml:"mqtt"`
-	CAAS               CAASSettings  `yaml:"caas"`
-	Redis              RedisSettings `yaml:"redis"`
-	DebugSettings      DebugSettings `yaml:"debug"`
+	MECID              string            `yaml:"mecID"`
+	MaxHeaderBytes     int               `yaml:"maxHeaderBytes"`
+	ReadTimeout        int               `yaml:"readTimeout"`
+	WriteTimeout       int               `yaml:"writeTimeout"`
+	HandlerTimeout     int               `yaml:"handlerTimeout"`
+	Port               string            `yaml:"port"`
+	TokenFile          string            `yaml:"tokenFile"`
+	TokenWatchInterval int               `yaml:"tokenWatchInterval"`
+	OAuth2             OAuth2Settings    `yaml:"oauth2"`
+	UpstreamReasonCode []ReasonCode      `yaml:"upstreamReasonCode"`
+	Store              StoreType         `yaml:"store"`
+	Disconnecter       DisconnecterType  `yaml:"disconnecter"`
+	Expiry             ExpirySettings    `yaml:"expiry"`
+	Refresh            RefreshSettings   `yaml:"refresh"`
+	TLS                TLSSettings       `yaml:"tls"`
+	Auth               AuthSettings      `yaml:"auth"`
+	MetricsEndpoint    string            `yaml:"metricsEndpoint"`
+	Health             HealthSettings    `yaml:"health"`
+	Handover           HandoverSettings  `yaml:"handover"`
+	RateLimit          RateLimitSettings `yaml:"rateLimit"`
+	Idle               IdleSettings      `yaml:"idle"`
+	Bulk               BulkSettings      `yaml:"bulk"`
+	TokenHash          TokenHashSettings `yaml:"tokenHash"`
+	MQTT               MQTTSettings      `yaml:"mqtt"`
+	CAAS               CAASSettings      `yaml:"caas"`
+	Redis              RedisSettings     `yaml:"redis"`
+	DebugSettings      DebugSettings     `yaml:"debug"`
+	Reload             ReloadSettings    `yaml:"reload"`
 }
 
 // DebugSettings represents debug settings
@@ -35,13 +51,56 @@ type DebugSettings struct {
 	DebugLog       bool   `yaml:"debugLog"`
 }
 
+// ExpirySettings represents token expiration settings, all values are in seconds
+type ExpirySettings struct {
+	DefaultTTL    int `yaml:"defaultTTL"`
+	MaxTTL        int `yaml:"maxTTL"`
+	SweepInterval int `yaml:"sweepInterval"`
+}
+
+// default interval between expiry sweeps
+const defaultSweepInterval = 30 * time.Second
+
+// TTL resolves the token lifetime from the requested ttl, zero means the token never expires
+func (es ExpirySettings) TTL(requested int) time.Duration {
+	ttl := es.DefaultTTL
+	if requested > 0 {
+		ttl = requested
+	}
+	if es.MaxTTL > 0 && (ttl == 0 || ttl > es.MaxTTL) {
+		ttl = es.MaxTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// Interval returns how often the expiry sweeper runs
+func (es ExpirySettings) Interval() time.Duration {
+	if es.SweepInterval <= 0 {
+		return defaultSweepInterval
+	}
+	return time.Duration(es.SweepInterval) * time.Second
+}
+
+// RefreshSettings represents token refresh settings
+// GracePeriod is how long (seconds) the replaced token keeps validating after a refresh,
+// NotifyCAAS registers the new token with caas and drops the old one on every refresh
+type RefreshSettings struct {
+	GracePeriod int  `yaml:"gracePeriod"`
+	NotifyCAAS  bool `yaml:"notifyCAAS"`
+}
+
 // MQTTSettings represents settings for MQTT
 type MQTTSettings struct {
-	Server      string      `yaml:"server"`
-	SuccessCode byte        `yaml:"successCode"`
-	AuthType    AuthType    `yaml:"authType"`
-	AuthFile    string      `yaml:"authFile"`
-	CRS         CRSSettings `yaml:"crs"`
+	Server       string           `yaml:"server"`
+	SuccessCode  byte             `yaml:"successCode"`
+	AuthType     AuthType         `yaml:"authType"`
+	AuthFile     string           `yaml:"authFile"`
+	CRS          CRSSettings      `yaml:"crs"`
+	V5           MQTTv5Settings   `yaml:"v5"`
+	DynSec       DynSecSettings   `yaml:"dynsec"`
+	REST         RESTSettings     `yaml:"rest"`
+	Brokers      []BrokerSettings `yaml:"brokers"`
+	FanOutPolicy FanOutPolicy     `yaml:"fanOutPolicy"`
 }
 
 // CRSSettings represents settings for CRS
@@ -53,21 +112,73 @@ type CRSSettings struct {
 }
 
 // CAASSettings represents settings for CAAS
+// Timeout, IdleConnTimeout and RetryBackoff are in milliseconds, Retries only applies to
+// idempotent calls, APIVersion picks the caas api and defaults to v1
 type CAASSettings struct {
-	Server         string `yaml:"server"`
-	CreateEndpoint string `yaml:"createEndpoint"`
-	DeleteEndpoint string `yaml:"deleteEndpoint"`
+	APIVersion      CAASAPIVersion  `yaml:"apiVersion"`
+	Server          string          `yaml:"server"`
+	CreateEndpoint  string          `yaml:"createEndpoint"`
+	DeleteEndpoint  string          `yaml:"deleteEndpoint"`
+	Timeout         int             `yaml:"timeout"`
+	MaxIdleConns    int             `yaml:"maxIdleConns"`
+	IdleConnTimeout int             `yaml:"idleConnTimeout"`
+	Retries         int             `yaml:"retries"`
+	RetryBackoff    int             `yaml:"retryBackoff"`
+	Breaker         BreakerSettings `yaml:"breaker"`
 }
 
+// RedisMode represents the redis deployment topology
+type RedisMode string
+
+// Different redis modes
+const (
+	RedisSingle   RedisMode = "single"
+	RedisSentinel RedisMode = "sentinel"
+	RedisCluster  RedisMode = "cluster"
+)
+
 // RedisSettings represents settings for Redis
 type RedisSettings struct {
-	Server   string `yaml:"server"`
-	AuthFile string `yaml:"authFile"`
-	DBIndex  int    `yaml:"DBIndex"`
+	Mode     RedisMode        `yaml:"mode"`
+	Server   string           `yaml:"server"`
+	AuthFile string           `yaml:"authFile"`
+	DBIndex  int              `yaml:"DBIndex"`
+	Sentinel SentinelSettings `yaml:"sentinel"`
+	Cluster  ClusterSettings  `yaml:"cluster"`
+}
+
+// SentinelSettings represents settings for redis sentinel failover
+type SentinelSettings struct {
+	MasterName string   `yaml:"masterName"`
+	Addresses  []string `yaml:"addresses"`
+	AuthFile   string   `yaml:"authFile"`
+}
+
+// ClusterSettings represents settings for redis cluster
+type ClusterSettings struct {
+	Seeds []string `yaml:"seeds"`
 }
 
-// NewConfig parses the file provided in path
+// hasServers checks if addresses for the configured mode are populated
+func (rs RedisSettings) hasServers() bool {
+	switch rs.Mode {
+	case RedisSentinel:
+		return len(rs.Sentinel.Addresses) > 0
+	case RedisCluster:
+		return len(rs.Cluster.Seeds) > 0
+	default:
+		return !IsEmpty(rs.Server)
+	}
+}
+
+// NewConfig parses the file provided in path with the environment overrides applied
 func NewConfig(path string) (Config, error) {
+	return LoadConfig(path, nil)
+}
+
+// ReadConfig parses the file provided in path, then applies the environment
+// overrides followed by flags without checking the values
+func ReadConfig(path string, flags Overrides) (Config, error) {
 	cfg := &Config{}
 	DebugLog("parsing file path: %s", path)
 	file, err := os.Open(path)
@@ -86,58 +197,31 @@ func NewConfig(path string) (Config, error) {
 		return Config{}, err
 	}
 
-	// make sure required fields are populated
-	if IsEmpty(cfg.Port) || IsEmpty(cfg.MECID) || IsEmpty(cfg.TokenFile) {
-		ErrorLog("missing required value %s, %s, %s", cfg.Port, cfg.MECID, cfg.TokenFile)
-		return Config{}, errors.New("missing required value")
+	// overrides are applied before anything is checked
+	if err := EnvOverrides(os.Environ()).apply(cfg); err != nil {
+		ErrorLog("invalid environment override, %s", err)
+		return Config{}, fmt.Errorf("invalid environment override, %s", err)
 	}
-
-	// check server timeout value
-	if cfg.ReadTimeout <= 0 || cfg.WriteTimeout <= 0 ||
-		cfg.MaxHeaderBytes <= 0 || cfg.HandlerTimeout <= 0 {
-		ErrorLog("must specify server values;"+
-			"readtimeout: %d, writetimeout: %d, maxheaderbytes: %d, handlertimeout: %d",
-			cfg.ReadTimeout, cfg.WriteTimeout, cfg.MaxHeaderBytes, cfg.HandlerTimeout)
-		return Config{}, errors.New("invalid server values")
-	}
-
-	// make sure all requried servers are populated
-	if IsEmpty(cfg.CAAS.Server) || IsEmpty(cfg.MQTT.Server) ||
-		IsEmpty(cfg.Redis.Server) {
-		ErrorLog("missing one of the required servers; redis: %s, caas: %s, mqtt: %s",
-			cfg.Redis.Server, cfg.CAAS.Server, cfg.MQTT.Server)
-		return Config{}, errors.New("missing required server locations")
+	if err := flags.apply(cfg); err != nil {
+		ErrorLog("invalid flag override, %s", err)
+		return Config{}, fmt.Errorf("invalid flag override, %s", err)
 	}
+	return *cfg, nil
+}
 
-	// make sure all endpoints are populated
-	if IsEmpty(cfg.CAAS.DeleteEndpoint) ||
-		IsEmpty(cfg.CAAS.CreateEndpoint) {
-		ErrorLog("missing caas endpoints; create: %s, deleteEntityID: %s",
-			cfg.CAAS.CreateEndpoint, cfg.CAAS.DeleteEndpoint)
-		return Config{}, errors.New("missing required endpoint")
+// LoadConfig parses the file provided in path, then applies the environment
+// overrides followed by flags and checks the result
+func LoadConfig(path string, flags Overrides) (Config, error) {
+	cfg, err := ReadConfig(path, flags)
+	if err != nil {
+		return Config{}, err
 	}
-
-	// make sure auth fields are populated
-	if cfg.MQTT.AuthType == CRSBased {
-		if IsEmpty(cfg.MQTT.CRS.Server) || IsEmpty(cfg.MQTT.CRS.Entity) ||
-			IsEmpty(cfg.MQTT.CRS.RegistrationEndpoint) || IsEmpty(cfg.MQTT.CRS.CfgPath) {
-			ErrorLog("missing one of the required crs field;"+
-				" server: %s, entity: %s, config: %s, registration: %s",
-				cfg.MQTT.CRS.Server, cfg.MQTT.CRS.Entity, cfg.MQTT.CRS.CfgPath,
-				cfg.MQTT.CRS.RegistrationEndpoint)
-			return Config{}, errors.New("missing required crs auth fields")
-		}
-	} else if cfg.MQTT.AuthType == FileBased {
-		if strings.TrimSpace(cfg.MQTT.AuthFile) == "" {
-			ErrorLog("missing mqtt auth file: %s", cfg.MQTT.AuthFile)
-			return Config{}, errors.New("missing required mqtt auth fields")
+	// the referenced files have to be mounted where the gateway runs
+	if err := ValidateConfig(cfg, true); err != nil {
+		for _, p := range err.(*ValidationError).Problems {
+			ErrorLog("invalid config value, %s", p)
 		}
+		return Config{}, err
 	}
-
-	// make sure redis auth is populated
-	if IsEmpty(cfg.Redis.AuthFile) {
-		ErrorLog("missing redis auth file: %s", cfg.Redis.AuthFile)
-		return Config{}, errors.New("missing required redis auth file")
-	}
-	return *cfg, nil
+	return cfg, nil
 }
@@ -16,13 +16,13 @@ func TestConfigParse(t *testing.T) {
 				HandlerTimeout: 1000,
 				MaxHeaderBytes: 1000,
 				Port:           "9090",
-				TokenFile:      "/etc/ds/crs/token",
+				TokenFile:      "./test/auth/tokenFile",
 				Redis: RedisSettings{
 					Server:   "localhost:6379",
-					AuthFile: "/etc/ds/auth",
+					AuthFile: "./test/auth/authFile",
 				},
 				CAAS: CAASSettings{
-					Server:         "localhost:8989",
+					Server:         "http://localhost:8989",
 					CreateEndpoint: "/token",
 					DeleteEndpoint: "/entity/delete",
 				},
@@ -39,10 +39,10 @@ func TestConfigParse(t *testing.T) {
 				HandlerTimeout:     1000,
 				MaxHeaderBytes:     1000,
 				Port:               "9090",
-				TokenFile:          "/etc/ds/crs/token",
+				TokenFile:          "./test/auth/tokenFile",
 				UpstreamReasonCode: []ReasonCode{0x98, 0x87},
 				CAAS: CAASSettings{
-					Server:         "localhost:8989",
+					Server:         "http://localhost:8989",
 					CreateEndpoint: "/token",
 					DeleteEndpoint: "/entity/delete",
 				},
@@ -50,11 +50,11 @@ func TestConfigParse(t *testing.T) {
 					Server:      "localhost:1883",
 					SuccessCode: 0x03,
 					AuthType:    FileBased,
-					AuthFile:    "/etc/ds/auth",
+					AuthFile:    "./test/auth/authFile",
 				},
 				Redis: RedisSettings{
 					Server:   "localhost:6379",
-					AuthFile: "/etc/ds/auth",
+					AuthFile: "./test/auth/authFile",
 				},
 			},
 			"./test/config/authCRS.yaml": {
@@ -64,10 +64,10 @@ func TestConfigParse(t *testing.T) {
 				HandlerTimeout:     1000,
 				MaxHeaderBytes:     1000,
 				Port:               "9090",
-				TokenFile:          "/etc/ds/crs/token",
+				TokenFile:          "./test/auth/tokenFile",
 				UpstreamReasonCode: []ReasonCode{0x98, 0x87},
 				CAAS: CAASSettings{
-					Server:         "localhost:8989",
+					Server:         "http://localhost:8989",
 					CreateEndpoint: "/token",
 					DeleteEndpoint: "/entity/delete",
 				},
@@ -77,14 +77,111 @@ func TestConfigParse(t *testing.T) {
 					AuthType:    CRSBased,
 					CRS: CRSSettings{
 						Entity:               "sw",
-						Server:               "vzmode-rkln.mec/registration:30413",
-						CfgPath:              "/etc/ds/crs/cfg",
+						Server:               "http://vzmode-rkln.mec:30413",
+						CfgPath:              "./test/config/crsCfg.json",
 						RegistrationEndpoint: "/registration",
 					},
 				},
 				Redis: RedisSettings{
 					Server:   "localhost:6379",
-					AuthFile: "/etc/ds/auth",
+					AuthFile: "./test/auth/authFile",
+				},
+			},
+			"./test/config/memoryStore.yaml": {
+				MECID:          "rkln",
+				ReadTimeout:    1000,
+				WriteTimeout:   1000,
+				HandlerTimeout: 1000,
+				MaxHeaderBytes: 1000,
+				Port:           "9090",
+				TokenFile:      "./test/auth/tokenFile",
+				Store:          MemoryStoreType,
+				Disconnecter:   MQTTv5DisconnecterType,
+				Expiry: ExpirySettings{
+					DefaultTTL:    3600,
+					MaxTTL:        86400,
+					SweepInterval: 10,
+				},
+				Refresh: RefreshSettings{
+					GracePeriod: 30,
+				},
+				Health: HealthSettings{
+					CAASEndpoint: "/health",
+					CheckMQTT:    true,
+					Timeout:      500,
+					CacheTTL:     1000,
+				},
+				Idle: IdleSettings{
+					Enabled:      true,
+					ScanInterval: 30,
+					Thresholds:   map[string]int{"veh": 600},
+				},
+				CAAS: CAASSettings{
+					Server:         "http://localhost:8989",
+					CreateEndpoint: "/token",
+					DeleteEndpoint: "/entity/delete",
+					Retries:        2,
+					Breaker:        BreakerSettings{Threshold: 5},
+				},
+				MQTT: MQTTSettings{
+					Server:      "localhost:1883",
+					AuthType:    NoAuth,
+					SuccessCode: 0x03,
+					V5: MQTTv5Settings{
+						AdminTopic: "$CONTROL/cgw/v1/disconnect",
+					},
+				},
+			},
+			"./test/config/redisSentinel.yaml": {
+				MECID:          "rkln",
+				ReadTimeout:    1000,
+				WriteTimeout:   1000,
+				HandlerTimeout: 1000,
+				MaxHeaderBytes: 1000,
+				Port:           "9090",
+				TokenFile:      "./test/auth/tokenFile",
+				Redis: RedisSettings{
+					Mode:     RedisSentinel,
+					AuthFile: "./test/auth/authFile",
+					Sentinel: SentinelSettings{
+						MasterName: "cgw-master",
+						Addresses:  []string{"sentinel-0:26379", "sentinel-1:26379"},
+						AuthFile:   "./test/auth/authFile",
+					},
+				},
+				CAAS: CAASSettings{
+					Server:         "http://localhost:8989",
+					CreateEndpoint: "/token",
+					DeleteEndpoint: "/entity/delete",
+				},
+				MQTT: MQTTSettings{
+					Server:      "localhost:1883",
+					SuccessCode: 0x03,
+				},
+			},
+			"./test/config/redisCluster.yaml": {
+				MECID:          "rkln",
+				ReadTimeout:    1000,
+				WriteTimeout:   1000,
+				HandlerTimeout: 1000,
+				MaxHeaderBytes: 1000,
+				Port:           "9090",
+				TokenFile:      "./test/auth/tokenFile",
+				Redis: RedisSettings{
+					Mode:     RedisCluster,
+					AuthFile: "./test/auth/authFile",
+					Cluster: ClusterSettings{
+						Seeds: []string{"redis-0:6379", "redis-1:6379", "redis-2:6379"},
+					},
+				},
+				CAAS: CAASSettings{
+					Server:         "http://localhost:8989",
+					CreateEndpoint: "/token",
+					DeleteEndpoint: "/entity/delete",
+				},
+				MQTT: MQTTSettings{
+					Server:      "localhost:1883",
+					SuccessCode: 0x03,
 				},
 			},
 		}
@@ -97,14 +194,17 @@ func TestConfigParse(t *testing.T) {
 
 	t.Run("fail_case", func(t *testing.T) {
 		testTable := map[string]string{
-			"./test/config/missingServer.yaml":    "missing required server locations",
-			"./test/config/missingEndpoint.yaml":  "missing required endpoint",
-			"./test/config/missingCRS.yaml":       "missing required crs auth fields",
-			"./test/config/missingRedisAuth.yaml": "missing required redis auth file",
+			"./test/config/missingServer.yaml":         "redis.server: missing required value",
+			"./test/config/missingEndpoint.yaml":       "caas.deleteEndpoint: missing required value",
+			"./test/config/missingCRS.yaml":            "mqtt.crs.registrationEndpoint: missing required value",
+			"./test/config/missingRedisAuth.yaml":      "redis.authFile: missing required value",
+			"./test/config/missingSentinelMaster.yaml": "redis.sentinel.masterName: missing required value",
+			"./test/config/invalidDisconnecter.yaml":   "disconnecter: disconnecter type is not supported, telnet",
+			"./test/config/invalidOAuth2.yaml":         "oauth2: client id and client secret file are required",
 		}
 		for k, v := range testTable {
 			_, err := NewConfig(k)
-			assert.Error(t, err, v)
+			assert.ErrorContains(t, err, v)
 		}
 	})
 }
@@ -13,11 +13,12 @@ type appendLogCb func(string, interface{})
 type getLogsCb func() []interface{}
 type clearLogsCb func()
 
-func flushHandler(kv RedisStore) http.HandlerFunc {
+func flushHandler(kv KeyValueStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		err := kv.redisClient.FlushAll(req.Context()).Err()
+		err := kv.Flush(req.Context())
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 		w.WriteHeader(http.StatusOK)
 	}
@@ -22,6 +22,7 @@ func TestDebugFlush(t *testing.T) {
 
 func TestDebugSetToken(t *testing.T) {
 	fakeToken := "1111.1111"
+	defer gw.SetToken(gw.GetToken())
 	handler := setTokenHandler(gw.SetToken)
 	w := &httptest.ResponseRecorder{}
 	req := createTestRequest(t, nil, nil)
@@ -29,11 +30,12 @@ func TestDebugSetToken(t *testing.T) {
 	q.Add("token", fakeToken)
 	req.URL.RawQuery = q.Encode()
 	handler(w, req)
-	assert.Equal(t, gw.token, fakeToken)
+	assert.Equal(t, gw.GetToken(), fakeToken)
 }
 
 func TestDebugSetMEC(t *testing.T) {
 	fakeMEC := "192.168.0.1"
+	defer gw.SetMEC(gw.GetMEC())
 	handler := setMECHandler(gw.SetMEC)
 	w := &httptest.ResponseRecorder{}
 	req := createTestRequest(t, nil, nil)
@@ -41,7 +43,7 @@ func TestDebugSetMEC(t *testing.T) {
 	q.Add("mec", fakeMEC)
 	req.URL.RawQuery = q.Encode()
 	handler(w, req)
-	assert.Equal(t, gw.mecID, fakeMEC)
+	assert.Equal(t, gw.GetMEC(), fakeMEC)
 }
 
 func TestAppendRequestLogs(t *testing.T) {
@@ -57,7 +59,7 @@ func TestAppendRequestLogs(t *testing.T) {
 	w := &httptest.ResponseRecorder{}
 	entHandler(w, req)
 
-	entry, ok := gw.requestLog[0].(map[string]interface{})
+	entry, ok := gw.GetLogs()[0].(map[string]interface{})
 	assert.Assert(t, ok)
 	blob := entry[""]
 	decoded, ok := blob.(*EntityTokenRequest)
@@ -66,7 +68,7 @@ func TestAppendRequestLogs(t *testing.T) {
 }
 
 func TestGetRequestLogs(t *testing.T) {
-	gw.requestLog = make([]interface{}, 0)
+	gw.ClearLogs()
 	entityTokenReq := EntityTokenRequest{
 		Token: "test.token",
 		EntityPair: EntityPair{
@@ -91,7 +93,7 @@ func TestGetRequestLogs(t *testing.T) {
 }
 
 func TestClearLogs(t *testing.T) {
-	gw.requestLog = make([]interface{}, 0)
+	gw.ClearLogs()
 	entityTokenReq := EntityTokenRequest{
 		Token: "test.token",
 		EntityPair: EntityPair{
@@ -100,10 +102,10 @@ func TestClearLogs(t *testing.T) {
 		},
 	}
 	gw.AppendLog("/url", entityTokenReq)
-	assert.Equal(t, len(gw.requestLog), 1)
+	assert.Equal(t, len(gw.GetLogs()), 1)
 	req := createTestRequest(t, nil, nil)
 	w := &httptest.ResponseRecorder{}
 	handler := delReqLogHandler(gw.ClearLogs)
 	handler(w, req)
-	assert.Equal(t, len(gw.requestLog), 0)
+	assert.Equal(t, len(gw.GetLogs()), 0)
 }
@@ -34,15 +34,20 @@ func (tokReq *DisconnectRequest) IsValid() bool {
 	if !tokReq.EntityPair.IsValid() {
 		return false
 	}
-	// check if the reason code exists
-	switch tokReq.ReasonCode {
+	return isValidReasonCode(tokReq.ReasonCode)
+}
+
+// isValidReasonCode checks if the reason code exists
+func isValidReasonCode(rc ReasonCode) bool {
+	switch rc {
 	case Reauthenticate:
 	case NotAuthorized:
 	case Expiration:
 	case Handover:
 	case Idle:
+	case RateTooHigh:
 	default:
-		ErrorLog("reason code is not valid, %d", tokReq.ReasonCode)
+		ErrorLog("reason code is not valid, %d", rc)
 		return false
 	}
 	return true
@@ -65,14 +70,16 @@ type ValidateTokenRequest struct {
 }
 
 // EntityTokenRequest is the json used for deleting entity requests
+// TTL is the requested token lifetime in seconds, zero uses the configured default
 type EntityTokenRequest struct {
 	EntityPair
 	Token string `json:"token"`
+	TTL   int    `json:"ttl,omitempty"`
 }
 
 // IsValid check is any of the fields are empty
 func (tokReq *EntityTokenRequest) IsValid() bool {
-	if !tokReq.EntityPair.IsValid() || IsEmpty(tokReq.Token) {
+	if !tokReq.EntityPair.IsValid() || IsEmpty(tokReq.Token) || tokReq.TTL < 0 {
 		return false
 	}
 	return true
@@ -83,6 +90,79 @@ func (tokReq *EntityTokenRequest) GetEntityPair() *EntityPair {
 	return &tokReq.EntityPair
 }
 
+// RefreshTokenRequest is the json used for refresh requests, OldToken is the
+// token being replaced and proves the caller holds it
+type RefreshTokenRequest struct {
+	EntityTokenRequest
+	OldToken string `json:"oldToken"`
+}
+
+// IsValid check is any of the fields are empty
+func (refReq *RefreshTokenRequest) IsValid() bool {
+	if !refReq.EntityTokenRequest.IsValid() || IsEmpty(refReq.OldToken) {
+		return false
+	}
+	return true
+}
+
+// HandoverRequest is the json a gateway sends to the next gateway during handover
+// ExpiresAt is the unix time the token expires, zero never expires
+type HandoverRequest struct {
+	EntityPair
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	CreatedAt int64  `json:"createdAt,omitempty"`
+	SourceMEC string `json:"sourceMEC"`
+}
+
+// IsValid check is any of the fields are empty
+func (hReq *HandoverRequest) IsValid() bool {
+	if !hReq.EntityPair.IsValid() || IsEmpty(hReq.Token) || IsEmpty(hReq.SourceMEC) ||
+		hReq.ExpiresAt < 0 || hReq.CreatedAt < 0 {
+		return false
+	}
+	return true
+}
+
+// GetEntityPair gets the entity pair in the struct
+func (hReq *HandoverRequest) GetEntityPair() *EntityPair {
+	return &hReq.EntityPair
+}
+
+// BulkDisconnectRequest is the json used to disconnect many entities at once
+// Entities are disconnected as listed, otherwise every stored entity matching Entity
+// and EntityIDPrefix is, All has to be set to select entities without either of them
+type BulkDisconnectRequest struct {
+	Entity         string       `json:"entity,omitempty"`
+	EntityIDPrefix string       `json:"entityidPrefix,omitempty"`
+	Entities       []EntityPair `json:"entities,omitempty"`
+	All            bool         `json:"all,omitempty"`
+	ReasonCode     ReasonCode   `json:"reasonCode"`
+}
+
+// IsValid check if there's a selector and the reason code can be used in bulk
+func (bReq *BulkDisconnectRequest) IsValid() bool {
+	if !IsEmpty(bReq.Entity) && !IsValidEntity(bReq.Entity) {
+		ErrorLog("entity is not valid, %s", bReq.Entity)
+		return false
+	}
+	for i := range bReq.Entities {
+		if !bReq.Entities[i].IsValid() {
+			return false
+		}
+	}
+	if len(bReq.Entities) == 0 && IsEmpty(bReq.Entity) && IsEmpty(bReq.EntityIDPrefix) && !bReq.All {
+		ErrorLog("bulk disconnect request has no selector")
+		return false
+	}
+	// handovers need a next server for every entity
+	if bReq.ReasonCode == Handover {
+		ErrorLog("handover can't be used in bulk")
+		return false
+	}
+	return isValidReasonCode(bReq.ReasonCode)
+}
+
 // EntityPair is the entity/entityid combo
 type EntityPair struct {
 	Entity   string `json:"entity"`
@@ -94,17 +174,26 @@ func (ep *EntityPair) IsValid() bool {
 	if IsEmpty(ep.Entity) || IsEmpty(ep.EntityID) {
 		return false
 	}
-	switch strings.ToLower(ep.Entity) {
-	case "veh":
-	case "sw":
-	case "admin":
-	default:
-		ErrorLog("entity is not valid, %d", ep.Entity)
+	if !IsValidEntity(ep.Entity) {
+		ErrorLog("entity is not valid, %s", ep.Entity)
 		return false
 	}
 	return true
 }
 
+// entityTypes are the entity types the gateway supports
+var entityTypes = []string{"veh", "sw", "admin"}
+
+// IsValidEntity checks if the entity type is supported
+func IsValidEntity(entity string) bool {
+	for _, e := range entityTypes {
+		if strings.ToLower(entity) == e {
+			return true
+		}
+	}
+	return false
+}
+
 // CreateKey builds a key from entity pair
 func (ep *EntityPair) CreateKey() string {
 	return HyphenConcat(strings.ToLower(ep.Entity), ep.EntityID)
@@ -0,0 +1,163 @@
+package cgw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// topics used by the mosquitto dynamic security plugin
+const (
+	dynSecControlTopic  = "$CONTROL/dynamic-security/v1"
+	dynSecResponseTopic = "$CONTROL/dynamic-security/v1/response"
+)
+
+// DynSecSettings represents settings for the mosquitto dynamic security disconnecter
+// clients are disabled which kicks them off the broker and enabled again right away
+// so they can reconnect, KeepDisabled locks them out until they're enabled by hand,
+// DeleteClient removes the client instead and DeleteRole removes the role of the same name
+type DynSecSettings struct {
+	KeepDisabled bool `yaml:"keepDisabled"`
+	DeleteClient bool `yaml:"deleteClient"`
+	DeleteRole   bool `yaml:"deleteRole"`
+}
+
+// validate checks the dynsec fields are consistent
+func (ds DynSecSettings) validate() error {
+	if ds.KeepDisabled && ds.DeleteClient {
+		return errors.New("deleted clients can't be kept disabled")
+	}
+	return nil
+}
+
+// DynSecCommand is a single dynamic security command
+type DynSecCommand struct {
+	Command         string `json:"command"`
+	Username        string `json:"username,omitempty"`
+	Rolename        string `json:"rolename,omitempty"`
+	CorrelationData string `json:"correlationData,omitempty"`
+}
+
+// DynSecResponse is the result of a single dynamic security command
+type DynSecResponse struct {
+	Command         string `json:"command"`
+	Error           string `json:"error,omitempty"`
+	CorrelationData string `json:"correlationData,omitempty"`
+}
+
+// DynSecDisconnecter disconnects clients through the mosquitto dynamic security plugin,
+// mosquitto picks the DISCONNECT reason code so the requested one isn't sent to the client
+type DynSecDisconnecter struct {
+	mqttv5Session
+	settings DynSecSettings
+}
+
+// NewDynSecDisconnecter creates a new dynamic security disconnecter
+func NewDynSecDisconnecter(settings MQTTSettings, token string) (Disconnecter, error) {
+	if err := settings.DynSec.validate(); err != nil {
+		return nil, err
+	}
+	session, err := newMQTTv5Session(settings, token)
+	if err != nil {
+		return nil, err
+	}
+	return &DynSecDisconnecter{
+		mqttv5Session: session,
+		settings:      settings.DynSec,
+	}, nil
+}
+
+// commands builds the dynamic security commands for the client
+func (handler *DynSecDisconnecter) commands(username string, correlationID string) []DynSecCommand {
+	cmds := []DynSecCommand{}
+	if handler.settings.DeleteClient {
+		cmds = append(cmds, DynSecCommand{Command: "deleteClient", Username: username})
+	} else {
+		cmds = append(cmds, DynSecCommand{Command: "disableClient", Username: username})
+		if !handler.settings.KeepDisabled {
+			cmds = append(cmds, DynSecCommand{Command: "enableClient", Username: username})
+		}
+	}
+	if handler.settings.DeleteRole {
+		cmds = append(cmds, DynSecCommand{Command: "deleteRole", Rolename: username})
+	}
+	for i := range cmds {
+		cmds[i].CorrelationData = fmt.Sprintf("%s-%d", correlationID, i)
+	}
+	return cmds
+}
+
+// Disconnect disables or deletes the client which makes mosquitto kick its sessions
+func (handler *DynSecDisconnecter) Disconnect(ctx context.Context, req DisconnectRequest) error {
+	clientID := newSessionID("cgw")
+	username := HyphenConcat(req.Entity, req.EntityID)
+	cmds := handler.commands(username, clientID)
+
+	// every subscriber sees every response, only keep ours
+	responses := make(chan DynSecResponse, len(cmds))
+	router := paho.NewSingleHandlerRouter(func(pb *paho.Publish) {
+		payload := struct {
+			Responses []DynSecResponse `json:"responses"`
+		}{}
+		if err := json.Unmarshal(pb.Payload, &payload); err != nil {
+			ErrorLog("unable to decode dynsec response, %s", err)
+			return
+		}
+		for _, resp := range payload.Responses {
+			if strings.HasPrefix(resp.CorrelationData, clientID+"-") {
+				select {
+				case responses <- resp:
+				default:
+				}
+			}
+		}
+	})
+	client, err := handler.connect(ctx, clientID, router)
+	if err != nil {
+		return fmt.Errorf("unable to connect to mqtt broker, %s", err)
+	}
+	defer client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+
+	_, err = client.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{
+			dynSecResponseTopic: {QoS: 1},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to %s, %s", dynSecResponseTopic, err)
+	}
+
+	payload, err := json.Marshal(map[string][]DynSecCommand{"commands": cmds})
+	if err != nil {
+		return err
+	}
+	DebugLog("sending dynsec commands, %s", string(payload))
+	_, err = client.Publish(ctx, &paho.Publish{
+		QoS:     1,
+		Topic:   dynSecControlTopic,
+		Payload: payload,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to publish dynsec commands, %s", err)
+	}
+
+	failed := []string{}
+	for range cmds {
+		select {
+		case resp := <-responses:
+			if !IsEmpty(resp.Error) {
+				failed = append(failed, fmt.Sprintf("%s: %s", resp.Command, resp.Error))
+			}
+		case <-ctx.Done():
+			return errors.New("timeout occured")
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("dynsec commands failed for %s, %s", username, strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package cgw
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"gotest.tools/assert"
+)
+
+// fakeDynSecBroker answers dynsec commands, failing the ones listed in errs
+func fakeDynSecBroker(t *testing.T, errs map[string]string, received chan<- []DynSecCommand) string {
+	return fakeBroker(t, func(p *packets.Publish) *packets.ControlPacket {
+		if p.Topic != dynSecControlTopic {
+			return nil
+		}
+		payload := map[string][]DynSecCommand{}
+		json.Unmarshal(p.Payload, &payload)
+		received <- payload["commands"]
+		responses := []DynSecResponse{}
+		for _, cmd := range payload["commands"] {
+			responses = append(responses, DynSecResponse{
+				Command:         cmd.Command,
+				Error:           errs[cmd.Command],
+				CorrelationData: cmd.CorrelationData,
+			})
+		}
+		data, _ := json.Marshal(map[string][]DynSecResponse{"responses": responses})
+		resp := packets.NewControlPacket(packets.PUBLISH)
+		resp.Content.(*packets.Publish).Topic = dynSecResponseTopic
+		resp.Content.(*packets.Publish).Payload = data
+		return resp
+	})
+}
+
+func newTestDynSecDisconnecter(t *testing.T, server string, dynsec DynSecSettings) Disconnecter {
+	ds, err := NewDisconnecter(DynSecDisconnecterType, MQTTSettings{
+		Server:   server,
+		AuthType: FileBased,
+		AuthFile: "./test/auth/authFile",
+		DynSec:   dynsec,
+	}, "")
+	assert.NilError(t, err)
+	return ds
+}
+
+func commandNames(cmds []DynSecCommand) []string {
+	names := []string{}
+	for _, cmd := range cmds {
+		names = append(names, cmd.Command+":"+cmd.Username+cmd.Rolename)
+	}
+	return names
+}
+
+func TestDynSecDisconnect(t *testing.T) {
+	testTable := map[string]struct {
+		settings DynSecSettings
+		commands []string
+	}{
+		"kick": {
+			DynSecSettings{},
+			[]string{"disableClient:veh-1234", "enableClient:veh-1234"},
+		},
+		"keep_disabled": {
+			DynSecSettings{KeepDisabled: true},
+			[]string{"disableClient:veh-1234"},
+		},
+		"delete": {
+			DynSecSettings{DeleteClient: true, DeleteRole: true},
+			[]string{"deleteClient:veh-1234", "deleteRole:veh-1234"},
+		},
+	}
+	for name, tc := range testTable {
+		t.Run(name, func(t *testing.T) {
+			received := make(chan []DynSecCommand, 1)
+			ds := newTestDynSecDisconnecter(t, fakeDynSecBroker(t, nil, received), tc.settings)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := ds.Disconnect(ctx, DisconnectRequest{
+				EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+				ReasonCode: Reauthenticate,
+			})
+			assert.NilError(t, err)
+			assert.DeepEqual(t, commandNames(<-received), tc.commands)
+		})
+	}
+}
+
+func TestDynSecDisconnectFailed(t *testing.T) {
+	received := make(chan []DynSecCommand, 1)
+	server := fakeDynSecBroker(t, map[string]string{"disableClient": "Client not found"}, received)
+	ds := newTestDynSecDisconnecter(t, server, DynSecSettings{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := ds.Disconnect(ctx, DisconnectRequest{
+		EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+		ReasonCode: Reauthenticate,
+	})
+	assert.ErrorContains(t, err, "Client not found")
+	<-received
+
+	_, err = NewDisconnecter(DynSecDisconnecterType, MQTTSettings{
+		Server: server,
+		DynSec: DynSecSettings{KeepDisabled: true, DeleteClient: true},
+	}, "")
+	assert.ErrorContains(t, err, "can't be kept disabled")
+}
@@ -0,0 +1,201 @@
+package cgw
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// EntitiesEndpoint is where stored entities are listed and looked up
+const EntitiesEndpoint = "/cgw/v1/entities"
+
+// page sizes for entity listings
+const (
+	defaultEntityPageSize = 100
+	maxEntityPageSize     = 1000
+)
+
+// EntityInfo is the metadata of a stored entity, the token is never exposed
+type EntityInfo struct {
+	EntityPair
+	MEC         string `json:"mec,omitempty"`
+	CreatedAt   int64  `json:"createdAt,omitempty"`
+	RefreshedAt int64  `json:"refreshedAt,omitempty"`
+	ExpiresAt   int64  `json:"expiresAt,omitempty"`
+	Expired     bool   `json:"expired"`
+}
+
+// EntityPage is a page of an entity listing, Cursor is empty on the last page
+type EntityPage struct {
+	Entities []EntityInfo `json:"entities"`
+	Cursor   string       `json:"cursor,omitempty"`
+}
+
+// newEntityInfo strips the token from the record, records written before
+// metadata was kept are reported on the mec of this gateway
+func newEntityInfo(rec EntityRecord, mecID string, now time.Time) EntityInfo {
+	info := EntityInfo{
+		EntityPair: EntityPair{
+			Entity:   strings.ToLower(rec.Entity),
+			EntityID: rec.EntityID,
+		},
+		MEC:         rec.MEC,
+		CreatedAt:   rec.CreatedAt,
+		RefreshedAt: rec.RefreshedAt,
+		ExpiresAt:   rec.ExpiresAt,
+		Expired:     rec.Expired(now),
+	}
+	if IsEmpty(info.MEC) {
+		info.MEC = mecID
+	}
+	return info
+}
+
+// entityCursor is the position of a listing, the index of the entity type
+// being scanned and the store cursor within it
+type entityCursor struct {
+	index int
+	scan  uint64
+}
+
+// parseEntityCursor decodes cursors in the form <index>.<scan>
+func parseEntityCursor(cursor string) (entityCursor, error) {
+	if IsEmpty(cursor) {
+		return entityCursor{}, nil
+	}
+	parts := strings.SplitN(cursor, ".", 2)
+	if len(parts) != 2 {
+		return entityCursor{}, fmt.Errorf("invalid cursor, %s", cursor)
+	}
+	index, err := strconv.Atoi(parts[0])
+	if err != nil || index < 0 {
+		return entityCursor{}, fmt.Errorf("invalid cursor, %s", cursor)
+	}
+	scan, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return entityCursor{}, fmt.Errorf("invalid cursor, %s", cursor)
+	}
+	return entityCursor{index: index, scan: scan}, nil
+}
+
+// String encodes the cursor
+func (ec entityCursor) String() string {
+	return fmt.Sprintf("%d.%d", ec.index, ec.scan)
+}
+
+// listEntities reads a page of records of the entity types, limit is a hint
+// since the store can return more or fewer keys per scan
+func listEntities(ctx context.Context, kv KeyValueStore, entities []string,
+	cursor entityCursor, limit int) ([]EntityRecord, entityCursor, bool, error) {
+	records := []EntityRecord{}
+	for cursor.index < len(entities) && len(records) < limit {
+		pattern := strings.ToLower(entities[cursor.index]) + "-*"
+		keys, next, err := kv.Scan(ctx, cursor.scan, pattern, int64(limit-len(records)))
+		if err != nil {
+			return nil, cursor, false, err
+		}
+		for _, key := range keys {
+			rec, err := getRecord(ctx, kv, key)
+			if err == ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				ErrorLog("unable to read record %s, %s", key, err)
+				continue
+			}
+			records = append(records, rec)
+		}
+		cursor.scan = next
+		if next == 0 {
+			cursor.index++
+		}
+	}
+	return records, cursor, cursor.index >= len(entities), nil
+}
+
+// listEntitiesHandler lists stored entities a page at a time
+// query takes entity to filter on the type, cursor from the previous page and limit
+// returns 200 with the page
+// returns 400 if the query is invalid
+func listEntitiesHandler(kv KeyValueStore, mecID readMECCb) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		query := req.URL.Query()
+		entities := entityTypes
+		if entity := query.Get("entity"); !IsEmpty(entity) {
+			if !IsValidEntity(entity) {
+				ErrorLog("entity is not valid, %s", entity)
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			entities = []string{strings.ToLower(entity)}
+		}
+		limit := defaultEntityPageSize
+		if val := query.Get("limit"); !IsEmpty(val) {
+			var err error
+			limit, err = strconv.Atoi(val)
+			if err != nil || limit <= 0 || limit > maxEntityPageSize {
+				ErrorLog("invalid page limit, %s", val)
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+		}
+		cursor, err := parseEntityCursor(query.Get("cursor"))
+		if err != nil {
+			ErrorLog("%s", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		records, next, done, err := listEntities(ctx, kv, entities, cursor, limit)
+		if err != nil {
+			ErrorLog("unable to list entities, %s", err)
+			http.Error(w, "Internal error occured with key store", http.StatusInternalServerError)
+			return
+		}
+		page := EntityPage{Entities: []EntityInfo{}}
+		now := time.Now()
+		for _, rec := range records {
+			page.Entities = append(page.Entities, newEntityInfo(rec, mecID(), now))
+		}
+		if !done {
+			page.Cursor = next.String()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// getEntityHandler looks up a single stored entity
+// returns 200 with the entity metadata
+// returns 404 if it doesn't exist
+func getEntityHandler(kv KeyValueStore, mecID readMECCb) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		vars := mux.Vars(req)
+		ep := EntityPair{Entity: vars["entity"], EntityID: vars["entityid"]}
+		if !ep.IsValid() {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		rec, err := getRecord(ctx, kv, ep.CreateKey())
+		if err == ErrKeyNotFound {
+			ErrorLog("entity does not exist, %s", ep.CreateKey())
+			http.Error(w, "Entity/EntityID does not exist", http.StatusNotFound)
+			return
+		} else if err != nil {
+			ErrorLog("error getting key from store, %s", err)
+			http.Error(w, "Internal error occured with key store", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(newEntityInfo(rec, mecID(), time.Now()))
+	}
+}
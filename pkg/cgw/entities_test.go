@@ -0,0 +1,143 @@
+package cgw
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gotest.tools/assert"
+)
+
+func TestEntityCursor(t *testing.T) {
+	cursor, err := parseEntityCursor("")
+	assert.NilError(t, err)
+	assert.Equal(t, cursor, entityCursor{})
+	cursor, err = parseEntityCursor("1.42")
+	assert.NilError(t, err)
+	assert.Equal(t, cursor, entityCursor{index: 1, scan: 42})
+	assert.Equal(t, cursor.String(), "1.42")
+	for _, bad := range []string{"1", "a.1", "-1.0", "1.b"} {
+		_, err = parseEntityCursor(bad)
+		assert.ErrorContains(t, err, "invalid cursor")
+	}
+}
+
+func TestEntityHandlers(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore()
+	now := time.Now()
+	records := []EntityRecord{
+		{EntityPair: EntityPair{"veh", "1"}, Token: "secret.test", CreatedAt: now.Unix(), MEC: "mec1"},
+		{EntityPair: EntityPair{"veh", "2"}, Token: "secret.test", ExpiresAt: now.Add(-time.Minute).Unix()},
+		{EntityPair: EntityPair{"veh", "3"}, Token: "secret.test", RefreshedAt: now.Unix()},
+		{EntityPair: EntityPair{"sw", "1"}, Token: "secret.test"},
+	}
+	for _, rec := range records {
+		assert.NilError(t, setRecord(ctx, ms, rec))
+	}
+	// keys kept alongside records aren't listed
+	assert.NilError(t, ms.Set(ctx, "lock:veh-1", "lock", 0))
+	assert.NilError(t, ms.Set(ctx, "active:veh-1", "1", 0))
+
+	router := mux.NewRouter()
+	mecID := func() string { return "local.mec" }
+	router.Handle(EntitiesEndpoint, listEntitiesHandler(ms, mecID)).Methods("GET")
+	router.Handle(EntitiesEndpoint+"/{entity}/{entityid}", getEntityHandler(ms, mecID)).Methods("GET")
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", url, nil)
+		assert.NilError(t, err)
+		router.ServeHTTP(w, req)
+		assert.Assert(t, !strings.Contains(w.Body.String(), "secret.test"))
+		return w
+	}
+
+	t.Run("list_pages", func(t *testing.T) {
+		keys := []string{}
+		cursor := ""
+		for pages := 0; ; pages++ {
+			assert.Assert(t, pages < 10)
+			w := get(EntitiesEndpoint + "?limit=2&cursor=" + cursor)
+			assert.Equal(t, w.Code, http.StatusOK)
+			page := EntityPage{}
+			assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &page))
+			assert.Assert(t, len(page.Entities) <= 2)
+			for _, info := range page.Entities {
+				keys = append(keys, info.CreateKey())
+			}
+			if page.Cursor == "" {
+				break
+			}
+			cursor = page.Cursor
+		}
+		assert.DeepEqual(t, keys, []string{"veh-1", "veh-2", "veh-3", "sw-1"})
+	})
+
+	t.Run("list_entity", func(t *testing.T) {
+		w := get(EntitiesEndpoint + "?entity=SW")
+		assert.Equal(t, w.Code, http.StatusOK)
+		page := EntityPage{}
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		assert.DeepEqual(t, page, EntityPage{Entities: []EntityInfo{
+			{EntityPair: EntityPair{"sw", "1"}, MEC: "local.mec"},
+		}})
+	})
+
+	t.Run("list_bad_query", func(t *testing.T) {
+		for _, query := range []string{"?entity=asd", "?limit=0", "?limit=a", "?cursor=a"} {
+			assert.Equal(t, get(EntitiesEndpoint+query).Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("lookup", func(t *testing.T) {
+		w := get(EntitiesEndpoint + "/veh/1")
+		assert.Equal(t, w.Code, http.StatusOK)
+		info := EntityInfo{}
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &info))
+		assert.DeepEqual(t, info, EntityInfo{
+			EntityPair: EntityPair{"veh", "1"},
+			MEC:        "mec1",
+			CreatedAt:  now.Unix(),
+		})
+
+		w = get(EntitiesEndpoint + "/veh/2")
+		assert.Equal(t, w.Code, http.StatusOK)
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &info))
+		assert.Assert(t, info.Expired)
+
+		assert.Equal(t, get(EntitiesEndpoint+"/veh/9").Code, http.StatusNotFound)
+		assert.Equal(t, get(EntitiesEndpoint+"/asd/1").Code, http.StatusBadRequest)
+	})
+}
+
+func TestRefreshKeepsMetadata(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore()
+	created := EntityRecord{
+		EntityPair: EntityPair{"veh", "1234"},
+		Token:      "old.test",
+		CreatedAt:  time.Now().Add(-time.Hour).Unix(),
+		MEC:        "mec1",
+	}
+	assert.NilError(t, setRecord(ctx, ms, created))
+	w := httptest.NewRecorder()
+	refreshTokenHandler(ms, ExpirySettings{}, nil, nil, RefreshSettings{}, nil)(w, createTestRequest(t, nil, &RefreshTokenRequest{
+		EntityTokenRequest: EntityTokenRequest{
+			EntityPair: created.EntityPair,
+			Token:      "new.test",
+		},
+		OldToken: "old.test",
+	}))
+	assert.Equal(t, w.Code, http.StatusOK)
+	rec, err := getRecord(ctx, ms, created.CreateKey())
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Token, "new.test")
+	assert.Equal(t, rec.CreatedAt, created.CreatedAt)
+	assert.Equal(t, rec.MEC, "mec1")
+	assert.Assert(t, rec.RefreshedAt >= created.CreatedAt)
+}
@@ -0,0 +1,52 @@
+package cgw
+
+import (
+	"context"
+	"time"
+)
+
+// sweepExpired periodically disconnects entities whose tokens expired
+func (cgw *CAASGateway) sweepExpired(ctx context.Context) {
+	ticker := time.NewTicker(cgw.expiry.Interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cgw.expireEntities(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// expireEntities goes through all records and expires lapsed tokens
+func (cgw *CAASGateway) expireEntities(ctx context.Context) {
+	now := time.Now()
+	for _, entity := range entityTypes {
+		err := scanRecords(ctx, cgw.kv, entity, func(rec EntityRecord) {
+			if !rec.Expired(now) {
+				return
+			}
+			if err := cgw.expireEntity(ctx, rec.EntityPair); err != nil {
+				ErrorLog("unable to expire %s, %s", rec.CreateKey(), err)
+			}
+		})
+		if err != nil {
+			ErrorLog("unable to scan %s records, %s", entity, err)
+		}
+	}
+}
+
+// expireEntity disconnects the client with the expiration reason code and
+// removes the entity from caas and the store
+func (cgw *CAASGateway) expireEntity(ctx context.Context, ep EntityPair) error {
+	// the token might have been refreshed since the scan
+	_, err := cgw.removeEntity(ctx, ep, Expiration, func(ctx context.Context, rec EntityRecord) (bool, error) {
+		if !rec.Expired(time.Now()) {
+			return false, nil
+		}
+		DebugLog("token expired for %s", rec.CreateKey())
+		return true, nil
+	})
+	return err
+}
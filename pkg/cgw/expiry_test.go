@@ -0,0 +1,166 @@
+package cgw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+type recordingDisconnecter struct {
+	mu       sync.Mutex
+	requests []DisconnectRequest
+}
+
+func (rd *recordingDisconnecter) Disconnect(ctx context.Context, ds DisconnectRequest) error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.requests = append(rd.requests, ds)
+	return nil
+}
+
+func TestExpiryTTL(t *testing.T) {
+	testTable := map[time.Duration]struct {
+		settings  ExpirySettings
+		requested int
+	}{
+		0:                {ExpirySettings{}, 0},
+		60 * time.Second: {ExpirySettings{DefaultTTL: 60}, 0},
+		30 * time.Second: {ExpirySettings{DefaultTTL: 60}, 30},
+		90 * time.Second: {ExpirySettings{MaxTTL: 90}, 0},
+		80 * time.Second: {ExpirySettings{DefaultTTL: 60, MaxTTL: 90}, 80},
+	}
+	for k, v := range testTable {
+		assert.Equal(t, v.settings.TTL(v.requested), k)
+	}
+	assert.Equal(t, ExpirySettings{MaxTTL: 90}.TTL(120), 90*time.Second)
+	assert.Equal(t, ExpirySettings{}.Interval(), defaultSweepInterval)
+	assert.Equal(t, ExpirySettings{SweepInterval: 5}.Interval(), 5*time.Second)
+}
+
+func TestValidateExpiredToken(t *testing.T) {
+	ms := NewMemoryStore()
+	etr := &EntityTokenRequest{
+		EntityPair: EntityPair{
+			Entity:   "veh",
+			EntityID: "1234",
+		},
+		Token: "test.test",
+	}
+	err := setRecord(context.Background(), ms, EntityRecord{
+		EntityPair: etr.EntityPair,
+		Token:      etr.Token,
+		ExpiresAt:  time.Now().Add(-time.Second).Unix(),
+	})
+	assert.NilError(t, err)
+	w := httptest.NewRecorder()
+	validateTokenHandler(ms, nil, nil)(w, createTestRequest(t, nil, etr))
+	assert.Equal(t, w.Code, http.StatusForbidden)
+}
+
+func TestRefreshSetsExpiry(t *testing.T) {
+	ms := NewMemoryStore()
+	etr := &RefreshTokenRequest{
+		EntityTokenRequest: EntityTokenRequest{
+			EntityPair: EntityPair{
+				Entity:   "veh",
+				EntityID: "1234",
+			},
+			Token: "test.test",
+			TTL:   120,
+		},
+		OldToken: "old.test",
+	}
+	assert.NilError(t, ms.Set(context.Background(), "veh-1234", "old.test", 0))
+	w := httptest.NewRecorder()
+	refreshTokenHandler(ms, ExpirySettings{MaxTTL: 60}, nil, nil, RefreshSettings{}, nil)(w, createTestRequest(t, nil, etr))
+	assert.Equal(t, w.Code, http.StatusOK)
+	rec, err := getRecord(context.Background(), ms, "veh-1234")
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Token, "test.test")
+	assert.Assert(t, rec.ExpiresAt > time.Now().Add(50*time.Second).Unix())
+	assert.Assert(t, rec.ExpiresAt <= time.Now().Add(60*time.Second).Unix())
+	assert.Equal(t, w.Header().Get("token-expires-at") != "", true)
+}
+
+func TestExpireEntities(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore()
+	ds := &recordingDisconnecter{}
+	cgw := gw
+	cgw.kv = ms
+	cgw.disconnecter = ds
+	updateSettings(&cgw, func(ls *liveSettings) {
+		ls.handlerTO = time.Second
+	})
+
+	expired := EntityRecord{
+		EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+		Token:      "expired.test",
+		ExpiresAt:  time.Now().Add(-time.Second).Unix(),
+	}
+	valid := EntityRecord{
+		EntityPair: EntityPair{Entity: "sw", EntityID: "1234"},
+		Token:      "valid.test",
+		ExpiresAt:  time.Now().Add(time.Hour).Unix(),
+	}
+	forever := EntityRecord{
+		EntityPair: EntityPair{Entity: "veh", EntityID: "5678"},
+		Token:      "forever.test",
+	}
+	for _, rec := range []EntityRecord{expired, valid, forever} {
+		assert.NilError(t, setRecord(ctx, ms, rec))
+	}
+
+	cgw.expireEntities(ctx)
+	assert.Equal(t, len(ds.requests), 1)
+	assert.Equal(t, ds.requests[0].ReasonCode, Expiration)
+	assert.Equal(t, ds.requests[0].EntityPair, expired.EntityPair)
+	_, err := getRecord(ctx, ms, "veh-1234")
+	assert.Equal(t, err, ErrKeyNotFound)
+	for _, key := range []string{"sw-1234", "veh-5678"} {
+		_, err := getRecord(ctx, ms, key)
+		assert.NilError(t, err)
+	}
+
+	// caas should have been told to drop the expired mapping
+	val := sm.GetTail(1)
+	assert.Assert(t, val.query == "/caas/v1/token/entity/delete")
+
+	t.Run("caas_failure", func(t *testing.T) {
+		// the record stays until caas drops the mapping so later sweeps retry
+		var mu sync.Mutex
+		status := http.StatusInternalServerError
+		caas := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.WriteHeader(status)
+		}))
+		defer caas.Close()
+		client, err := NewCAASClient(CAASSettings{
+			Server:         caas.URL,
+			CreateEndpoint: "/caas/v1/token/entity",
+			DeleteEndpoint: "/caas/v1/token/entity/delete",
+		})
+		assert.NilError(t, err)
+		updateSettings(&cgw, func(ls *liveSettings) {
+			ls.caas = client
+		})
+		assert.NilError(t, setRecord(ctx, ms, expired))
+
+		cgw.expireEntities(ctx)
+		_, err = getRecord(ctx, ms, "veh-1234")
+		assert.NilError(t, err)
+
+		mu.Lock()
+		status = http.StatusOK
+		mu.Unlock()
+		cgw.expireEntities(ctx)
+		_, err = getRecord(ctx, ms, "veh-1234")
+		assert.Equal(t, err, ErrKeyNotFound)
+	})
+}
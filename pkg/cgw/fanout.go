@@ -0,0 +1,217 @@
+package cgw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FanOutPolicy decides when a fan out disconnect succeeds
+type FanOutPolicy string
+
+// Different fan out policies, they apply to every broker group
+const (
+	// FanOutAny succeeds when any broker in each group confirms
+	FanOutAny FanOutPolicy = "any"
+	// FanOutAll succeeds when every broker in each group confirms
+	FanOutAll FanOutPolicy = "all"
+)
+
+// BrokerSettings represents a single broker, everything that isn't set is
+// inherited from the enclosing mqtt settings
+type BrokerSettings struct {
+	Name         string           `yaml:"name"`
+	Group        string           `yaml:"group"`
+	Server       string           `yaml:"server"`
+	Disconnecter DisconnecterType `yaml:"disconnecter"`
+}
+
+// BrokerResult is the outcome of disconnecting a client from one broker
+type BrokerResult struct {
+	Broker string `json:"broker"`
+	Group  string `json:"group,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BrokerReporter is implemented by disconnecters that can report per broker results
+type BrokerReporter interface {
+	DisconnectBrokers(context.Context, DisconnectRequest) ([]BrokerResult, error)
+}
+
+// disconnectBrokers disconnects with per broker results when the disconnecter supports it
+func disconnectBrokers(ctx context.Context, disconnecter Disconnecter, req DisconnectRequest) ([]BrokerResult, error) {
+	if reporter, ok := disconnecter.(BrokerReporter); ok {
+		return reporter.DisconnectBrokers(ctx, req)
+	}
+	return nil, disconnecter.Disconnect(ctx, req)
+}
+
+// validateBrokers checks the broker list and policy are consistent
+func (ms MQTTSettings) validateBrokers() error {
+	switch ms.FanOutPolicy {
+	case FanOutAny, FanOutAll, "":
+	default:
+		return fmt.Errorf("fan out policy is not supported, %s", ms.FanOutPolicy)
+	}
+	names := map[string]bool{}
+	for _, b := range ms.Brokers {
+		if IsEmpty(b.Name) || IsEmpty(b.Server) {
+			return errors.New("brokers require a name and server")
+		}
+		if names[b.Name] {
+			return fmt.Errorf("duplicate broker name, %s", b.Name)
+		}
+		names[b.Name] = true
+	}
+	return nil
+}
+
+// brokerSettings creates the settings for a single broker, brokers use the
+// disconnecter type kind unless they have their own
+func (ms MQTTSettings) brokerSettings(kind DisconnecterType, b BrokerSettings) (DisconnecterType, MQTTSettings) {
+	settings := ms
+	settings.Brokers = nil
+	settings.Server = b.Server
+	if !IsEmpty(string(b.Disconnecter)) {
+		kind = b.Disconnecter
+	}
+	if kind == RESTDisconnecterType {
+		settings.REST.Server = b.Server
+	}
+	return kind, settings
+}
+
+// fanOutBroker is a named disconnecter for a single broker
+type fanOutBroker struct {
+	name         string
+	group        string
+	disconnecter Disconnecter
+}
+
+// FanOutDisconnecter disconnects clients from several brokers in parallel
+type FanOutDisconnecter struct {
+	brokers []fanOutBroker
+	policy  FanOutPolicy
+}
+
+// NewFanOutDisconnecter creates a disconnecter for every broker in settings
+func NewFanOutDisconnecter(kind DisconnecterType, settings MQTTSettings, token string) (Disconnecter, error) {
+	if err := settings.validateBrokers(); err != nil {
+		return nil, err
+	}
+	handler := &FanOutDisconnecter{
+		policy: settings.FanOutPolicy,
+	}
+	if IsEmpty(string(handler.policy)) {
+		handler.policy = FanOutAny
+	}
+	for _, b := range settings.Brokers {
+		brokerKind, brokerSettings := settings.brokerSettings(kind, b)
+		disconnecter, err := NewDisconnecter(brokerKind, brokerSettings, token)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create disconnecter for broker %s, %s", b.Name, err)
+		}
+		handler.brokers = append(handler.brokers, fanOutBroker{
+			name:         b.Name,
+			group:        b.Group,
+			disconnecter: disconnecter,
+		})
+	}
+	return handler, nil
+}
+
+// run calls fn for every broker in parallel and collects the errors
+func (handler *FanOutDisconnecter) run(fn func(fanOutBroker) error) map[string]error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	errs := map[string]error{}
+	for _, b := range handler.brokers {
+		wg.Add(1)
+		go func(b fanOutBroker) {
+			defer wg.Done()
+			err := fn(b)
+			mu.Lock()
+			defer mu.Unlock()
+			errs[b.name] = err
+		}(b)
+	}
+	wg.Wait()
+	return errs
+}
+
+// brokers without a group are reported under this name
+const defaultBrokerGroup = "default"
+
+// check applies the policy to every group and returns the groups that failed
+func (handler *FanOutDisconnecter) check(errs map[string]error) []string {
+	succeeded := map[string]int{}
+	total := map[string]int{}
+	for _, b := range handler.brokers {
+		total[b.group]++
+		if errs[b.name] == nil {
+			succeeded[b.group]++
+		}
+	}
+	failed := []string{}
+	for group, count := range total {
+		if (handler.policy == FanOutAll && succeeded[group] != count) ||
+			(handler.policy == FanOutAny && succeeded[group] == 0) {
+			if IsEmpty(group) {
+				group = defaultBrokerGroup
+			}
+			failed = append(failed, group)
+		}
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+// DisconnectBrokers disconnects the client from every broker and reports each outcome
+func (handler *FanOutDisconnecter) DisconnectBrokers(ctx context.Context, req DisconnectRequest) ([]BrokerResult, error) {
+	errs := handler.run(func(b fanOutBroker) error {
+		return b.disconnecter.Disconnect(ctx, req)
+	})
+	results := []BrokerResult{}
+	for _, b := range handler.brokers {
+		result := BrokerResult{
+			Broker: b.name,
+			Group:  b.group,
+			Status: "success",
+		}
+		if err := errs[b.name]; err != nil {
+			ErrorLog("unable to disconnect %s from %s, %s", req.CreateKey(), b.name, err)
+			result.Status = "failure"
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	if failed := handler.check(errs); len(failed) > 0 {
+		return results, fmt.Errorf("%s policy not met for broker groups [%s]",
+			handler.policy, strings.Join(failed, ", "))
+	}
+	return results, nil
+}
+
+// Disconnect disconnects the client from every broker
+func (handler *FanOutDisconnecter) Disconnect(ctx context.Context, req DisconnectRequest) error {
+	_, err := handler.DisconnectBrokers(ctx, req)
+	return err
+}
+
+// Ping checks the brokers that support it against the policy
+func (handler *FanOutDisconnecter) Ping(ctx context.Context) error {
+	errs := handler.run(func(b fanOutBroker) error {
+		if pinger, ok := b.disconnecter.(Pinger); ok {
+			return pinger.Ping(ctx)
+		}
+		return nil
+	})
+	if failed := handler.check(errs); len(failed) > 0 {
+		return fmt.Errorf("brokers unreachable in groups [%s]", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package cgw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+type failingDisconnecter struct{}
+
+func (failingDisconnecter) Disconnect(ctx context.Context, ds DisconnectRequest) error {
+	return errors.New("broker unreachable")
+}
+
+func newTestFanOut(policy FanOutPolicy, brokers ...fanOutBroker) *FanOutDisconnecter {
+	return &FanOutDisconnecter{brokers: brokers, policy: policy}
+}
+
+func TestFanOutPolicy(t *testing.T) {
+	ok := func(name, group string) fanOutBroker {
+		return fanOutBroker{name: name, group: group, disconnecter: &dsMock{}}
+	}
+	bad := func(name, group string) fanOutBroker {
+		return fanOutBroker{name: name, group: group, disconnecter: failingDisconnecter{}}
+	}
+	req := DisconnectRequest{
+		EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+		ReasonCode: Reauthenticate,
+	}
+
+	testTable := map[string]struct {
+		handler *FanOutDisconnecter
+		err     string
+	}{
+		"any_one_confirms": {newTestFanOut(FanOutAny, ok("a", ""), bad("b", "")), ""},
+		"any_none_confirm": {newTestFanOut(FanOutAny, bad("a", ""), bad("b", "")), "any policy not met for broker groups [default]"},
+		"all_confirm":      {newTestFanOut(FanOutAll, ok("a", ""), ok("b", "")), ""},
+		"all_one_fails":    {newTestFanOut(FanOutAll, ok("a", ""), bad("b", "")), "all policy not met"},
+		"any_per_group": {
+			newTestFanOut(FanOutAny, ok("a1", "east"), bad("a2", "east"), bad("b1", "west"), bad("b2", "west")),
+			"any policy not met for broker groups [west]",
+		},
+	}
+	for name, tc := range testTable {
+		t.Run(name, func(t *testing.T) {
+			results, err := tc.handler.DisconnectBrokers(context.Background(), req)
+			if tc.err == "" {
+				assert.NilError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.err)
+			}
+			assert.Equal(t, len(results), len(tc.handler.brokers))
+			for i, b := range tc.handler.brokers {
+				assert.Equal(t, results[i].Broker, b.name)
+				_, failing := b.disconnecter.(failingDisconnecter)
+				assert.Equal(t, results[i].Status == "failure", failing)
+			}
+		})
+	}
+}
+
+func TestNewFanOutDisconnecter(t *testing.T) {
+	ds, err := NewDisconnecter(RESTDisconnecterType, MQTTSettings{
+		Brokers: []BrokerSettings{
+			{Name: "emqx-0", Server: "http://emqx-0:18083"},
+			{Name: "emqx-1", Server: "http://emqx-1:18083"},
+			{Name: "mosquitto", Server: "localhost:1883", Disconnecter: ConnectDisconnecterType},
+		},
+		FanOutPolicy: FanOutAll,
+	}, "")
+	assert.NilError(t, err)
+	fo := ds.(*FanOutDisconnecter)
+	assert.Equal(t, fo.policy, FanOutAll)
+	assert.Equal(t, len(fo.brokers), 3)
+	assert.Equal(t, fo.brokers[1].disconnecter.(*RESTDisconnecter).server, "http://emqx-1:18083")
+	_, ok := fo.brokers[2].disconnecter.(*MQTTDisconnecter)
+	assert.Assert(t, ok)
+
+	testTable := map[string]MQTTSettings{
+		"brokers require a name and server": {Brokers: []BrokerSettings{{Name: "a"}}},
+		"duplicate broker name, a":          {Brokers: []BrokerSettings{{Name: "a", Server: "x"}, {Name: "a", Server: "y"}}},
+		"fan out policy is not supported":   {FanOutPolicy: "most", Brokers: []BrokerSettings{{Name: "a", Server: "x"}}},
+	}
+	for k, v := range testTable {
+		_, err := NewDisconnecter(ConnectDisconnecterType, v, "")
+		assert.ErrorContains(t, err, k)
+	}
+}
+
+func TestDisconnectHandlerFanOut(t *testing.T) {
+	fo := newTestFanOut(FanOutAll,
+		fanOutBroker{name: "a", disconnecter: &dsMock{}},
+		fanOutBroker{name: "b", disconnecter: failingDisconnecter{}})
+	handler := disconnectHandler(metricsDisconnecter{fo}, gw.kv, gw.settings().caas,
+		map[ReasonCode]bool{}, gw.GetMEC, gw.GetToken, nil, nil)
+	dr := &DisconnectRequest{
+		EntityPair: EntityPair{
+			Entity:   "veh",
+			EntityID: "1234",
+		},
+		ReasonCode: Reauthenticate,
+	}
+
+	t.Run("fail_policy", func(t *testing.T) {
+		redMock.ExpectGet("veh-1234").SetVal("test.test")
+		defer redMock.ClearExpect()
+		w := httptest.NewRecorder()
+		handler(w, createTestRequest(t, nil, dr))
+		assert.Equal(t, w.Code, http.StatusInternalServerError)
+		body := map[string][]BrokerResult{}
+		assert.NilError(t, json.NewDecoder(w.Body).Decode(&body))
+		assert.DeepEqual(t, body["brokers"], []BrokerResult{
+			{Broker: "a", Status: "success"},
+			{Broker: "b", Status: "failure", Error: "broker unreachable"},
+		})
+	})
+
+	t.Run("success_any", func(t *testing.T) {
+		fo.policy = FanOutAny
+		redMock.ExpectGet("veh-1234").SetVal("test.test")
+		redMock.ExpectDel("veh-1234").SetVal(1)
+		defer redMock.ClearExpect()
+		w := httptest.NewRecorder()
+		handler(w, createTestRequest(t, nil, dr))
+		assert.Equal(t, w.Code, http.StatusOK)
+		body := map[string][]BrokerResult{}
+		assert.NilError(t, json.NewDecoder(w.Body).Decode(&body))
+		assert.Equal(t, len(body["brokers"]), 2)
+	})
+}
@@ -1,14 +1,12 @@
 package cgw
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 	"time"
-
-	"github.com/bsm/redislock"
-	"github.com/go-redis/redis/v8"
 )
 
 type ctxKey int
@@ -16,8 +14,11 @@ type requestType int
 
 // Type of requests that we will see from client
 const (
-	EntityTokenReq   requestType = 0
-	DisconnectionReq requestType = 1
+	EntityTokenReq    requestType = 0
+	DisconnectionReq  requestType = 1
+	HandoverReq       requestType = 2
+	BulkDisconnectReq requestType = 3
+	RefreshTokenReq   requestType = 4
 )
 
 // Type of values stored as ctx
@@ -30,17 +31,26 @@ func jsonDecodeHandler(reqType requestType, next http.HandlerFunc, appendLog app
 	return func(w http.ResponseWriter, req *http.Request) {
 		// deocde json based on the request type specified
 		var decodedReq interface{}
+		bodySize := int64(1 << 12)
 		switch reqType {
 		case EntityTokenReq:
 			decodedReq = &EntityTokenRequest{}
 		case DisconnectionReq:
 			decodedReq = &DisconnectRequest{}
+		case HandoverReq:
+			decodedReq = &HandoverRequest{}
+		case RefreshTokenReq:
+			decodedReq = &RefreshTokenRequest{}
+		case BulkDisconnectReq:
+			// explicit entity lists can get long
+			decodedReq = &BulkDisconnectRequest{}
+			bodySize = 1 << 20
 		default:
 			ErrorLog("request type is not specified")
 			http.Error(w, "Interal Server Error", http.StatusInternalServerError)
 			return
 		}
-		err := JSONDecodeRequest(w, req, 1<<12, decodedReq)
+		err := JSONDecodeRequest(w, req, bodySize, decodedReq)
 		if err != nil {
 			ErrorLog("error occured decoding json, %s", err)
 			return
@@ -58,7 +68,9 @@ func jsonDecodeHandler(reqType requestType, next http.HandlerFunc, appendLog app
 		}
 
 		// append to log
-		appendLog(req.RequestURI, decodedReq)
+		if appendLog != nil {
+			appendLog(req.RequestURI, decodedReq)
+		}
 
 		// put decoded JSON as part of context
 		newCtx := context.WithValue(req.Context(), DecodedJSON, decodedReq)
@@ -68,7 +80,7 @@ func jsonDecodeHandler(reqType requestType, next http.HandlerFunc, appendLog app
 
 // redisLockHandler locks the key for a specific entity pair
 // so concurrent requests on the same entity pair won't cause race condition
-func redisLockHandler(rs RedisStore, timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+func redisLockHandler(kv KeyValueStore, timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		// retrieve json from body
 		ctx := req.Context()
@@ -85,12 +97,10 @@ func redisLockHandler(rs RedisStore, timeout time.Duration, next http.HandlerFun
 			return
 		}
 
-		// setup retries for locks
-		backoff := redislock.LimitRetry(redislock.LinearBackoff(100*time.Millisecond), 3)
-		lock, err := rs.redisLock.Obtain(ctx, "lock:"+eid.GetEntityPair().CreateKey(), timeout, &redislock.Options{
-			RetryStrategy: backoff,
-		})
+		// store retries a few times before giving up on the lock
+		lock, err := kv.Lock(ctx, "lock:"+eid.GetEntityPair().CreateKey(), timeout)
 		if err != nil {
+			lockFailures.Inc()
 			ErrorLog("unable to obtain lock for resource, %s, %s", eid.GetEntityPair().CreateKey(), err)
 			http.Error(w, "Resource is currently in use", http.StatusUnprocessableEntity)
 			return
@@ -127,25 +137,63 @@ func getReqFromContext(ctx context.Context, w http.ResponseWriter, reqType reque
 			return false
 		}
 		*lValPtr = *rVal
+	case HandoverReq:
+		lValPtr, ok := dataPtr.(*HandoverRequest)
+		rVal, ok2 := value.(*HandoverRequest)
+		if !ok || !ok2 {
+			ErrorLog("unable to retrieve cast data from ctx, %t, %t", ok, ok2)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return false
+		}
+		*lValPtr = *rVal
+	case RefreshTokenReq:
+		lValPtr, ok := dataPtr.(*RefreshTokenRequest)
+		rVal, ok2 := value.(*RefreshTokenRequest)
+		if !ok || !ok2 {
+			ErrorLog("unable to retrieve cast data from ctx, %t, %t", ok, ok2)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return false
+		}
+		*lValPtr = *rVal
+	case BulkDisconnectReq:
+		lValPtr, ok := dataPtr.(*BulkDisconnectRequest)
+		rVal, ok2 := value.(*BulkDisconnectRequest)
+		if !ok || !ok2 {
+			ErrorLog("unable to retrieve cast data from ctx, %t, %t", ok, ok2)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return false
+		}
+		*lValPtr = *rVal
 	}
 	return true
 }
 
+// rotateTokenCb tells caas an entity's token was replaced
+type rotateTokenCb func(ctx context.Context, ep EntityPair, oldToken string, newToken string) error
+
 // refreshToken is used to handle refresh calls, rewrites entityid/token to redis
+// the caller has to present the current token, the record is locked for the whole
+// handler so the check and the write can't interleave with another refresh
 // returns 200 on success
+// returns 403 if the old token doesn't match
+// returns 502 if caas couldn't be notified of the rotation
+// returns 503 if calls to caas are failing fast
+// returns 500 if the store can't be written, caas is rotated back to the old token
 // returns 4xx for other errors
-func refreshTokenHandler(rs RedisStore) http.HandlerFunc {
+func refreshTokenHandler(kv KeyValueStore, expiry ExpirySettings, hasher *TokenHasher,
+	idle *IdleTracker, refresh RefreshSettings, rotate rotateTokenCb) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		// get context and set in redis
 		ctx := req.Context()
-		tokeReq := &EntityTokenRequest{}
-		if !getReqFromContext(ctx, w, EntityTokenReq, tokeReq) {
+		refReq := &RefreshTokenRequest{}
+		if !getReqFromContext(ctx, w, RefreshTokenReq, refReq) {
 			return
 		}
-		DebugLog("refresh token handler called, %v", tokeReq)
-		exists, err := rs.redisClient.Exists(ctx, tokeReq.CreateKey()).Result()
-		if exists == 0 {
-			ErrorLog("token doesn't exist, %s", err)
+		tokeReq := &refReq.EntityTokenRequest
+		DebugLog("refresh token handler called, %s", tokeReq.CreateKey())
+		rec, err := getRecord(ctx, kv, tokeReq.CreateKey())
+		if err == ErrKeyNotFound {
+			ErrorLog("token doesn't exist, %s", tokeReq.CreateKey())
 			http.Error(w, "Internal server error", http.StatusNotFound)
 			return
 		} else if err != nil {
@@ -153,21 +201,76 @@ func refreshTokenHandler(rs RedisStore) http.HandlerFunc {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
-		err = rs.redisClient.Set(ctx, tokeReq.CreateKey(), tokeReq.Token, 0).Err()
+		match, err := hasher.Verify(rec, refReq.OldToken)
+		if err != nil {
+			ErrorLog("error occur checking credentials of %s, %s", tokeReq.CreateKey(), err)
+			http.Error(w, "Error occured retrieving credentials", http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		if !match || rec.Expired(now) {
+			ErrorLog("old token doesn't match, %s", tokeReq.CreateKey())
+			http.Error(w, "User does not have access", http.StatusForbidden)
+			return
+		}
+		rotated := rotate != nil && refReq.OldToken != tokeReq.Token
+		if rotated {
+			if err := rotate(ctx, tokeReq.EntityPair, refReq.OldToken, tokeReq.Token); err != nil {
+				ErrorLog("unable to rotate token of %s with caas, %s", tokeReq.CreateKey(), err)
+				status := http.StatusBadGateway
+				if err == ErrCircuitOpen {
+					status = http.StatusServiceUnavailable
+				}
+				http.Error(w, "Error occured upstream", status)
+				return
+			}
+		}
+		// the old token keeps working for the grace period so in flight requests don't fail
+		rec.Previous = nil
+		if refresh.GracePeriod > 0 {
+			rec.retire(now.Add(time.Duration(refresh.GracePeriod) * time.Second))
+		}
+		// keep when and where the entity was created
+		rec.RefreshedAt = now.Unix()
+		err = writeTokenRecord(ctx, w, kv, expiry, hasher, rec, tokeReq)
 		if err != nil {
 			ErrorLog("error occured setting token, %s", err)
+			// caas goes back to the old token so it still agrees with the store,
+			// the caller might have given up already, the client timeout bounds the rollback
+			if rotated {
+				rbErr := rotate(context.Background(), tokeReq.EntityPair, tokeReq.Token, refReq.OldToken)
+				if rbErr != nil {
+					ErrorLog("unable to roll back caas rotation for %s, %s", tokeReq.CreateKey(), rbErr)
+				}
+			}
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		touchActivity(ctx, idle, tokeReq.EntityPair)
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
+// writeTokenRecord stores the requested token in the record along with its expiry and sets the expiry header
+func writeTokenRecord(ctx context.Context, w http.ResponseWriter, kv KeyValueStore,
+	expiry ExpirySettings, hasher *TokenHasher, rec EntityRecord, tokeReq *EntityTokenRequest) error {
+	if err := hasher.Seal(&rec, tokeReq.Token); err != nil {
+		return err
+	}
+	rec.ExpiresAt = 0
+	if ttl := expiry.TTL(tokeReq.TTL); ttl > 0 {
+		rec.ExpiresAt = time.Now().Add(ttl).Unix()
+		w.Header().Set("token-expires-at", strconv.FormatInt(rec.ExpiresAt, 10))
+	}
+	// expired tokens are rejected, the sweeper removes the key once caas is cleaned up
+	return setRecord(ctx, kv, rec)
+}
+
 // validateToken validates the entity/token mapping
 // returns 200 on success
 // returns 400 if it doesn't exist
 // returns 4xx for other errors
-func validateTokenHandler(rs RedisStore) http.HandlerFunc {
+func validateTokenHandler(kv KeyValueStore, hasher *TokenHasher, idle *IdleTracker) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		// create context and check with redis, redis must have the most up to date lookup
 		ctx := req.Context()
@@ -175,17 +278,35 @@ func validateTokenHandler(rs RedisStore) http.HandlerFunc {
 		if !getReqFromContext(ctx, w, EntityTokenReq, tokeReq) {
 			return
 		}
-		val, err := rs.redisClient.Get(ctx, tokeReq.CreateKey()).Result()
-		if err == redis.Nil || val != tokeReq.Token {
-			ErrorLog("user has no access, %+v", tokeReq)
+		rec, err := getRecord(ctx, kv, tokeReq.CreateKey())
+		match := false
+		if err == nil {
+			match, err = hasher.Verify(rec, tokeReq.Token)
+		}
+		// tokens replaced by a refresh are accepted until their grace period ends
+		if prev, ok := rec.previous(time.Now()); err == nil && !match && ok {
+			match, err = hasher.Verify(prev, tokeReq.Token)
+			// the key of a replaced token may have been dropped, it just doesn't match then
+			if errors.Is(err, ErrUnknownTokenKey) {
+				match, err = false, nil
+			}
+		}
+		if err == ErrKeyNotFound || (err == nil && !match) {
+			ErrorLog("user has no access, %s", tokeReq.CreateKey())
 			http.Error(w, "User does not have access", http.StatusForbidden)
 			return
 		} else if err != nil {
-			ErrorLog("error occur getting key from redis, %+v", tokeReq)
+			ErrorLog("error occur checking credentials of %s, %s", tokeReq.CreateKey(), err)
 			http.Error(w, "Error occured retrieving credentials", http.StatusInternalServerError)
 			return
 		}
-		DebugLog("retrieved value %s from %s", val, tokeReq.CreateKey())
+		if rec.Expired(time.Now()) {
+			ErrorLog("token has expired, %+v", tokeReq)
+			http.Error(w, "User does not have access", http.StatusForbidden)
+			return
+		}
+		DebugLog("validated %s", tokeReq.CreateKey())
+		touchActivity(ctx, idle, tokeReq.EntityPair)
 		w.WriteHeader(http.StatusOK)
 	}
 }
@@ -193,13 +314,13 @@ func validateTokenHandler(rs RedisStore) http.HandlerFunc {
 // createNewToken creates a new entity/token mapping on gateway
 // returns 200 on success
 // returns 409 if there's conflict
+// returns 503 if calls to caas are failing fast
 // returns 4xx for other errors
-func createNewTokenHandler(rs RedisStore,
-	endpoint string, mecID readMECCb, bearerToken readTokenCb) http.HandlerFunc {
+func createNewTokenHandler(kv KeyValueStore, expiry ExpirySettings, hasher *TokenHasher,
+	caas CAASClient, mecID readMECCb, bearerToken readTokenCb) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		// the entity ID send to us is the new entity ID that crs created
 		// it will never be populated in cache, need to always check with caas first
-		// create new request to send to caas
 		ctx := req.Context()
 		tokeReq := &EntityTokenRequest{}
 		if !getReqFromContext(ctx, w, EntityTokenReq, tokeReq) {
@@ -209,61 +330,43 @@ func createNewTokenHandler(rs RedisStore,
 			EntityTokenRequest: *tokeReq,
 			MEC:                mecID(),
 		}
-		jsBytes, err := json.Marshal(valReq)
-		if err != nil {
-			ErrorLog("encoding json error, %s", err)
-			http.Error(w, "Error occured upstream", http.StatusInternalServerError)
+		err := caas.CreateToken(ctx, valReq, bearerToken())
+		var conflict *ConflictError
+		var upErr *UpstreamError
+		if errors.As(err, &conflict) {
+			// tell the caller which entity owns the token
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(conflict.Existing)
 			return
-		}
-		resp, err := HTTPRequest(ctx, "POST", endpoint,
-			map[string]string{
-				"Content-Type":  "application/json",
-				"Authorization": "Bearer " + bearerToken(),
-			}, nil, bytes.NewBuffer(jsBytes))
-		if err != nil {
+		} else if errors.As(err, &upErr) {
+			ErrorLog("error response from caas %d", upErr.Status)
+			http.Error(w, "Error occured upstream", upErr.Status)
+			return
+		} else if err != nil {
 			ErrorLog("error occured making request to caas, %s", err)
-			http.Error(w, "Error occured upstream", http.StatusInternalServerError)
+			http.Error(w, "Error occured upstream", caasStatusCode(err))
 			return
 		}
-		// check response
-		if resp.status == http.StatusOK {
-			// write to cache and write OK to client
-			err := rs.redisClient.Set(ctx, tokeReq.CreateKey(), tokeReq.Token, 0).Err()
-			if err != nil {
-				ErrorLog("error writing new entry to cache, %s", err.Error())
-				http.Error(w, "Internal server cache write error", http.StatusInternalServerError)
-				return
-			}
-			w.WriteHeader(http.StatusOK)
-		} else if resp.status == http.StatusConflict {
-			// we should only get here if the tokens match
-			// check if json is formed correctly and not empty
-			eID := &EntityPair{}
-			err := json.Unmarshal(resp.body, eID)
-			if err != nil {
-				ErrorLog("decoding json response from caas filed, %s", err.Error())
-				http.Error(w, "Internal server decoding error", http.StatusInternalServerError)
-				return
-			}
-			if !eID.IsValid() {
-				ErrorLog("received empty response from caas, entity exists, %s", err.Error())
-				http.Error(w, "Internal server decoding error", http.StatusInternalServerError)
-				return
-			}
-			w.WriteHeader(http.StatusConflict)
-			w.Write(resp.body)
-		} else {
-			ErrorLog("error response from caas %d", resp.status)
-			DebugLog("body response from caas %s", resp.body)
-			http.Error(w, "Error occured upstream", resp.status)
+		// write to cache and write OK to client
+		err = writeTokenRecord(ctx, w, kv, expiry, hasher, EntityRecord{
+			EntityPair: tokeReq.EntityPair,
+			CreatedAt:  time.Now().Unix(),
+			MEC:        valReq.MEC,
+		}, tokeReq)
+		if err != nil {
+			ErrorLog("error writing new entry to cache, %s", err.Error())
+			http.Error(w, "Internal server cache write error", http.StatusInternalServerError)
+			return
 		}
+		w.WriteHeader(http.StatusOK)
 	}
 }
 
 // disconnectHandler disconnects the
-func disconnectHandler(disconnecter Disconnecter,
-	rs RedisStore, deleteIDEndpoint string,
-	upstreamReasonCodes map[ReasonCode]bool, mecID readMECCb, bearerToken readTokenCb) http.HandlerFunc {
+func disconnectHandler(disconnecter Disconnecter, kv KeyValueStore, caas CAASClient,
+	upstreamReasonCodes map[ReasonCode]bool, mecID readMECCb, bearerToken readTokenCb,
+	handover *HandoverClient, hasher *TokenHasher) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		// create context and try to disconnect first
 		ctx := req.Context()
@@ -272,9 +375,22 @@ func disconnectHandler(disconnecter Disconnecter,
 			return
 		}
 
+		// the token is only sent to configured peers, check before anything changes
+		handingOver := disReq.ReasonCode == Handover && handover != nil
+		if handingOver && IsEmpty(disReq.NextServer) {
+			ErrorLog("handover requested without next server, %s", disReq.CreateKey())
+			http.Error(w, "Next server is required for handover", http.StatusBadRequest)
+			return
+		}
+		if handingOver && !handover.hasPeer(disReq.NextServer) {
+			ErrorLog("handover requested to unknown next server %s, %s", disReq.NextServer, disReq.CreateKey())
+			http.Error(w, "Next server is not a handover peer", http.StatusBadRequest)
+			return
+		}
+
 		// (1) get key from redis
-		token, err := rs.redisClient.Get(ctx, disReq.CreateKey()).Result()
-		if err == redis.Nil {
+		rec, err := getRecord(ctx, kv, disReq.CreateKey())
+		if err == ErrKeyNotFound {
 			ErrorLog("entity does not exist, %s", disReq.CreateKey())
 			http.Error(w, "Entity/EntityID does not exist", http.StatusNotFound)
 			return
@@ -284,50 +400,53 @@ func disconnectHandler(disconnecter Disconnecter,
 			return
 		}
 
+		// caas and the next gateway need the token itself
+		_, upstream := upstreamReasonCodes[disReq.ReasonCode]
+		token := ""
+		if upstream || handingOver {
+			token, err = hasher.Open(rec)
+			if err != nil {
+				ErrorLog("unable to recover token of %s, %s", disReq.CreateKey(), err)
+				http.Error(w, "Internal error occured with key store", http.StatusInternalServerError)
+				return
+			}
+		}
+
 		skipped := false
 		// (2) if needed, delete
-		if _, ok := upstreamReasonCodes[disReq.ReasonCode]; ok {
-			valReq := ValidateTokenRequest{
-				EntityTokenRequest: EntityTokenRequest{
-					EntityPair: disReq.EntityPair,
-					Token:      token,
-				},
-				MEC: mecID(),
-			}
-			jsBytes, err := json.Marshal(valReq)
-			DebugLog("sending to caas: %s", jsBytes)
-			resp, err := HTTPRequest(ctx, "POST", deleteIDEndpoint,
-				map[string]string{
-					"Content-Type":  "application/json",
-					"Authorization": "Bearer " + bearerToken(),
-				}, nil, bytes.NewBuffer(jsBytes))
+		if upstream {
+			skipped, err = caasDeleteEntity(ctx, caas, disReq.EntityPair, token, mecID(), bearerToken())
 			if err != nil {
 				ErrorLog("unable to make request to caas, %v", err)
-				http.Error(w, "Unable to make request to caas", http.StatusInternalServerError)
+				http.Error(w, "Unable to make request to caas", caasStatusCode(err))
 				return
 			}
-			if resp.status == http.StatusNotFound {
-				// if entityid/token mapping is not found, swallow the error for now since its gone already
-				ErrorLog("unable to find entityid, got back %d from caas, %s",
-					resp.status, resp.body)
-				skipped = true
-			} else if resp.status != http.StatusNoContent {
-				ErrorLog("bad response from caas, got back %d from caas, %s",
-					resp.status, resp.body)
-				http.Error(w, "Unable to make request to caas", http.StatusInternalServerError)
+		}
+
+		// (3) hand the entity over to the next gateway before the client moves
+		if handingOver {
+			err = handover.Push(ctx, disReq.NextServer, rec, token, mecID())
+			if err != nil {
+				ErrorLog("unable to hand over %s to %s, %s", disReq.CreateKey(), disReq.NextServer, err)
+				http.Error(w, "Unable to hand over entity to next server", http.StatusBadGateway)
 				return
 			}
 		}
 
-		// (3) disconnect the client
+		// (4) disconnect the client
 		// Disconnect call should always return success even if there's nothing to delete
-		err = disconnecter.Disconnect(ctx, *disReq)
+		// brokers report their own outcome when disconnects fan out
+		results, err := disconnectBrokers(ctx, disconnecter, *disReq)
 		if err != nil {
 			ErrorLog("disconnect error, %s", err.Error())
+			if results != nil {
+				writeBrokerResults(w, http.StatusInternalServerError, results)
+				return
+			}
 			http.Error(w, "Internal error occured while disconnecting", http.StatusInternalServerError)
 			return
 		}
-		err = rs.redisClient.Del(ctx, disReq.CreateKey()).Err()
+		err = kv.Delete(ctx, disReq.CreateKey())
 		if err != nil {
 			ErrorLog("error deleting key from redis, %s", err)
 			http.Error(w, "Internal error occured with key store", http.StatusInternalServerError)
@@ -337,6 +456,17 @@ func disconnectHandler(disconnecter Disconnecter,
 		if skipped {
 			w.Header().Add("caas-verification", "skipped")
 		}
+		if results != nil {
+			writeBrokerResults(w, http.StatusOK, results)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// writeBrokerResults writes the per broker disconnect results
+func writeBrokerResults(w http.ResponseWriter, status int, results []BrokerResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]BrokerResult{"brokers": results})
+}
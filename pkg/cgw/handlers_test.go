@@ -5,9 +5,11 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -39,28 +41,53 @@ func TestMain(m *testing.M) {
 	var rClient *redis.Client
 	rClient, redMock = redismock.NewClientMock()
 	gw = CAASGateway{
-		mecID:                 "local.mec",
-		caasCreateURL:         "http://localhost:9090/caas/v1/token/entity",
-		caasDeleteEntityIDURL: "http://localhost:9090/caas/v1/token/entity/delete",
-		upstreamReasonCodes:   map[ReasonCode]bool{Idle: true, NotAuthorized: true},
-		disconnecter:          &dsMock{},
-		token:                 "password",
-		debugSettings: DebugSettings{
-			DebugLog: true,
-		},
-		requestLog: make([]interface{}, 0),
-		kv: RedisStore{
+		disconnecter: &dsMock{},
+		token:        &BearerToken{token: "password"},
+		state:        newGatewayState("local.mec", true),
+		kv: &RedisStore{
 			redisClient: rClient,
 			redisLock:   redislock.New(rClient),
 		},
 	}
+	caas, _ := NewCAASClient(CAASSettings{
+		Server:         "http://localhost:9090",
+		CreateEndpoint: "/caas/v1/token/entity",
+		DeleteEndpoint: "/caas/v1/token/entity/delete",
+	})
+	gw.setSettings(&liveSettings{
+		upstreamReasonCodes: map[ReasonCode]bool{Idle: true, NotAuthorized: true},
+		caas:                caas,
+		debugSettings: DebugSettings{
+			DebugLog: true,
+		},
+	})
 	stop := make(chan struct{})
 	go sm.StartServer("9090", stop)
+	waitForServer("localhost:9090")
 	exitVal := m.Run()
 	stop <- struct{}{}
 	os.Exit(exitVal)
 }
 
+// updateSettings replaces the settings of cgw with a copy changed by update
+func updateSettings(cgw *CAASGateway, update func(ls *liveSettings)) {
+	ls := *cgw.settings()
+	update(&ls)
+	cgw.setSettings(&ls)
+}
+
+// waitForServer blocks until something is listening on addr
+func waitForServer(addr string) {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
 func createTestRequest(t *testing.T, bodyStruct interface{}, ctxStruct interface{}) *http.Request {
 	var req *http.Request
 	var err error
@@ -141,7 +168,7 @@ func TestJSONDecodeHandler(t *testing.T) {
 
 	// check bad handler initialization
 	t.Run("bad_handler", func(t *testing.T) {
-		badHandler := jsonDecodeHandler(requestType(2), func(w http.ResponseWriter, req *http.Request) { lastReq = req }, nil)
+		badHandler := jsonDecodeHandler(requestType(99), func(w http.ResponseWriter, req *http.Request) { lastReq = req }, nil)
 		req := createTestRequest(t, map[string]string{"x": "test"}, nil)
 		w := &httptest.ResponseRecorder{}
 		badHandler(w, req)
@@ -169,12 +196,18 @@ func TestRedisLock(t *testing.T) {
 	redMock.Regexp().ExpectSetNX("lock:veh-1234", `[a-z1-9]*`, 5*time.Second).SetVal(false)
 	redMock.Regexp().ExpectSetNX("lock:veh-1234", `[a-z1-9]*`, 5*time.Second).SetVal(false)
 	defer redMock.ClearExpect()
-	w := &httptest.ResponseRecorder{}
-	go lockHandler(w, req)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lockHandler(&httptest.ResponseRecorder{}, req)
+	}()
 	time.Sleep(100 * time.Millisecond)
+	w := &httptest.ResponseRecorder{}
 	lockHandler(w, req)
-	assert.Equal(t, x, 1)
 	assert.Equal(t, w.Code, http.StatusUnprocessableEntity)
+	// the first request has to release its lock before the mock is cleared
+	<-done
+	assert.Equal(t, x, 1)
 }
 
 func TestGetReqFromContext(t *testing.T) {
@@ -213,18 +246,21 @@ func TestGetReqFromContext(t *testing.T) {
 }
 
 func TestRefreshToken(t *testing.T) {
-	handler := refreshTokenHandler(gw.kv)
-	etr := &EntityTokenRequest{
-		EntityPair: EntityPair{
-			Entity:   "veh",
-			EntityID: "1234",
+	handler := refreshTokenHandler(gw.kv, gw.expiry, nil, nil, RefreshSettings{}, nil)
+	etr := &RefreshTokenRequest{
+		EntityTokenRequest: EntityTokenRequest{
+			EntityPair: EntityPair{
+				Entity:   "veh",
+				EntityID: "1234",
+			},
+			Token: "test.test",
 		},
-		Token: "test.test",
+		OldToken: "old.test",
 	}
 	t.Run("success_case", func(t *testing.T) {
 		// key exists and overwrite value
-		redMock.ExpectExists("veh-1234").SetVal(1)
-		redMock.ExpectSet("veh-1234", "test.test", 0).SetVal("")
+		redMock.ExpectGet("veh-1234").SetVal(`{"entity":"veh","entityid":"1234","token":"old.test","createdAt":1600000000,"mec":"local.mec"}`)
+		redMock.Regexp().ExpectSet("veh-1234", `\{"entity":"veh","entityid":"1234","token":"test\.test","createdAt":1600000000,"refreshedAt":[0-9]+,"mec":"local\.mec"\}`, 0).SetVal("")
 		defer redMock.ClearExpect()
 		writer := httptest.NewRecorder()
 		req := createTestRequest(t, nil, etr)
@@ -233,18 +269,136 @@ func TestRefreshToken(t *testing.T) {
 	})
 	t.Run("fail_case", func(t *testing.T) {
 		// key does not exists
-		redMock.ExpectExists("veh-1234").SetVal(0)
-		redMock.ExpectSet("veh-1234", "test.test", 0).SetVal("")
+		redMock.ExpectGet("veh-1234").RedisNil()
 		defer redMock.ClearExpect()
 		writer := httptest.NewRecorder()
 		req := createTestRequest(t, nil, etr)
 		handler(writer, req)
 		assert.Equal(t, writer.Code, http.StatusNotFound)
 	})
+	t.Run("wrong_old_token", func(t *testing.T) {
+		// the old token has to match before anything is written
+		redMock.ExpectGet("veh-1234").SetVal(`{"entity":"veh","entityid":"1234","token":"other.test"}`)
+		defer redMock.ClearExpect()
+		writer := httptest.NewRecorder()
+		req := createTestRequest(t, nil, etr)
+		handler(writer, req)
+		assert.Equal(t, writer.Code, http.StatusForbidden)
+		assert.NilError(t, redMock.ExpectationsWereMet())
+	})
+}
+
+func TestRefreshGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore()
+	ep := EntityPair{Entity: "veh", EntityID: "1234"}
+	assert.NilError(t, setRecord(ctx, ms, EntityRecord{EntityPair: ep, Token: "old.test"}))
+	validate := func(token string) int {
+		w := httptest.NewRecorder()
+		validateTokenHandler(ms, nil, nil)(w, createTestRequest(t, nil, &EntityTokenRequest{EntityPair: ep, Token: token}))
+		return w.Code
+	}
+
+	w := httptest.NewRecorder()
+	refreshTokenHandler(ms, ExpirySettings{}, nil, nil, RefreshSettings{GracePeriod: 60}, nil)(w,
+		createTestRequest(t, nil, &RefreshTokenRequest{
+			EntityTokenRequest: EntityTokenRequest{EntityPair: ep, Token: "new.test"},
+			OldToken:           "old.test",
+		}))
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, validate("new.test"), http.StatusOK)
+	assert.Equal(t, validate("old.test"), http.StatusOK)
+
+	// the replaced token can't be used to refresh again
+	w = httptest.NewRecorder()
+	refreshTokenHandler(ms, ExpirySettings{}, nil, nil, RefreshSettings{GracePeriod: 60}, nil)(w,
+		createTestRequest(t, nil, &RefreshTokenRequest{
+			EntityTokenRequest: EntityTokenRequest{EntityPair: ep, Token: "other.test"},
+			OldToken:           "old.test",
+		}))
+	assert.Equal(t, w.Code, http.StatusForbidden)
+
+	// once the grace period is over only the new token validates
+	rec, err := getRecord(ctx, ms, ep.CreateKey())
+	assert.NilError(t, err)
+	rec.Previous.ValidUntil = time.Now().Add(-time.Second).Unix()
+	assert.NilError(t, setRecord(ctx, ms, rec))
+	assert.Equal(t, validate("new.test"), http.StatusOK)
+	assert.Equal(t, validate("old.test"), http.StatusForbidden)
+
+	// refreshing without a grace period drops the old token right away
+	w = httptest.NewRecorder()
+	refreshTokenHandler(ms, ExpirySettings{}, nil, nil, RefreshSettings{}, nil)(w,
+		createTestRequest(t, nil, &RefreshTokenRequest{
+			EntityTokenRequest: EntityTokenRequest{EntityPair: ep, Token: "last.test"},
+			OldToken:           "new.test",
+		}))
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, validate("new.test"), http.StatusForbidden)
+}
+
+func TestRefreshRotatesCAAS(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore()
+	ep := EntityPair{Entity: "veh", EntityID: "1234"}
+	assert.NilError(t, setRecord(ctx, ms, EntityRecord{EntityPair: ep, Token: "old.test"}))
+	defer sm.ClearDB()
+	handler := refreshTokenHandler(ms, ExpirySettings{}, nil, nil, RefreshSettings{},
+		caasRotateToken(gw.settings().caas, gw.GetMEC, gw.GetToken))
+
+	// caas rejects the new token so nothing changes
+	w := httptest.NewRecorder()
+	handler(w, createTestRequest(t, nil, &RefreshTokenRequest{
+		EntityTokenRequest: EntityTokenRequest{EntityPair: ep, Token: "fail.test"},
+		OldToken:           "old.test",
+	}))
+	assert.Equal(t, w.Code, http.StatusBadGateway)
+	rec, err := getRecord(ctx, ms, ep.CreateKey())
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Token, "old.test")
+
+	w = httptest.NewRecorder()
+	handler(w, createTestRequest(t, nil, &RefreshTokenRequest{
+		EntityTokenRequest: EntityTokenRequest{EntityPair: ep, Token: "new.test"},
+		OldToken:           "old.test",
+	}))
+	assert.Equal(t, w.Code, http.StatusOK)
+	created, deleted := sm.GetTail(2), sm.GetTail(1)
+	assert.Equal(t, created.query, "/caas/v1/token/entity")
+	assert.Assert(t, strings.Contains(string(created.body), `"token":"new.test"`))
+	assert.Equal(t, deleted.query, "/caas/v1/token/entity/delete")
+	assert.Assert(t, strings.Contains(string(deleted.body), `"token":"old.test"`))
+
+	// caas is rotated back when the new token can't be stored
+	rotations := [][2]string{}
+	rotate := func(ctx context.Context, ep EntityPair, oldToken string, newToken string) error {
+		rotations = append(rotations, [2]string{oldToken, newToken})
+		return nil
+	}
+	w = httptest.NewRecorder()
+	refreshTokenHandler(readOnlyStore{ms}, ExpirySettings{}, nil, nil, RefreshSettings{}, rotate)(w,
+		createTestRequest(t, nil, &RefreshTokenRequest{
+			EntityTokenRequest: EntityTokenRequest{EntityPair: ep, Token: "last.test"},
+			OldToken:           "new.test",
+		}))
+	assert.Equal(t, w.Code, http.StatusInternalServerError)
+	assert.DeepEqual(t, rotations, [][2]string{{"new.test", "last.test"}, {"last.test", "new.test"}})
+	rec, err = getRecord(ctx, ms, ep.CreateKey())
+	assert.NilError(t, err)
+	assert.Equal(t, rec.Token, "new.test")
+}
+
+// readOnlyStore fails every write so tests can check what happens after caas was changed
+type readOnlyStore struct {
+	KeyValueStore
+}
+
+func (rs readOnlyStore) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return errors.New("store is read only")
 }
 
 func TestValidateToken(t *testing.T) {
-	handler := validateTokenHandler(gw.kv)
+	handler := validateTokenHandler(gw.kv, nil, nil)
 	etr := &EntityTokenRequest{
 		EntityPair: EntityPair{
 			Entity:   "veh",
@@ -285,7 +439,7 @@ func TestValidateToken(t *testing.T) {
 
 func TestCreateNewToken(t *testing.T) {
 	// setup http handler
-	handler := createNewTokenHandler(gw.kv, gw.caasCreateURL, gw.GetMEC, gw.GetToken)
+	handler := createNewTokenHandler(gw.kv, gw.expiry, nil, gw.settings().caas, gw.GetMEC, gw.GetToken)
 	etr := &EntityTokenRequest{
 		Token: "test.test",
 		EntityPair: EntityPair{
@@ -296,7 +450,7 @@ func TestCreateNewToken(t *testing.T) {
 
 	t.Run("success_case", func(t *testing.T) {
 		// set expectations
-		redMock.ExpectSet("veh-1234", "test.test", 0).SetVal("")
+		redMock.Regexp().ExpectSet("veh-1234", `\{"entity":"veh","entityid":"1234","token":"test\.test","createdAt":[0-9]+,"mec":"local\.mec"\}`, 0).SetVal("")
 		defer func() {
 			redMock.ClearExpect()
 			sm.ClearDB()
@@ -318,7 +472,7 @@ func TestCreateNewToken(t *testing.T) {
 	t.Run("conflict_case", func(t *testing.T) {
 		// create 2 requests and run after each other
 		writer := httptest.NewRecorder()
-		redMock.ExpectSet("veh-1234", "test.test", 0).SetVal("")
+		redMock.Regexp().ExpectSet("veh-1234", `\{"entity":"veh","entityid":"1234","token":"test\.test","createdAt":[0-9]+,"mec":"local\.mec"\}`, 0).SetVal("")
 		req := createTestRequest(t, nil, etr)
 		handler(writer, req)
 		req = createTestRequest(t, nil, etr)
@@ -348,10 +502,10 @@ func TestCreateNewToken(t *testing.T) {
 
 func TestDisconnectHandler(t *testing.T) {
 	ds := &dsMock{}
-	handler := disconnectHandler(ds, gw.kv, gw.caasDeleteEntityIDURL, map[ReasonCode]bool{
+	handler := disconnectHandler(ds, gw.kv, gw.settings().caas, map[ReasonCode]bool{
 		Idle:          true,
 		NotAuthorized: true,
-	}, gw.GetMEC, gw.GetToken)
+	}, gw.GetMEC, gw.GetToken, nil, nil)
 	dr := &DisconnectRequest{
 		EntityPair: EntityPair{
 			Entity:   "veh",
@@ -0,0 +1,189 @@
+package cgw
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// default path gateways accept handovers on
+const defaultHandoverEndpoint = "/cgw/v1/handover"
+
+// ErrUnknownPeer is returned when the next server isn't one of the configured peers
+var ErrUnknownPeer = errors.New("next server is not a handover peer")
+
+// HandoverSettings represents settings for handing entities over to the next gateway
+// Peers maps a NextServer to the base url of its gateway, entities are only handed
+// over to listed servers since the token is sent along,
+// TokenFile has the bearer token presented to peers, peers present the same token
+// to this gateway when inbound auth is disabled
+type HandoverSettings struct {
+	Enabled   bool              `yaml:"enabled"`
+	Endpoint  string            `yaml:"endpoint"`
+	Peers     map[string]string `yaml:"peers"`
+	TokenFile string            `yaml:"tokenFile"`
+}
+
+// validate checks the handover fields are consistent
+func (hs HandoverSettings) validate() error {
+	if !hs.Enabled {
+		return nil
+	}
+	if len(hs.Peers) == 0 {
+		return errors.New("handover requires at least one peer")
+	}
+	for server, peer := range hs.Peers {
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid peer url for %s, %s", server, peer)
+		}
+	}
+	return nil
+}
+
+// HandoverClient pushes entity records to the gateway at the next server
+type HandoverClient struct {
+	endpoint string
+	peers    map[string]string
+	token    string
+	header   map[string]string
+}
+
+// NewHandoverClient creates a handover client for the configured peers
+func NewHandoverClient(settings HandoverSettings) (*HandoverClient, error) {
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+	hc := &HandoverClient{
+		endpoint: settings.Endpoint,
+		peers:    settings.Peers,
+		header:   map[string]string{"Content-Type": "application/json"},
+	}
+	if IsEmpty(hc.endpoint) {
+		hc.endpoint = defaultHandoverEndpoint
+	}
+	// the endpoint is also the path handovers are accepted on
+	hc.endpoint = "/" + strings.TrimPrefix(hc.endpoint, "/")
+	if !IsEmpty(settings.TokenFile) {
+		tBytes, err := ioutil.ReadFile(settings.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		if IsEmpty(string(tBytes)) {
+			return nil, errors.New("handover token is empty")
+		}
+		hc.token = strings.TrimSpace(string(tBytes))
+		hc.header["Authorization"] = "Bearer " + hc.token
+	}
+	return hc, nil
+}
+
+// peerURL finds the handover url of the gateway serving nextServer, only
+// configured peers are handed entities
+func (hc *HandoverClient) peerURL(nextServer string) (string, error) {
+	peer, ok := hc.peers[nextServer]
+	if !ok {
+		return "", ErrUnknownPeer
+	}
+	return URLJoin(peer, hc.endpoint)
+}
+
+// hasPeer checks if entities can be handed over to nextServer
+func (hc *HandoverClient) hasPeer(nextServer string) bool {
+	_, ok := hc.peers[nextServer]
+	return ok
+}
+
+// Push sends the record with its token to the gateway at nextServer and waits for it to be acknowledged
+func (hc *HandoverClient) Push(ctx context.Context, nextServer string, rec EntityRecord, token string, sourceMEC string) error {
+	endpoint, err := hc.peerURL(nextServer)
+	if err != nil {
+		return err
+	}
+	jsBytes, err := json.Marshal(HandoverRequest{
+		EntityPair: rec.EntityPair,
+		Token:      token,
+		ExpiresAt:  rec.ExpiresAt,
+		CreatedAt:  rec.CreatedAt,
+		SourceMEC:  sourceMEC,
+	})
+	if err != nil {
+		return err
+	}
+	DebugLog("handing over %s to %s", rec.CreateKey(), endpoint)
+	resp, err := HTTPRequest(ctx, "POST", endpoint, hc.header, nil, bytes.NewBuffer(jsBytes))
+	if err != nil {
+		return err
+	}
+	if resp.status != http.StatusOK {
+		return fmt.Errorf("peer rejected handover with %d, %s", resp.status, strings.TrimSpace(string(resp.body)))
+	}
+	return nil
+}
+
+// handoverPeerHandler rejects handovers from peers that don't present the handover token,
+// the token is only checked when inbound auth is disabled since auth covers the route otherwise
+func handoverPeerHandler(auth *Authenticator, hc *HandoverClient, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if auth != nil {
+			next(w, req)
+			return
+		}
+		header := req.Header.Get("Authorization")
+		if IsEmpty(hc.token) || !strings.HasPrefix(header, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(hc.token)) != 1 {
+			ErrorLog("unable to authenticate handover peer")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// handoverHandler stores entities handed over from another gateway, the entity
+// is registered on this mec from now on
+// returns 200 once the record is stored
+// returns 4xx if the token can't be accepted
+func handoverHandler(kv KeyValueStore, hasher *TokenHasher, mecID readMECCb) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		hReq := &HandoverRequest{}
+		if !getReqFromContext(ctx, w, HandoverReq, hReq) {
+			return
+		}
+		rec := EntityRecord{
+			EntityPair: EntityPair{
+				Entity:   strings.ToLower(hReq.Entity),
+				EntityID: hReq.EntityID,
+			},
+			ExpiresAt: hReq.ExpiresAt,
+			CreatedAt: hReq.CreatedAt,
+			MEC:       mecID(),
+		}
+		if rec.Expired(time.Now()) {
+			ErrorLog("handover from %s has an expired token, %s", hReq.SourceMEC, rec.CreateKey())
+			http.Error(w, "Token has expired", http.StatusGone)
+			return
+		}
+		err := hasher.Seal(&rec, hReq.Token)
+		if err == nil {
+			err = setRecord(ctx, kv, rec)
+		}
+		if err != nil {
+			ErrorLog("error setting handover record, %s", err)
+			http.Error(w, "Internal error occured with key store", http.StatusInternalServerError)
+			return
+		}
+		DebugLog("accepted handover of %s from %s", rec.CreateKey(), hReq.SourceMEC)
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,177 @@
+package cgw
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestHandoverPeerURL(t *testing.T) {
+	hc, err := NewHandoverClient(HandoverSettings{
+		Enabled: true,
+		Peers:   map[string]string{"mec3.example.com:1883": "https://cgw.mec3.example.com"},
+	})
+	assert.NilError(t, err)
+	u, err := hc.peerURL("mec3.example.com:1883")
+	assert.NilError(t, err)
+	assert.Equal(t, u, "https://cgw.mec3.example.com/cgw/v1/handover")
+
+	// the next server comes from the caller, it's never turned into a peer
+	for _, server := range []string{"mec2.example.com", "mec3.example.com", "ssl://mec3.example.com:1883"} {
+		_, err = hc.peerURL(server)
+		assert.Equal(t, err, ErrUnknownPeer)
+	}
+
+	testTable := map[string]HandoverSettings{
+		"handover requires at least one peer": {Enabled: true},
+		"invalid peer url for mec2":           {Enabled: true, Peers: map[string]string{"mec2": "ftp://mec2"}},
+	}
+	for k, v := range testTable {
+		_, err = NewHandoverClient(v)
+		assert.ErrorContains(t, err, k)
+	}
+}
+
+func TestHandoverRoute(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target := NewMemoryStore()
+	cgw := gw
+	cgw.kv = target
+	updateSettings(&cgw, func(ls *liveSettings) {
+		ls.handlerTO = time.Second
+	})
+	var err error
+	cgw.handover, err = NewHandoverClient(HandoverSettings{
+		Enabled:   true,
+		Endpoint:  "mec/handover",
+		Peers:     map[string]string{"mec2:1883": "http://mec2"},
+		TokenFile: "./test/auth/tokenFile",
+	})
+	assert.NilError(t, err)
+	srv := httptest.NewServer(cgw.routes(ctx))
+	defer srv.Close()
+	cgw.handover.peers = map[string]string{"mec2:1883": srv.URL}
+
+	// handovers are accepted on the configured endpoint with the peer token
+	rec := EntityRecord{
+		EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+		ExpiresAt:  time.Now().Add(time.Hour).Unix(),
+	}
+	assert.NilError(t, cgw.handover.Push(ctx, "mec2:1883", rec, "test.test", "mec1"))
+	moved, err := getRecord(ctx, target, rec.CreateKey())
+	assert.NilError(t, err)
+	assert.Equal(t, moved.Token, "test.test")
+
+	for name, header := range map[string]string{
+		"missing_token": "",
+		"wrong_token":   "Bearer wrong.test",
+	} {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", srv.URL+"/mec/handover",
+				bytes.NewBufferString(`{"entity":"veh","entityID":"5678","token":"peer.test"}`))
+			assert.NilError(t, err)
+			if header != "" {
+				req.Header.Set("Authorization", header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			assert.NilError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, resp.StatusCode, http.StatusUnauthorized)
+			exists, err := target.Exists(ctx, "veh-5678")
+			assert.NilError(t, err)
+			assert.Assert(t, !exists)
+		})
+	}
+}
+
+func TestHandover(t *testing.T) {
+	target := NewMemoryStore()
+	peer := httptest.NewServer(jsonDecodeHandler(HandoverReq, handoverHandler(target, nil, func() string { return "mec2" }), nil))
+	defer peer.Close()
+	hc, err := NewHandoverClient(HandoverSettings{
+		Enabled:   true,
+		Peers:     map[string]string{"mec2:1883": peer.URL},
+		TokenFile: "./test/auth/tokenFile",
+	})
+	assert.NilError(t, err)
+
+	source := NewMemoryStore()
+	rd := &recordingDisconnecter{}
+	handler := disconnectHandler(rd, source, gw.settings().caas,
+		map[ReasonCode]bool{}, gw.GetMEC, gw.GetToken, hc, nil)
+	ctx := context.Background()
+	rec := EntityRecord{
+		EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+		Token:      "test.test",
+		ExpiresAt:  time.Now().Add(time.Hour).Unix(),
+		CreatedAt:  time.Now().Add(-time.Hour).Unix(),
+		MEC:        "mec1",
+	}
+	dr := &DisconnectRequest{
+		EntityPair: rec.EntityPair,
+		ReasonCode: Handover,
+		NextServer: "mec2:1883",
+	}
+
+	t.Run("success", func(t *testing.T) {
+		assert.NilError(t, setRecord(ctx, source, rec))
+		w := httptest.NewRecorder()
+		handler(w, createTestRequest(t, nil, dr))
+		assert.Equal(t, w.Code, http.StatusOK)
+
+		moved, err := getRecord(ctx, target, rec.CreateKey())
+		assert.NilError(t, err)
+		expected := rec
+		expected.MEC = "mec2"
+		assert.DeepEqual(t, moved, expected)
+		_, err = getRecord(ctx, source, rec.CreateKey())
+		assert.Equal(t, err, ErrKeyNotFound)
+		assert.Equal(t, len(rd.requests), 1)
+		assert.Equal(t, rd.requests[0].NextServer, "mec2:1883")
+	})
+
+	t.Run("fail_expired", func(t *testing.T) {
+		rd.requests = nil
+		expired := rec
+		expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+		assert.NilError(t, setRecord(ctx, source, expired))
+		w := httptest.NewRecorder()
+		handler(w, createTestRequest(t, nil, dr))
+		assert.Equal(t, w.Code, http.StatusBadGateway)
+
+		// the client stays where it is when the peer doesn't acknowledge
+		_, err := getRecord(ctx, source, rec.CreateKey())
+		assert.NilError(t, err)
+		assert.Equal(t, len(rd.requests), 0)
+	})
+
+	t.Run("fail_missing_next_server", func(t *testing.T) {
+		assert.NilError(t, setRecord(ctx, source, rec))
+		w := httptest.NewRecorder()
+		handler(w, createTestRequest(t, nil, &DisconnectRequest{
+			EntityPair: rec.EntityPair,
+			ReasonCode: Handover,
+		}))
+		assert.Equal(t, w.Code, http.StatusBadRequest)
+	})
+	t.Run("fail_unknown_next_server", func(t *testing.T) {
+		rd.requests = nil
+		assert.NilError(t, setRecord(ctx, source, rec))
+		w := httptest.NewRecorder()
+		handler(w, createTestRequest(t, nil, &DisconnectRequest{
+			EntityPair: rec.EntityPair,
+			ReasonCode: Handover,
+			NextServer: "attacker.example.com:1883",
+		}))
+		assert.Equal(t, w.Code, http.StatusBadRequest)
+		_, err := getRecord(ctx, source, rec.CreateKey())
+		assert.NilError(t, err)
+		assert.Equal(t, len(rd.requests), 0)
+	})
+}
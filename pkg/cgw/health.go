@@ -0,0 +1,187 @@
+package cgw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// paths the probes are served on
+const (
+	LivenessEndpoint  = "/healthz"
+	ReadinessEndpoint = "/readyz"
+)
+
+// default readiness check values
+const (
+	defaultHealthTimeout = 2 * time.Second
+	defaultCAASHealthURL = "/"
+)
+
+// HealthSettings represents settings for the readiness probe
+// Timeout and CacheTTL are in milliseconds, CacheTTL of 0 disables caching
+type HealthSettings struct {
+	CAASEndpoint string `yaml:"caasEndpoint"`
+	CheckMQTT    bool   `yaml:"checkMQTT"`
+	Timeout      int    `yaml:"timeout"`
+	CacheTTL     int    `yaml:"cacheTTL"`
+}
+
+// validate checks the health fields are consistent
+func (hs HealthSettings) validate() error {
+	if hs.Timeout < 0 || hs.CacheTTL < 0 {
+		return errors.New("timeout and cache ttl can't be negative")
+	}
+	return nil
+}
+
+// Pinger is implemented by dependencies that can check their connection
+type Pinger interface {
+	Ping(context.Context) error
+}
+
+// PingerFunc adapts a function to the Pinger interface
+type PingerFunc func(context.Context) error
+
+// Ping calls the function
+func (pf PingerFunc) Ping(ctx context.Context) error {
+	return pf(ctx)
+}
+
+// DependencyStatus is the result of checking one dependency
+type DependencyStatus struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ReadinessReport is the json returned by the readiness probe
+type ReadinessReport struct {
+	Status       string                      `json:"status"`
+	CheckedAt    time.Time                   `json:"checkedAt"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// readinessProbe checks dependencies and caches the results
+type readinessProbe struct {
+	checks   map[string]Pinger
+	timeout  time.Duration
+	cacheTTL time.Duration
+	mu       sync.Mutex
+	last     *ReadinessReport
+}
+
+// newReadinessProbe creates a probe for the checks with settings
+func newReadinessProbe(settings HealthSettings, checks map[string]Pinger) *readinessProbe {
+	rp := &readinessProbe{
+		checks:   checks,
+		timeout:  defaultHealthTimeout,
+		cacheTTL: time.Duration(settings.CacheTTL) * time.Millisecond,
+	}
+	if settings.Timeout > 0 {
+		rp.timeout = time.Duration(settings.Timeout) * time.Millisecond
+	}
+	return rp
+}
+
+// newCAASHealthPinger checks the health endpoint on the caas server, the caas
+// settings can be reloaded so the pinger is kept with the live settings
+func newCAASHealthPinger(caas CAASSettings, health HealthSettings) (Pinger, error) {
+	endpoint := health.CAASEndpoint
+	if IsEmpty(endpoint) {
+		endpoint = defaultCAASHealthURL
+	}
+	url, err := URLJoin(caas.Server, endpoint)
+	if err != nil {
+		ErrorLog("unable to join caas health url %s, %s", caas.Server, endpoint)
+		return nil, fmt.Errorf("unable to join caas health url, %s", err)
+	}
+	return caasPinger(url), nil
+}
+
+// caasPinger checks that caas answers requests on url
+func caasPinger(url string) Pinger {
+	return PingerFunc(func(ctx context.Context) error {
+		resp, err := HTTPRequest(ctx, "GET", url, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.status >= http.StatusInternalServerError {
+			return fmt.Errorf("caas returned status %d", resp.status)
+		}
+		return nil
+	})
+}
+
+// Report returns the cached report or checks all dependencies concurrently
+func (rp *readinessProbe) Report(ctx context.Context) ReadinessReport {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.last != nil && time.Since(rp.last.CheckedAt) < rp.cacheTTL {
+		return *rp.last
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rp.timeout)
+	defer cancel()
+	report := ReadinessReport{
+		Status:       "ok",
+		CheckedAt:    time.Now(),
+		Dependencies: map[string]DependencyStatus{},
+	}
+	var wg sync.WaitGroup
+	var resMu sync.Mutex
+	for name, check := range rp.checks {
+		wg.Add(1)
+		go func(name string, check Pinger) {
+			defer wg.Done()
+			start := time.Now()
+			err := check.Ping(ctx)
+			status := DependencyStatus{
+				Status:  "ok",
+				Latency: time.Since(start).String(),
+			}
+			if err != nil {
+				status.Status = "fail"
+				status.Error = err.Error()
+			}
+			resMu.Lock()
+			defer resMu.Unlock()
+			report.Dependencies[name] = status
+			if err != nil {
+				report.Status = "fail"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	rp.last = &report
+	return report
+}
+
+// livenessHandler reports the process is up
+func livenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}
+}
+
+// readinessHandler reports the status of every dependency
+// returns 200 if all dependencies are reachable
+// returns 503 otherwise
+func readinessHandler(rp *readinessProbe) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		report := rp.Report(req.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != "ok" {
+			ErrorLog("readiness check failed, %+v", report.Dependencies)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,83 @@
+package cgw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	caas := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer caas.Close()
+
+	t.Run("ready", func(t *testing.T) {
+		rp := newReadinessProbe(HealthSettings{}, map[string]Pinger{
+			"redis": NewMemoryStore(),
+			"caas":  caasPinger(caas.URL),
+		})
+		w := httptest.NewRecorder()
+		readinessHandler(rp)(w, createTestRequest(t, nil, nil))
+		assert.Equal(t, w.Code, http.StatusOK)
+		report := ReadinessReport{}
+		assert.NilError(t, json.NewDecoder(w.Body).Decode(&report))
+		assert.Equal(t, report.Status, "ok")
+		assert.Equal(t, report.Dependencies["redis"].Status, "ok")
+		assert.Equal(t, report.Dependencies["caas"].Status, "ok")
+	})
+
+	t.Run("not ready", func(t *testing.T) {
+		rp := newReadinessProbe(HealthSettings{}, map[string]Pinger{
+			"redis": NewMemoryStore(),
+			"mqtt": PingerFunc(func(context.Context) error {
+				return errors.New("connection refused")
+			}),
+		})
+		w := httptest.NewRecorder()
+		readinessHandler(rp)(w, createTestRequest(t, nil, nil))
+		assert.Equal(t, w.Code, http.StatusServiceUnavailable)
+		report := ReadinessReport{}
+		assert.NilError(t, json.NewDecoder(w.Body).Decode(&report))
+		assert.Equal(t, report.Status, "fail")
+		assert.Equal(t, report.Dependencies["redis"].Status, "ok")
+		assert.Equal(t, report.Dependencies["mqtt"].Error, "connection refused")
+	})
+
+	t.Run("caas unavailable", func(t *testing.T) {
+		down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer down.Close()
+		assert.Assert(t, caasPinger(down.URL).Ping(context.Background()) != nil)
+	})
+}
+
+func TestReadinessCache(t *testing.T) {
+	calls := 0
+	rp := newReadinessProbe(HealthSettings{CacheTTL: 60000}, map[string]Pinger{
+		"count": PingerFunc(func(context.Context) error {
+			calls++
+			return nil
+		}),
+	})
+	rp.Report(context.Background())
+	rp.Report(context.Background())
+	assert.Equal(t, calls, 1)
+
+	rp.last.CheckedAt = time.Now().Add(-time.Hour)
+	rp.Report(context.Background())
+	assert.Equal(t, calls, 2)
+}
+
+func TestLivenessHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	livenessHandler()(w, createTestRequest(t, nil, nil))
+	assert.Equal(t, w.Code, http.StatusOK)
+}
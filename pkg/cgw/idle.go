@@ -0,0 +1,171 @@
+package cgw
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// default interval between idle scans
+const defaultIdleScanInterval = 60 * time.Second
+
+// IdleSettings represents settings for disconnecting idle entities
+// Thresholds is how long (seconds) each entity type can go without validating or
+// refreshing before it's disconnected with Idle, entity types without a threshold never idle
+type IdleSettings struct {
+	Enabled      bool           `yaml:"enabled"`
+	Thresholds   map[string]int `yaml:"thresholds"`
+	ScanInterval int            `yaml:"scanInterval"`
+}
+
+// validate checks the idle fields are consistent
+func (is IdleSettings) validate() error {
+	if !is.Enabled {
+		return nil
+	}
+	if is.ScanInterval < 0 {
+		return fmt.Errorf("scan interval can't be negative, %d", is.ScanInterval)
+	}
+	for entity, threshold := range is.Thresholds {
+		if !IsValidEntity(entity) {
+			return fmt.Errorf("entity is not supported, %s", entity)
+		}
+		if threshold <= 0 {
+			return fmt.Errorf("threshold for %s must be positive, %d", entity, threshold)
+		}
+	}
+	return nil
+}
+
+// Interval returns how often the idle scanner runs
+func (is IdleSettings) Interval() time.Duration {
+	if is.ScanInterval <= 0 {
+		return defaultIdleScanInterval
+	}
+	return time.Duration(is.ScanInterval) * time.Second
+}
+
+// IdleTracker records the last activity of entities in the key value store
+type IdleTracker struct {
+	kv         KeyValueStore
+	thresholds map[string]time.Duration
+	interval   time.Duration
+}
+
+// NewIdleTracker creates an idle tracker
+func NewIdleTracker(settings IdleSettings, kv KeyValueStore) (*IdleTracker, error) {
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+	it := &IdleTracker{
+		kv:         kv,
+		thresholds: map[string]time.Duration{},
+		interval:   settings.Interval(),
+	}
+	for entity, threshold := range settings.Thresholds {
+		it.thresholds[strings.ToLower(entity)] = time.Duration(threshold) * time.Second
+	}
+	return it, nil
+}
+
+// activityKey is where the last activity of the entity pair is kept
+func activityKey(ep EntityPair) string {
+	return "active:" + ep.CreateKey()
+}
+
+// ttl keeps the activity around until a couple of scans after the entity goes idle
+func (it *IdleTracker) ttl(threshold time.Duration) time.Duration {
+	return threshold + 2*it.interval
+}
+
+// Touch records activity for the entity pair at time now
+func (it *IdleTracker) Touch(ctx context.Context, ep EntityPair, now time.Time) error {
+	threshold, ok := it.thresholds[strings.ToLower(ep.Entity)]
+	if !ok {
+		return nil
+	}
+	return it.kv.Set(ctx, activityKey(ep), strconv.FormatInt(now.Unix(), 10), it.ttl(threshold))
+}
+
+// Idle checks if the entity pair has been inactive past its threshold at time now,
+// entities without recorded activity are seen as active from now on
+func (it *IdleTracker) Idle(ctx context.Context, ep EntityPair, now time.Time) (bool, error) {
+	threshold, ok := it.thresholds[strings.ToLower(ep.Entity)]
+	if !ok {
+		return false, nil
+	}
+	val, err := it.kv.Get(ctx, activityKey(ep))
+	if err == ErrKeyNotFound {
+		return false, it.Touch(ctx, ep, now)
+	} else if err != nil {
+		return false, err
+	}
+	last, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("invalid activity for %s, %s", ep.CreateKey(), val)
+	}
+	return now.Sub(time.Unix(last, 0)) > threshold, nil
+}
+
+// touchActivity records activity for the request, failures only get logged
+func touchActivity(ctx context.Context, idle *IdleTracker, ep EntityPair) {
+	if idle == nil {
+		return
+	}
+	if err := idle.Touch(ctx, ep, time.Now()); err != nil {
+		ErrorLog("unable to record activity for %s, %s", ep.CreateKey(), err)
+	}
+}
+
+// sweepIdle periodically disconnects entities that stopped being active
+func (cgw *CAASGateway) sweepIdle(ctx context.Context) {
+	ticker := time.NewTicker(cgw.idle.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cgw.disconnectIdleEntities(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// disconnectIdleEntities goes through records of entity types with a threshold
+func (cgw *CAASGateway) disconnectIdleEntities(ctx context.Context) {
+	for entity := range cgw.idle.thresholds {
+		err := scanRecords(ctx, cgw.kv, entity, func(rec EntityRecord) {
+			idle, err := cgw.idle.Idle(ctx, rec.EntityPair, time.Now())
+			if err != nil {
+				ErrorLog("unable to check activity of %s, %s", rec.CreateKey(), err)
+				return
+			}
+			if !idle {
+				return
+			}
+			if err := cgw.disconnectIdleEntity(ctx, rec.EntityPair); err != nil {
+				ErrorLog("unable to disconnect idle %s, %s", rec.CreateKey(), err)
+			}
+		})
+		if err != nil {
+			ErrorLog("unable to scan %s records, %s", entity, err)
+		}
+	}
+}
+
+// disconnectIdleEntity disconnects the client with the idle reason code, caas
+// is only updated if idle is one of the upstream reason codes
+func (cgw *CAASGateway) disconnectIdleEntity(ctx context.Context, ep EntityPair) error {
+	// the entity might have been active since the scan
+	_, err := cgw.removeEntity(ctx, ep, Idle, func(ctx context.Context, rec EntityRecord) (bool, error) {
+		idle, err := cgw.idle.Idle(ctx, rec.EntityPair, time.Now())
+		if err != nil || !idle {
+			return false, err
+		}
+		DebugLog("entity is idle, %s", rec.CreateKey())
+		return true, nil
+	})
+	return err
+}
@@ -0,0 +1,142 @@
+package cgw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestIdleSettings(t *testing.T) {
+	testTable := map[string]IdleSettings{
+		"scan interval can't be negative": {Enabled: true, ScanInterval: -1},
+		"entity is not supported":         {Enabled: true, Thresholds: map[string]int{"asd": 60}},
+		"threshold for veh":               {Enabled: true, Thresholds: map[string]int{"veh": 0}},
+	}
+	for k, v := range testTable {
+		_, err := NewIdleTracker(v, nil)
+		assert.ErrorContains(t, err, k)
+	}
+	assert.Equal(t, IdleSettings{}.Interval(), defaultIdleScanInterval)
+	assert.Equal(t, IdleSettings{ScanInterval: 5}.Interval(), 5*time.Second)
+}
+
+func TestIdleTracker(t *testing.T) {
+	ctx := context.Background()
+	it, err := NewIdleTracker(IdleSettings{
+		Enabled:    true,
+		Thresholds: map[string]int{"veh": 60},
+	}, NewMemoryStore())
+	assert.NilError(t, err)
+	ep := EntityPair{Entity: "VEH", EntityID: "1234"}
+	now := time.Now()
+
+	// unseen entities start being tracked
+	idle, err := it.Idle(ctx, ep, now)
+	assert.NilError(t, err)
+	assert.Assert(t, !idle)
+	idle, err = it.Idle(ctx, ep, now.Add(61*time.Second))
+	assert.NilError(t, err)
+	assert.Assert(t, idle)
+
+	// activity resets the threshold
+	assert.NilError(t, it.Touch(ctx, ep, now.Add(30*time.Second)))
+	idle, err = it.Idle(ctx, ep, now.Add(61*time.Second))
+	assert.NilError(t, err)
+	assert.Assert(t, !idle)
+
+	// entity types without a threshold never idle
+	idle, err = it.Idle(ctx, EntityPair{Entity: "sw", EntityID: "1234"}, now.Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Assert(t, !idle)
+}
+
+func TestIdleActivityHandlers(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore()
+	it, err := NewIdleTracker(IdleSettings{
+		Enabled:    true,
+		Thresholds: map[string]int{"veh": 60},
+	}, ms)
+	assert.NilError(t, err)
+	etr := &EntityTokenRequest{
+		EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+		Token:      "test.test",
+	}
+	assert.NilError(t, setRecord(ctx, ms, EntityRecord{EntityPair: etr.EntityPair, Token: etr.Token}))
+
+	// failed validations aren't activity
+	w := httptest.NewRecorder()
+	validateTokenHandler(ms, nil, it)(w, createTestRequest(t, nil, &EntityTokenRequest{
+		EntityPair: etr.EntityPair,
+		Token:      "wrong.test",
+	}))
+	assert.Equal(t, w.Code, http.StatusForbidden)
+	_, err = ms.Get(ctx, activityKey(etr.EntityPair))
+	assert.Equal(t, err, ErrKeyNotFound)
+
+	w = httptest.NewRecorder()
+	validateTokenHandler(ms, nil, it)(w, createTestRequest(t, nil, etr))
+	assert.Equal(t, w.Code, http.StatusOK)
+	_, err = ms.Get(ctx, activityKey(etr.EntityPair))
+	assert.NilError(t, err)
+
+	assert.NilError(t, ms.Delete(ctx, activityKey(etr.EntityPair)))
+	w = httptest.NewRecorder()
+	refreshTokenHandler(ms, ExpirySettings{}, nil, it, RefreshSettings{}, nil)(w, createTestRequest(t, nil, &RefreshTokenRequest{
+		EntityTokenRequest: *etr,
+		OldToken:           etr.Token,
+	}))
+	assert.Equal(t, w.Code, http.StatusOK)
+	_, err = ms.Get(ctx, activityKey(etr.EntityPair))
+	assert.NilError(t, err)
+}
+
+func TestDisconnectIdleEntities(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore()
+	ds := &recordingDisconnecter{}
+	cgw := gw
+	cgw.kv = ms
+	cgw.disconnecter = ds
+	updateSettings(&cgw, func(ls *liveSettings) {
+		ls.handlerTO = time.Second
+		ls.upstreamReasonCodes = map[ReasonCode]bool{Idle: true}
+	})
+	var err error
+	cgw.idle, err = NewIdleTracker(IdleSettings{
+		Enabled:    true,
+		Thresholds: map[string]int{"veh": 60},
+	}, ms)
+	assert.NilError(t, err)
+
+	idle := EntityRecord{EntityPair: EntityPair{Entity: "veh", EntityID: "1234"}, Token: "test.test"}
+	active := EntityRecord{EntityPair: EntityPair{Entity: "veh", EntityID: "5678"}, Token: "test.test"}
+	unseen := EntityRecord{EntityPair: EntityPair{Entity: "veh", EntityID: "9012"}, Token: "test.test"}
+	untracked := EntityRecord{EntityPair: EntityPair{Entity: "sw", EntityID: "1234"}, Token: "test.test"}
+	for _, rec := range []EntityRecord{idle, active, unseen, untracked} {
+		assert.NilError(t, setRecord(ctx, ms, rec))
+	}
+	assert.NilError(t, cgw.idle.Touch(ctx, idle.EntityPair, time.Now().Add(-2*time.Minute)))
+	assert.NilError(t, cgw.idle.Touch(ctx, active.EntityPair, time.Now()))
+
+	cgw.disconnectIdleEntities(ctx)
+	assert.Equal(t, len(ds.requests), 1)
+	assert.Equal(t, ds.requests[0].ReasonCode, Idle)
+	assert.Equal(t, ds.requests[0].EntityPair, idle.EntityPair)
+	for _, key := range []string{"veh-1234", activityKey(idle.EntityPair)} {
+		_, err := ms.Get(ctx, key)
+		assert.Equal(t, err, ErrKeyNotFound)
+	}
+	for _, key := range []string{"veh-5678", "veh-9012", "sw-1234", activityKey(unseen.EntityPair)} {
+		_, err := ms.Get(ctx, key)
+		assert.NilError(t, err)
+	}
+
+	// idle is an upstream reason code so caas drops the mapping
+	val := sm.GetTail(1)
+	assert.Assert(t, val.query == "/caas/v1/token/entity/delete")
+}
@@ -0,0 +1,60 @@
+package cgw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// StoreType represents the backend used for key value storage
+type StoreType string
+
+// Different store types
+const (
+	RedisStoreType  StoreType = "redis"
+	MemoryStoreType StoreType = "memory"
+)
+
+// errors returned by all store implementations
+var (
+	ErrKeyNotFound     = errors.New("key not found")
+	ErrLockNotObtained = errors.New("lock not obtained")
+)
+
+// retry strategy used when obtaining locks
+const (
+	lockRetryBackoff = 100 * time.Millisecond
+	lockRetries      = 3
+)
+
+// KeyLock is a lock held on a key
+type KeyLock interface {
+	Release(context.Context) error
+}
+
+// KeyValueStore is interface all db will implement
+type KeyValueStore interface {
+	Get(context.Context, string) (string, error)
+	Set(context.Context, string, string, time.Duration) error
+	Exists(context.Context, string) (bool, error)
+	Delete(context.Context, string) error
+	Incr(context.Context, string, time.Duration) (int64, error)
+	Scan(context.Context, uint64, string, int64) ([]string, uint64, error)
+	Lock(context.Context, string, time.Duration) (KeyLock, error)
+	Flush(context.Context) error
+	Ping(context.Context) error
+	Close() error
+}
+
+// NewKeyValueStore creates the store specified in the config
+func NewKeyValueStore(storeType StoreType, settings RedisSettings) (KeyValueStore, error) {
+	switch storeType {
+	case RedisStoreType, "":
+		return NewRedisStore(settings)
+	case MemoryStoreType:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("store type is not supported, %s", storeType)
+	}
+}
@@ -0,0 +1,212 @@
+package cgw
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-process store, used for development and testing
+type MemoryStore struct {
+	mu    sync.Mutex
+	data  map[string]memEntry
+	locks map[string]memLockEntry
+}
+
+type memEntry struct {
+	value   string
+	expires time.Time
+}
+
+// expired checks if the entry has a ttl that lapsed
+func (me memEntry) expired(now time.Time) bool {
+	return !me.expires.IsZero() && !now.Before(me.expires)
+}
+
+type memLockEntry struct {
+	token   string
+	expires time.Time
+}
+
+// memLock is a lock obtained from a MemoryStore
+type memLock struct {
+	store *MemoryStore
+	key   string
+	token string
+}
+
+// NewMemoryStore creates a new MemoryStore instance
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data:  map[string]memEntry{},
+		locks: map[string]memLockEntry{},
+	}
+}
+
+// Get returns a string of the value stored
+func (ms *MemoryStore) Get(ctx context.Context, key string) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry, ok := ms.lookup(key)
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return entry.value, nil
+}
+
+// lookup returns the entry stored at key, dropping it if it expired, must hold mu
+func (ms *MemoryStore) lookup(key string) (memEntry, bool) {
+	entry, ok := ms.data[key]
+	if ok && entry.expired(time.Now()) {
+		delete(ms.data, key)
+		return memEntry{}, false
+	}
+	return entry, ok
+}
+
+// Set sets the value of the key to value, a zero ttl means the key never expires
+func (ms *MemoryStore) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry := memEntry{value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	ms.data[key] = entry
+	return nil
+}
+
+// Exists checks if the key is stored
+func (ms *MemoryStore) Exists(ctx context.Context, key string) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, ok := ms.lookup(key)
+	return ok, nil
+}
+
+// Delete removes the key
+func (ms *MemoryStore) Delete(ctx context.Context, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.data, key)
+	return nil
+}
+
+// Incr increments the counter at key and refreshes its ttl
+func (ms *MemoryStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var n int64
+	if entry, ok := ms.lookup(key); ok {
+		var err error
+		n, err = strconv.ParseInt(entry.value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("value is not an integer, %s", key)
+		}
+	}
+	n++
+	entry := memEntry{value: strconv.FormatInt(n, 10)}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	ms.data[key] = entry
+	return n, nil
+}
+
+// Scan iterates over keys matching the glob pattern in sorted order,
+// the cursor is the offset into the matching keys and 0 ends the iteration
+func (ms *MemoryStore) Scan(ctx context.Context, cursor uint64, match string, count int64) ([]string, uint64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	keys := []string{}
+	for key := range ms.data {
+		if _, ok := ms.lookup(key); !ok {
+			continue
+		}
+		if ok, err := path.Match(match, key); err != nil {
+			return nil, 0, err
+		} else if ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if cursor >= uint64(len(keys)) {
+		return []string{}, 0, nil
+	}
+	end := cursor + uint64(count)
+	if count <= 0 || end >= uint64(len(keys)) {
+		return keys[cursor:], 0, nil
+	}
+	return keys[cursor:end], end, nil
+}
+
+// Lock obtains a lock on key that expires after ttl
+func (ms *MemoryStore) Lock(ctx context.Context, key string, ttl time.Duration) (KeyLock, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b)
+	for attempt := 0; ; attempt++ {
+		if ms.tryLock(key, token, ttl) {
+			return &memLock{store: ms, key: key, token: token}, nil
+		}
+		if attempt >= lockRetries {
+			return nil, ErrLockNotObtained
+		}
+		// back off linearly like the redis lock does
+		select {
+		case <-time.After(lockRetryBackoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// tryLock takes the lock if it is free or expired
+func (ms *MemoryStore) tryLock(key string, token string, ttl time.Duration) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	if entry, ok := ms.locks[key]; ok && now.Before(entry.expires) {
+		return false
+	}
+	ms.locks[key] = memLockEntry{token: token, expires: now.Add(ttl)}
+	return true
+}
+
+// Release frees the lock if it's still held by this holder
+func (ml *memLock) Release(ctx context.Context) error {
+	ml.store.mu.Lock()
+	defer ml.store.mu.Unlock()
+	entry, ok := ml.store.locks[ml.key]
+	if !ok || entry.token != ml.token {
+		return ErrLockNotObtained
+	}
+	delete(ml.store.locks, ml.key)
+	return nil
+}
+
+// Flush gets rid of all the keys in store
+func (ms *MemoryStore) Flush(ctx context.Context) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.data = map[string]memEntry{}
+	return nil
+}
+
+// Ping always succeeds since the store is in process
+func (ms *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close the store
+func (ms *MemoryStore) Close() error {
+	return nil
+}
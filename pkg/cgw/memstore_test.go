@@ -0,0 +1,142 @@
+package cgw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore()
+
+	t.Run("get_set", func(t *testing.T) {
+		_, err := ms.Get(ctx, "veh-1234")
+		assert.Equal(t, err, ErrKeyNotFound)
+		assert.NilError(t, ms.Set(ctx, "veh-1234", "test.test", 0))
+		val, err := ms.Get(ctx, "veh-1234")
+		assert.NilError(t, err)
+		assert.Equal(t, val, "test.test")
+	})
+
+	t.Run("exists_delete", func(t *testing.T) {
+		exists, err := ms.Exists(ctx, "veh-1234")
+		assert.NilError(t, err)
+		assert.Assert(t, exists)
+		assert.NilError(t, ms.Delete(ctx, "veh-1234"))
+		exists, err = ms.Exists(ctx, "veh-1234")
+		assert.NilError(t, err)
+		assert.Assert(t, !exists)
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		assert.NilError(t, ms.Set(ctx, "veh-1234", "test.test", 0))
+		assert.NilError(t, ms.Flush(ctx))
+		_, err := ms.Get(ctx, "veh-1234")
+		assert.Equal(t, err, ErrKeyNotFound)
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		assert.NilError(t, ms.Set(ctx, "veh-1234", "test.test", 50*time.Millisecond))
+		exists, err := ms.Exists(ctx, "veh-1234")
+		assert.NilError(t, err)
+		assert.Assert(t, exists)
+		time.Sleep(60 * time.Millisecond)
+		_, err = ms.Get(ctx, "veh-1234")
+		assert.Equal(t, err, ErrKeyNotFound)
+	})
+
+	t.Run("incr", func(t *testing.T) {
+		defer ms.Flush(ctx)
+		for i := int64(1); i <= 3; i++ {
+			val, err := ms.Incr(ctx, "rate:veh-1234:1", time.Second)
+			assert.NilError(t, err)
+			assert.Equal(t, val, i)
+		}
+		assert.NilError(t, ms.Set(ctx, "veh-1234", "test.test", 0))
+		_, err := ms.Incr(ctx, "veh-1234", time.Second)
+		assert.ErrorContains(t, err, "not an integer")
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		for _, key := range []string{"veh-1", "veh-2", "veh-3", "sw-1", "lock:veh-1"} {
+			assert.NilError(t, ms.Set(ctx, key, "test.test", 0))
+		}
+		defer ms.Flush(ctx)
+		keys, cursor, err := ms.Scan(ctx, 0, "veh-*", 2)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, keys, []string{"veh-1", "veh-2"})
+		keys, cursor, err = ms.Scan(ctx, cursor, "veh-*", 2)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, keys, []string{"veh-3"})
+		assert.Equal(t, cursor, uint64(0))
+	})
+
+	t.Run("lock", func(t *testing.T) {
+		lock, err := ms.Lock(ctx, "lock:veh-1234", 5*time.Second)
+		assert.NilError(t, err)
+		_, err = ms.Lock(ctx, "lock:veh-1234", 5*time.Second)
+		assert.Equal(t, err, ErrLockNotObtained)
+
+		// other keys are not affected
+		other, err := ms.Lock(ctx, "lock:sw-1234", 5*time.Second)
+		assert.NilError(t, err)
+		assert.NilError(t, other.Release(ctx))
+
+		assert.NilError(t, lock.Release(ctx))
+		assert.Equal(t, lock.Release(ctx), ErrLockNotObtained)
+		lock, err = ms.Lock(ctx, "lock:veh-1234", 5*time.Second)
+		assert.NilError(t, err)
+		assert.NilError(t, lock.Release(ctx))
+	})
+
+	t.Run("lock_expires", func(t *testing.T) {
+		_, err := ms.Lock(ctx, "lock:veh-1234", 50*time.Millisecond)
+		assert.NilError(t, err)
+		lock, err := ms.Lock(ctx, "lock:veh-1234", 5*time.Second)
+		assert.NilError(t, err)
+		assert.NilError(t, lock.Release(ctx))
+	})
+}
+
+func TestMemoryStoreHandlers(t *testing.T) {
+	ms := NewMemoryStore()
+	etr := &EntityTokenRequest{
+		EntityPair: EntityPair{
+			Entity:   "veh",
+			EntityID: "1234",
+		},
+		Token: "test.test",
+	}
+
+	// refresh fails until the key exists
+	rtr := &RefreshTokenRequest{EntityTokenRequest: *etr, OldToken: "old.test"}
+	w := httptest.NewRecorder()
+	refreshTokenHandler(ms, ExpirySettings{}, nil, nil, RefreshSettings{}, nil)(w, createTestRequest(t, nil, rtr))
+	assert.Equal(t, w.Code, http.StatusNotFound)
+	assert.NilError(t, ms.Set(context.Background(), "veh-1234", "old.test", 0))
+	w = httptest.NewRecorder()
+	refreshTokenHandler(ms, ExpirySettings{}, nil, nil, RefreshSettings{}, nil)(w, createTestRequest(t, nil, rtr))
+	assert.Equal(t, w.Code, http.StatusOK)
+
+	// validate against the refreshed value
+	w = httptest.NewRecorder()
+	validateTokenHandler(ms, nil, nil)(w, createTestRequest(t, nil, etr))
+	assert.Equal(t, w.Code, http.StatusOK)
+
+	// lock handler rejects concurrent requests on the same entity
+	held, err := ms.Lock(context.Background(), "lock:veh-1234", 5*time.Second)
+	assert.NilError(t, err)
+	defer held.Release(context.Background())
+	called := false
+	w = httptest.NewRecorder()
+	redisLockHandler(ms, 5*time.Second, func(w http.ResponseWriter, req *http.Request) {
+		called = true
+	})(w, createTestRequest(t, nil, etr))
+	assert.Assert(t, !called)
+	assert.Equal(t, w.Code, http.StatusUnprocessableEntity)
+}
@@ -0,0 +1,146 @@
+package cgw
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// default path metrics are served on
+const defaultMetricsEndpoint = "/metrics"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cgw_http_requests_total",
+		Help: "Number of requests handled by route and status code.",
+	}, []string{"route", "code"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cgw_http_request_duration_seconds",
+		Help:    "Latency of requests handled by route and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "code"})
+	caasDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cgw_caas_request_duration_seconds",
+		Help:    "Latency of requests made to caas by operation and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "code"})
+	caasBreakerState = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cgw_caas_breaker_state",
+		Help: "State of the caas circuit breaker, 0 is closed, 1 is half-open and 2 is open.",
+	})
+	caasRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cgw_caas_rejected_total",
+		Help: "Number of caas requests failed fast by the circuit breaker by operation.",
+	}, []string{"operation"})
+	redisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cgw_redis_command_duration_seconds",
+		Help:    "Latency of redis commands.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command"})
+	redisErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cgw_redis_command_errors_total",
+		Help: "Number of redis commands that failed.",
+	}, []string{"command"})
+	lockFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cgw_lock_failures_total",
+		Help: "Number of requests rejected because the entity lock couldn't be obtained.",
+	})
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cgw_rate_limited_total",
+		Help: "Number of requests rejected by the rate limiter by route and entity type.",
+	}, []string{"route", "entity"})
+	disconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cgw_disconnects_total",
+		Help: "Number of client disconnects by reason code and outcome.",
+	}, []string{"reason_code", "outcome"})
+)
+
+// metricsHandler serves the metrics registered with the default registry
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// instrumentHandler records request counts and latency for route
+func instrumentHandler(route string, next http.Handler) http.Handler {
+	labels := prometheus.Labels{"route": route}
+	return promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(httpDuration.MustCurryWith(labels), next))
+}
+
+// observeCAAS records the latency and outcome of a caas request
+func observeCAAS(operation string, start time.Time, resp HTTPResponse, err error) {
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.status)
+	}
+	caasDuration.WithLabelValues(operation, code).Observe(time.Since(start).Seconds())
+}
+
+// metricsDisconnecter counts the outcome of every disconnect
+type metricsDisconnecter struct {
+	Disconnecter
+}
+
+// Disconnect calls the wrapped disconnecter and records the outcome
+func (md metricsDisconnecter) Disconnect(ctx context.Context, req DisconnectRequest) error {
+	err := md.Disconnecter.Disconnect(ctx, req)
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	disconnects.WithLabelValues(fmt.Sprintf("0x%X", byte(req.ReasonCode)), outcome).Inc()
+	return err
+}
+
+// DisconnectBrokers calls the wrapped disconnecter and records the outcome
+func (md metricsDisconnecter) DisconnectBrokers(ctx context.Context, req DisconnectRequest) ([]BrokerResult, error) {
+	results, err := disconnectBrokers(ctx, md.Disconnecter, req)
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	disconnects.WithLabelValues(fmt.Sprintf("0x%X", byte(req.ReasonCode)), outcome).Inc()
+	return results, err
+}
+
+type redisStartKey struct{}
+
+// redisMetricsHook records latency and errors of redis commands
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisMetricsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	observeRedis(ctx, cmd.Name(), cmd.Err())
+	return nil
+}
+
+func (redisMetricsHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisMetricsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		observeRedis(ctx, cmd.Name(), cmd.Err())
+	}
+	return nil
+}
+
+// observeRedis records a redis command, a missing key is not an error
+func observeRedis(ctx context.Context, command string, err error) {
+	if start, ok := ctx.Value(redisStartKey{}).(time.Time); ok {
+		redisDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+	}
+	if err != nil && err != redis.Nil {
+		redisErrors.WithLabelValues(command).Inc()
+	}
+}
@@ -0,0 +1,57 @@
+package cgw
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+func TestInstrumentHandler(t *testing.T) {
+	handler := instrumentHandler("/test/route", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	}))
+	before := testutil.ToFloat64(httpRequests.WithLabelValues("/test/route", "409"))
+	handler.ServeHTTP(httptest.NewRecorder(), createTestRequest(t, nil, nil))
+	assert.Equal(t, testutil.ToFloat64(httpRequests.WithLabelValues("/test/route", "409")), before+1)
+}
+
+func TestMetricsDisconnecter(t *testing.T) {
+	md := metricsDisconnecter{&dsMock{}}
+	success := disconnects.WithLabelValues("0x8C", "success")
+	failure := disconnects.WithLabelValues("0x96", "failure")
+	beforeSuccess, beforeFailure := testutil.ToFloat64(success), testutil.ToFloat64(failure)
+	assert.NilError(t, md.Disconnect(context.Background(), DisconnectRequest{ReasonCode: Reauthenticate}))
+	assert.Assert(t, md.Disconnect(context.Background(), DisconnectRequest{ReasonCode: RateTooHigh}) != nil)
+	assert.Equal(t, testutil.ToFloat64(success), beforeSuccess+1)
+	assert.Equal(t, testutil.ToFloat64(failure), beforeFailure+1)
+}
+
+func TestObserveRedis(t *testing.T) {
+	ctx := context.WithValue(context.Background(), redisStartKey{}, time.Now())
+	before := testutil.ToFloat64(redisErrors.WithLabelValues("get"))
+	observeRedis(ctx, "get", redis.Nil)
+	assert.Equal(t, testutil.ToFloat64(redisErrors.WithLabelValues("get")), before)
+	observeRedis(ctx, "get", errors.New("connection refused"))
+	assert.Equal(t, testutil.ToFloat64(redisErrors.WithLabelValues("get")), before+1)
+}
+
+func TestLockFailureMetric(t *testing.T) {
+	ms := NewMemoryStore()
+	held, err := ms.Lock(context.Background(), "lock:veh-1234", 5*time.Second)
+	assert.NilError(t, err)
+	defer held.Release(context.Background())
+	before := testutil.ToFloat64(lockFailures)
+	req := createTestRequest(t, nil, &EntityTokenRequest{
+		EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+		Token:      "test.test",
+	})
+	redisLockHandler(ms, time.Second, func(w http.ResponseWriter, req *http.Request) {})(httptest.NewRecorder(), req)
+	assert.Equal(t, testutil.ToFloat64(lockFailures), before+1)
+}
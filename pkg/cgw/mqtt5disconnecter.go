@@ -0,0 +1,273 @@
+package cgw
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// default topic the broker admin plugin listens on for disconnect requests
+const defaultMQTTv5AdminTopic = "$CONTROL/cgw/v1/disconnect"
+
+// sessions only live for a single request, so keepalive pings are never due
+const mqttv5KeepAlive = 30
+
+// sessionCount keeps client ids unique when sessions start in the same nanosecond
+var sessionCount uint64
+
+// newSessionID creates a client id no other session of the gateway is using
+func newSessionID(prefix string) string {
+	return fmt.Sprintf("%s-%d-%d", prefix, time.Now().UnixNano(), atomic.AddUint64(&sessionCount, 1))
+}
+
+// MQTTv5Settings represents settings for the mqtt 5 disconnecter
+// AdminTopic is the topic the broker admin plugin takes disconnect requests on.
+// The mqtt5 disconnecter is not standalone, stock mosquitto and emqx don't answer
+// on the admin topic, so it only works with a broker running the admin plugin
+// described on MQTTv5Disconnecter
+type MQTTv5Settings struct {
+	AdminTopic string `yaml:"adminTopic"`
+}
+
+// MQTTv5DisconnectCommand is the payload published to the admin topic,
+// the broker sends a DISCONNECT to ClientID with ReasonCode and ServerReference
+type MQTTv5DisconnectCommand struct {
+	ClientID        string     `json:"clientId"`
+	ReasonCode      ReasonCode `json:"reasonCode"`
+	ServerReference string     `json:"serverReference,omitempty"`
+}
+
+// MQTTv5DisconnectResult is the payload the broker responds with,
+// a ReasonCode of 0 means the client was disconnected
+type MQTTv5DisconnectResult struct {
+	ReasonCode   byte   `json:"reasonCode"`
+	ReasonString string `json:"reasonString,omitempty"`
+}
+
+// mqttv5Session opens short lived mqtt 5 sessions with the admin credentials
+type mqttv5Session struct {
+	server   *url.URL
+	username string
+	password string
+}
+
+// newMQTTv5Session resolves the broker address and credentials in settings
+func newMQTTv5Session(settings MQTTSettings, token string) (mqttv5Session, error) {
+	server, err := parseBrokerURL(settings.Server)
+	if err != nil {
+		ErrorLog("unable to parse mqtt server %s", settings.Server)
+		return mqttv5Session{}, fmt.Errorf("unable to parse mqtt server, %s", err)
+	}
+	mAuth, err := mqttCredentials(settings, token)
+	if err != nil {
+		return mqttv5Session{}, err
+	}
+	return mqttv5Session{
+		server:   server,
+		username: mAuth.user,
+		password: mAuth.password,
+	}, nil
+}
+
+// MQTTv5Disconnecter disconnects clients using the mqtt 5 request/response pattern.
+// Brokers can't be told to disconnect a client through mqtt itself, so this depends
+// on an admin plugin running in the broker, mosquitto and emqx don't ship one.
+// The plugin has to:
+//   - subscribe to the admin topic, only the gateway credentials should be allowed to publish to it
+//   - decode the json MQTTv5DisconnectCommand in the request
+//   - send a DISCONNECT to ClientID with ReasonCode, and ServerReference if it's set
+//   - publish a json MQTTv5DisconnectResult to the ResponseTopic of the request,
+//     copying its CorrelationData, with reason code 0 once the client is gone
+//
+// Use the dynsec disconnecter for stock mosquitto or the rest disconnecter for emqx,
+// they only support the reason codes the broker picks.
+type MQTTv5Disconnecter struct {
+	mqttv5Session
+	adminTopic string
+}
+
+// NewMQTTv5Disconnecter creates a new mqtt 5 disconnecter
+func NewMQTTv5Disconnecter(settings MQTTSettings, token string) (Disconnecter, error) {
+	session, err := newMQTTv5Session(settings, token)
+	if err != nil {
+		return nil, err
+	}
+	handler := &MQTTv5Disconnecter{
+		mqttv5Session: session,
+		adminTopic:    settings.V5.AdminTopic,
+	}
+	if IsEmpty(handler.adminTopic) {
+		handler.adminTopic = defaultMQTTv5AdminTopic
+	}
+	return handler, nil
+}
+
+// parseBrokerURL accepts "host:port" or "scheme://host:port" broker addresses
+func parseBrokerURL(server string) (*url.URL, error) {
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		u, err = url.Parse("tcp://" + server)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts":
+	default:
+		return nil, fmt.Errorf("scheme is not supported, %s", u.Scheme)
+	}
+	return u, nil
+}
+
+// dial opens the network connection to the broker
+func (session mqttv5Session) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	switch session.server.Scheme {
+	case "ssl", "tls", "mqtts":
+		conn, err := dialer.DialContext(ctx, "tcp", session.server.Host)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: session.server.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	default:
+		return dialer.DialContext(ctx, "tcp", session.server.Host)
+	}
+}
+
+// connect creates a new mqtt 5 session with the admin credentials
+func (session mqttv5Session) connect(ctx context.Context, clientID string, router paho.Router) (*paho.Client, error) {
+	conn, err := session.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := paho.NewClient(paho.ClientConfig{
+		Conn:        conn,
+		Router:      router,
+		PingHandler: &idlePinger{stop: make(chan struct{})},
+	})
+	connect := &paho.Connect{
+		ClientID:     clientID,
+		KeepAlive:    mqttv5KeepAlive,
+		CleanStart:   true,
+		Username:     session.username,
+		UsernameFlag: !IsEmpty(session.username),
+		Password:     []byte(session.password),
+		PasswordFlag: !IsEmpty(session.password),
+	}
+	if _, err := client.Connect(ctx, connect); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Disconnect asks the broker to send a DISCONNECT with the reason code to the client
+func (handler *MQTTv5Disconnecter) Disconnect(ctx context.Context, req DisconnectRequest) error {
+	clientID := newSessionID("cgw")
+	responseTopic := clientID + "/responses"
+	correlationData := []byte(HyphenConcat(req.Entity, req.EntityID))
+
+	// responses are routed to the session that made the request
+	results := make(chan *paho.Publish, 1)
+	router := paho.NewSingleHandlerRouter(func(pb *paho.Publish) {
+		if pb.Properties == nil || string(pb.Properties.CorrelationData) != string(correlationData) {
+			return
+		}
+		select {
+		case results <- pb:
+		default:
+		}
+	})
+	client, err := handler.connect(ctx, clientID, router)
+	if err != nil {
+		return fmt.Errorf("unable to connect to mqtt broker, %s", err)
+	}
+	defer client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+
+	_, err = client.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{
+			responseTopic: {QoS: 1},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to %s, %s", responseTopic, err)
+	}
+
+	payload, err := json.Marshal(MQTTv5DisconnectCommand{
+		ClientID:        HyphenConcat(req.Entity, req.EntityID),
+		ReasonCode:      req.ReasonCode,
+		ServerReference: req.NextServer,
+	})
+	if err != nil {
+		return err
+	}
+	DebugLog("requesting disconnect on %s, %s", handler.adminTopic, string(payload))
+	_, err = client.Publish(ctx, &paho.Publish{
+		QoS:     1,
+		Topic:   handler.adminTopic,
+		Payload: payload,
+		Properties: &paho.PublishProperties{
+			ContentType:     "application/json",
+			ResponseTopic:   responseTopic,
+			CorrelationData: correlationData,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to publish disconnect request, %s", err)
+	}
+
+	select {
+	case pb := <-results:
+		result := MQTTv5DisconnectResult{}
+		if err := json.Unmarshal(pb.Payload, &result); err != nil {
+			return fmt.Errorf("MQTT response was invalid, %s", err)
+		}
+		if result.ReasonCode != 0 {
+			return fmt.Errorf("broker refused disconnect, 0x%X %s", result.ReasonCode, result.ReasonString)
+		}
+		return nil
+	case <-ctx.Done():
+		return errors.New("timeout occured")
+	}
+}
+
+// Ping checks that the broker accepts mqtt 5 sessions with the configured credentials
+func (session mqttv5Session) Ping(ctx context.Context) error {
+	client, err := session.connect(ctx, newSessionID("cgw-health"), nil)
+	if err != nil {
+		return err
+	}
+	return client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+}
+
+// idlePinger never sends pings, the default pinger can miss a Stop issued right
+// after Connect and hold Disconnect until its first tick
+type idlePinger struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (ip *idlePinger) Start(net.Conn, time.Duration) {
+	<-ip.stop
+}
+
+func (ip *idlePinger) Stop() {
+	ip.stopOnce.Do(func() { close(ip.stop) })
+}
+
+func (ip *idlePinger) PingResp() {}
+
+func (ip *idlePinger) SetDebug(paho.Logger) {}
@@ -0,0 +1,165 @@
+package cgw
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"gotest.tools/assert"
+)
+
+// fakeBroker accepts mqtt 5 sessions from user and answers publishes with respond
+func fakeBroker(t *testing.T, respond func(*packets.Publish) *packets.ControlPacket) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeConn(conn, respond)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveFakeConn(conn net.Conn, respond func(*packets.Publish) *packets.ControlPacket) {
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.Content.(type) {
+		case *packets.Connect:
+			ack := packets.NewControlPacket(packets.CONNACK)
+			if p.Username != "user" {
+				ack.Content.(*packets.Connack).ReasonCode = 0x86
+			}
+			ack.WriteTo(conn)
+		case *packets.Subscribe:
+			ack := packets.NewControlPacket(packets.SUBACK)
+			ack.Content.(*packets.Suback).PacketID = p.PacketID
+			ack.Content.(*packets.Suback).Reasons = []byte{1}
+			ack.WriteTo(conn)
+		case *packets.Publish:
+			ack := packets.NewControlPacket(packets.PUBACK)
+			ack.Content.(*packets.Puback).PacketID = p.PacketID
+			ack.WriteTo(conn)
+			if resp := respond(p); resp != nil {
+				resp.WriteTo(conn)
+			}
+		case *packets.Pingreq:
+			packets.NewControlPacket(packets.PINGRESP).WriteTo(conn)
+		case *packets.Disconnect:
+			return
+		}
+	}
+}
+
+// fakeAdminBroker answers disconnect requests on the admin topic with result
+func fakeAdminBroker(t *testing.T, result MQTTv5DisconnectResult, commands chan<- MQTTv5DisconnectCommand) string {
+	return fakeBroker(t, func(p *packets.Publish) *packets.ControlPacket {
+		cmd := MQTTv5DisconnectCommand{}
+		json.Unmarshal(p.Payload, &cmd)
+		commands <- cmd
+		payload, _ := json.Marshal(result)
+		resp := packets.NewControlPacket(packets.PUBLISH)
+		resp.Content.(*packets.Publish).Topic = p.Properties.ResponseTopic
+		resp.Content.(*packets.Publish).Payload = payload
+		resp.Content.(*packets.Publish).Properties.CorrelationData = p.Properties.CorrelationData
+		return resp
+	})
+}
+
+func newTestMQTTv5Disconnecter(t *testing.T, server string) Disconnecter {
+	ds, err := NewDisconnecter(MQTTv5DisconnecterType, MQTTSettings{
+		Server:   server,
+		AuthType: FileBased,
+		AuthFile: "./test/auth/authFile",
+	}, "")
+	assert.NilError(t, err)
+	return ds
+}
+
+func TestMQTTv5Disconnect(t *testing.T) {
+	commands := make(chan MQTTv5DisconnectCommand, 1)
+	server := fakeAdminBroker(t, MQTTv5DisconnectResult{}, commands)
+	ds := newTestMQTTv5Disconnecter(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := ds.Disconnect(ctx, DisconnectRequest{
+		EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+		ReasonCode: Handover,
+		NextServer: "mec2.example.com",
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, <-commands, MQTTv5DisconnectCommand{
+		ClientID:        "veh-1234",
+		ReasonCode:      Handover,
+		ServerReference: "mec2.example.com",
+	})
+	assert.NilError(t, ds.(Pinger).Ping(ctx))
+}
+
+func TestMQTTv5DisconnectRefused(t *testing.T) {
+	commands := make(chan MQTTv5DisconnectCommand, 1)
+	server := fakeAdminBroker(t, MQTTv5DisconnectResult{
+		ReasonCode:   0x80,
+		ReasonString: "client not connected",
+	}, commands)
+	ds := newTestMQTTv5Disconnecter(t, "tcp://"+server)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := ds.Disconnect(ctx, DisconnectRequest{
+		EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+		ReasonCode: Reauthenticate,
+	})
+	assert.ErrorContains(t, err, "client not connected")
+	assert.DeepEqual(t, <-commands, MQTTv5DisconnectCommand{
+		ClientID:   "veh-1234",
+		ReasonCode: Reauthenticate,
+	})
+}
+
+func TestParseBrokerURL(t *testing.T) {
+	u, err := parseBrokerURL("localhost:1883")
+	assert.NilError(t, err)
+	assert.Equal(t, u.Scheme, "tcp")
+	assert.Equal(t, u.Host, "localhost:1883")
+	u, err = parseBrokerURL("ssl://broker:8883")
+	assert.NilError(t, err)
+	assert.Equal(t, u.Scheme, "ssl")
+	_, err = parseBrokerURL("ws://broker:80")
+	assert.ErrorContains(t, err, "not supported")
+}
+
+func TestMQTTv5DialTimeout(t *testing.T) {
+	// the broker accepts the connection but never finishes the tls handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+	server, err := parseBrokerURL("ssl://" + ln.Addr().String())
+	assert.NilError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = mqttv5Session{server: server}.dial(ctx)
+	assert.Assert(t, err != nil)
+	assert.Assert(t, time.Since(start) < time.Second)
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
@@ -14,39 +15,85 @@ type Disconnecter interface {
 	Disconnect(context.Context, DisconnectRequest) error
 }
 
-// MQTTDisconnecter is the handler used to connect to MQTT services
+// MQTTDisconnecter is the handler used to connect to MQTT services,
+// ConnOpts are shared by concurrent calls so they're never changed after creation
 type MQTTDisconnecter struct {
 	SuccessCode byte
 	ConnOpts    *mqtt.ClientOptions
 }
 
-// NewMQTTDisconnecter creates a new disconnector
-func NewMQTTDisconnecter(settings MQTTSettings, token string) (Disconnecter, error) {
+// DisconnecterType represents the mechanism used to disconnect clients
+type DisconnecterType string
+
+// Different disconnecter types
+const (
+	// ConnectDisconnecterType uses a crafted CONNECT understood by the broker plugin
+	ConnectDisconnecterType DisconnecterType = "connect"
+	// MQTTv5DisconnecterType asks the broker over MQTT 5 request/response,
+	// it is not standalone and needs the admin plugin in the broker
+	MQTTv5DisconnecterType DisconnecterType = "mqtt5"
+	// DynSecDisconnecterType uses the mosquitto dynamic security plugin
+	DynSecDisconnecterType DisconnecterType = "dynsec"
+	// RESTDisconnecterType kicks clients through the broker management api
+	RESTDisconnecterType DisconnecterType = "rest"
+)
+
+// NewDisconnecter creates a disconnecter of type kind,
+// settings with a broker list fan out to every broker
+func NewDisconnecter(kind DisconnecterType, settings MQTTSettings, token string) (Disconnecter, error) {
+	if len(settings.Brokers) > 0 {
+		return NewFanOutDisconnecter(kind, settings, token)
+	}
+	switch kind {
+	case ConnectDisconnecterType, "":
+		return NewMQTTDisconnecter(settings, token)
+	case MQTTv5DisconnecterType:
+		return NewMQTTv5Disconnecter(settings, token)
+	case DynSecDisconnecterType:
+		return NewDynSecDisconnecter(settings, token)
+	case RESTDisconnecterType:
+		return NewRESTDisconnecter(settings)
+	default:
+		return nil, fmt.Errorf("disconnecter type is not supported, %s", kind)
+	}
+}
+
+// mqttCredentials gets username/password based on credential type
+func mqttCredentials(settings MQTTSettings, token string) (UserPassword, error) {
 	var err error
 	mAuth := UserPassword{}
-	// get username/password based on crednetial type
 	if settings.AuthType == CRSBased {
 		url, err := URLJoin(settings.CRS.Server, settings.CRS.RegistrationEndpoint)
 		if err != nil {
 			ErrorLog("unable to join crs registration %s, %s",
 				settings.CRS.Server, settings.CRS.RegistrationEndpoint)
-			return nil, fmt.Errorf("unable to join crs registration url, %s", err)
+			return UserPassword{}, fmt.Errorf("unable to join crs registration url, %s", err)
 		}
 		mAuth, err = CRSCredentials(url, settings.CRS.Entity, token, settings.CRS.CfgPath)
 		if err != nil {
-			return nil, err
+			return UserPassword{}, err
 		}
 	} else if settings.AuthType == FileBased {
 		mAuth, err = FileCredentials(settings.AuthFile)
 		if err != nil {
-			return nil, err
+			return UserPassword{}, err
 		}
 	}
+	return mAuth, nil
+}
+
+// NewMQTTDisconnecter creates a new disconnector
+func NewMQTTDisconnecter(settings MQTTSettings, token string) (Disconnecter, error) {
+	mAuth, err := mqttCredentials(settings, token)
+	if err != nil {
+		return nil, err
+	}
 	DebugLog("got %+v", mAuth)
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(settings.Server)
 	opts.SetUsername(mAuth.user)
 	opts.SetPassword(mAuth.password)
+	opts.SetCleanSession(true)
 	return &MQTTDisconnecter{
 		SuccessCode: settings.SuccessCode,
 		ConnOpts:    opts,
@@ -75,33 +122,72 @@ func (handler *MQTTDisconnecter) Disconnect(ctx context.Context, req DisconnectR
 		return fmt.Errorf("error building client ID %s", err)
 	}
 	DebugLog("clientId created, %s", clientID)
-	handler.ConnOpts.SetClientID(clientID)
-	handler.ConnOpts.SetCleanSession(true)
 
-	// create client
-	client := mqtt.NewClient(handler.ConnOpts)
+	// create client, the client id is set on a copy since disconnects run concurrently
+	opts := *handler.ConnOpts
+	opts.SetClientID(clientID)
+	client := mqtt.NewClient(&opts)
+	token, err := waitConnect(ctx, client)
+	if err != nil {
+		return err
+	}
+	if token.Error() != nil {
+		cToken, ok := token.(*mqtt.ConnectToken)
+		if !ok {
+			return fmt.Errorf("MQTT response was invalid")
+		}
+		if cToken.ReturnCode() == handler.SuccessCode {
+			return nil
+		}
+		return fmt.Errorf("Unexpected error while trying to connect to mqtt %s, %d", token.Error().Error(), cToken.ReturnCode())
+	}
+	// connection is created, should really never get here
+	client.Disconnect(0)
+	return fmt.Errorf("Unexpected state reached")
+}
+
+// waitConnect connects client and waits for the result until ctx is done, a connect
+// that finishes after ctx is done is disconnected in the background so the client
+// and its goroutines aren't left behind
+func waitConnect(ctx context.Context, client mqtt.Client) (mqtt.Token, error) {
 	token := client.Connect()
 	mqttDone := make(chan struct{})
 	go func() {
 		token.Wait()
-		mqttDone <- struct{}{}
+		close(mqttDone)
 	}()
 	select {
 	case <-mqttDone:
-		if token.Error() != nil {
-			cToken, ok := token.(*mqtt.ConnectToken)
-			if !ok {
-				return fmt.Errorf("MQTT response was invalid")
-			}
-			if cToken.ReturnCode() == handler.SuccessCode {
-				return nil
-			}
-			return fmt.Errorf("Unexpected error while trying to connect to mqtt %s, %d", token.Error().Error(), cToken.ReturnCode())
-		}
-		// connection is created, should really never get here
-		client.Disconnect(0)
-		return fmt.Errorf("Unexpected state reached")
+		return token, nil
 	case <-ctx.Done():
-		return errors.New("timeout occured")
+		go func() {
+			<-mqttDone
+			if client.IsConnected() {
+				client.Disconnect(0)
+			}
+		}()
+		return nil, errors.New("timeout occured")
+	}
+}
+
+// Ping checks that the broker accepts connections with the configured credentials
+func (handler *MQTTDisconnecter) Ping(ctx context.Context) error {
+	// the shared options are never changed, so the probe's settings go on a copy
+	opts := *handler.ConnOpts
+	opts.SetClientID(HyphenConcat("cgw-health", fmt.Sprintf("%d", time.Now().UnixNano())))
+	opts.SetAutoReconnect(false)
+	// give up on the connect along with the probe
+	if deadline, ok := ctx.Deadline(); ok {
+		opts.SetConnectTimeout(time.Until(deadline))
+	}
+	client := mqtt.NewClient(&opts)
+	token, err := waitConnect(ctx, client)
+	if err != nil {
+		return err
+	}
+	if token.Error() != nil {
+		return token.Error()
 	}
+	client.Disconnect(0)
+	return nil
 }
@@ -1,8 +1,13 @@
 package cgw
 
 import (
+	"context"
+	"net"
 	"testing"
+	"time"
 
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 	"gotest.tools/assert"
 )
 
@@ -125,3 +130,123 @@ func TestNewMQTTDisconnector(t *testing.T) {
 		assert.Equal(t, mDS.ConnOpts.Servers[0].Host, "localhost:1883")
 	}
 }
+
+// slowConnectToken finishes when done is closed
+type slowConnectToken struct {
+	done chan struct{}
+}
+
+func (st slowConnectToken) Wait() bool {
+	<-st.done
+	return true
+}
+
+func (st slowConnectToken) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-st.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (st slowConnectToken) Error() error {
+	return nil
+}
+
+// slowConnectClient connects once its token is done
+type slowConnectClient struct {
+	mqtt.Client
+	token        slowConnectToken
+	disconnected chan struct{}
+}
+
+func (sc *slowConnectClient) Connect() mqtt.Token {
+	return sc.token
+}
+
+func (sc *slowConnectClient) IsConnected() bool {
+	select {
+	case <-sc.token.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sc *slowConnectClient) Disconnect(quiesce uint) {
+	close(sc.disconnected)
+}
+
+func TestWaitConnect(t *testing.T) {
+	client := &slowConnectClient{
+		token:        slowConnectToken{done: make(chan struct{})},
+		disconnected: make(chan struct{}),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := waitConnect(ctx, client)
+	assert.ErrorContains(t, err, "timeout occured")
+
+	// the connect finishing late is cleaned up
+	close(client.token.done)
+	select {
+	case <-client.disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("client wasn't disconnected after the timeout")
+	}
+}
+
+// fakeConnectBroker refuses every mqtt 3 connect with returnCode and sends the client ids to ids
+func fakeConnectBroker(t *testing.T, returnCode byte, ids chan<- string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				cp, err := packets.ReadPacket(conn)
+				if err != nil {
+					return
+				}
+				if connect, ok := cp.(*packets.ConnectPacket); ok {
+					ids <- connect.ClientIdentifier
+				}
+				ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+				ack.ReturnCode = returnCode
+				ack.Write(conn)
+			}()
+		}
+	}()
+	return "tcp://" + ln.Addr().String()
+}
+
+// run with -race, probes and disconnects share the connect options
+func TestPingWhileDisconnecting(t *testing.T) {
+	ids := make(chan string, 16)
+	ds, err := NewMQTTDisconnecter(MQTTSettings{
+		Server:      fakeConnectBroker(t, 0x03, ids),
+		SuccessCode: 0x03,
+	}, "")
+	assert.NilError(t, err)
+	handler := ds.(*MQTTDisconnecter)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- handler.Disconnect(ctx, DisconnectRequest{
+			EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+			ReasonCode: Reauthenticate,
+		})
+	}()
+	// the broker refuses every connect so the probe fails
+	assert.Assert(t, handler.Ping(ctx) != nil)
+	assert.NilError(t, <-done)
+	assert.Equal(t, handler.ConnOpts.ClientID, "")
+}
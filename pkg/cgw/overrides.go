@@ -0,0 +1,256 @@
+package cgw
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config values are read in order, later sources take precedence:
+//  1. the config file
+//  2. CGW_ environment variables, e.g. CGW_MQTT_CRS_SERVER sets mqtt.crs.server
+//  3. command line flags, e.g. -mqtt.crs.server
+// Every field can be overridden, values are parsed as yaml so lists and maps use
+// the flow style, e.g. CGW_UPSTREAM_REASON_CODE="[0x98, 0x87]"
+
+// EnvPrefix is the prefix of environment variables that override the config
+const EnvPrefix = "CGW_"
+
+// redacted replaces secrets in the effective config
+const redacted = "xxxxx"
+
+// Overrides are config values keyed by their yaml path, e.g. mqtt.crs.server
+type Overrides map[string]string
+
+// configKey is a config field that can be overridden
+type configKey struct {
+	path    string
+	env     string
+	usage   string
+	boolean bool
+}
+
+// configKeys lists every config field, nested settings are walked and any
+// other field is overridden as a whole
+func configKeys() []configKey {
+	keys := []configKey{}
+	var walk func(t reflect.Type, prefix string)
+	walk = func(t reflect.Type, prefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			name := yamlName(t.Field(i))
+			if name == "" {
+				continue
+			}
+			path := prefix + name
+			if t.Field(i).Type.Kind() == reflect.Struct {
+				walk(t.Field(i).Type, path+".")
+				continue
+			}
+			keys = append(keys, configKey{
+				path:    path,
+				env:     envName(path),
+				usage:   fmt.Sprintf("overrides %s, also set with %s", path, envName(path)),
+				boolean: t.Field(i).Type.Kind() == reflect.Bool,
+			})
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "")
+	return keys
+}
+
+// yamlName is the key of the field in the config file
+func yamlName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// envName converts a yaml path to its environment variable, words in camel case
+// keys are split so mqtt.crs.cfgPath becomes CGW_MQTT_CRS_CFG_PATH
+func envName(path string) string {
+	var sb strings.Builder
+	sb.WriteString(EnvPrefix)
+	for _, key := range strings.Split(path, ".") {
+		if sb.Len() > len(EnvPrefix) {
+			sb.WriteByte('_')
+		}
+		runes := []rune(key)
+		for i, r := range runes {
+			// start a word on lower to upper and at the end of an acronym, e.g. clientCAFile
+			if i > 0 && unicode.IsUpper(r) && (!unicode.IsUpper(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				sb.WriteByte('_')
+			}
+			sb.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return sb.String()
+}
+
+// EnvOverrides collects the CGW_ variables in environ, variables that
+// don't match a config field are ignored
+func EnvOverrides(environ []string) Overrides {
+	paths := map[string]string{}
+	for _, key := range configKeys() {
+		paths[key.env] = key.path
+	}
+	overrides := Overrides{}
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], EnvPrefix) {
+			continue
+		}
+		path, ok := paths[parts[0]]
+		if !ok {
+			ErrorLog("environment variable doesn't match a config field, %s", parts[0])
+			continue
+		}
+		overrides[path] = parts[1]
+	}
+	return overrides
+}
+
+// overrideFlag records the value of a config flag when it's set
+type overrideFlag struct {
+	path      string
+	boolean   bool
+	overrides Overrides
+}
+
+// String returns the value that was set
+func (of overrideFlag) String() string {
+	return of.overrides[of.path]
+}
+
+// Set records the value
+func (of overrideFlag) Set(value string) error {
+	of.overrides[of.path] = value
+	return nil
+}
+
+// IsBoolFlag lets bool fields be set without a value, e.g. -auth.enabled
+func (of overrideFlag) IsBoolFlag() bool {
+	return of.boolean
+}
+
+// RegisterConfigFlags adds a flag for every config field to fs, once fs is
+// parsed the returned overrides have the flags that were set
+func RegisterConfigFlags(fs *flag.FlagSet) Overrides {
+	overrides := Overrides{}
+	for _, key := range configKeys() {
+		fs.Var(overrideFlag{key.path, key.boolean, overrides}, key.path, key.usage)
+	}
+	return overrides
+}
+
+// apply sets the overrides on cfg, strings are used as is and other
+// values are parsed as yaml
+func (o Overrides) apply(cfg *Config) error {
+	paths := make([]string, 0, len(o))
+	for path := range o {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		field, err := configField(cfg, path)
+		if err != nil {
+			return err
+		}
+		if field.Kind() == reflect.String {
+			field.SetString(o[path])
+			continue
+		}
+		// replace the field instead of merging into existing lists and maps
+		value := reflect.New(field.Type())
+		if err := yaml.Unmarshal([]byte(o[path]), value.Interface()); err != nil {
+			return fmt.Errorf("invalid value for %s, %s", path, err)
+		}
+		field.Set(value.Elem())
+	}
+	return nil
+}
+
+// configField finds the field at path in cfg
+func configField(cfg *Config, path string) (reflect.Value, error) {
+	field := reflect.ValueOf(cfg).Elem()
+	for _, key := range strings.Split(path, ".") {
+		if field.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("unknown config field, %s", path)
+		}
+		found := false
+		for i := 0; i < field.NumField(); i++ {
+			if yamlName(field.Type().Field(i)) == key {
+				field = field.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, fmt.Errorf("unknown config field, %s", path)
+		}
+	}
+	if field.Kind() == reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("config field has nested fields, %s", path)
+	}
+	return field, nil
+}
+
+// DumpConfig returns the effective config as yaml, secrets are files that are never
+// read into the config so only passwords in urls have to be redacted
+func DumpConfig(cfg Config) ([]byte, error) {
+	value := reflect.ValueOf(&cfg).Elem()
+	redactURLs(value)
+	return yaml.Marshal(cfg)
+}
+
+// redactURLs replaces the password of every url in v
+func redactURLs(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				redactURLs(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		// copy so the caller's config isn't changed
+		if v.IsNil() {
+			return
+		}
+		elems := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(elems, v)
+		for i := 0; i < elems.Len(); i++ {
+			redactURLs(elems.Index(i))
+		}
+		v.Set(elems)
+	case reflect.Map:
+		if v.IsNil() || v.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		entries := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, key := range v.MapKeys() {
+			entry := reflect.New(v.Type().Elem()).Elem()
+			entry.Set(v.MapIndex(key))
+			redactURLs(entry)
+			entries.SetMapIndex(key, entry)
+		}
+		v.Set(entries)
+	case reflect.String:
+		u, err := url.Parse(v.String())
+		if err != nil || u.User == nil {
+			return
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			v.SetString(u.String())
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package cgw
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// default rate limit window
+const defaultRateLimitWindow = 60 * time.Second
+
+// routes that can be rate limited
+var rateLimitRoutes = []string{CreateRoute, ValidateRoute, RefreshRoute, DisconnectRoute}
+
+// RateLimitSettings represents settings for limiting requests per entity pair
+// Limits is the number of requests allowed per Window (seconds) for each entity type,
+// entity types without a limit are not limited, Routes defaults to validate only,
+// Disconnect disconnects clients with RateTooHigh when they first go over the limit
+type RateLimitSettings struct {
+	Enabled    bool           `yaml:"enabled"`
+	Window     int            `yaml:"window"`
+	Limits     map[string]int `yaml:"limits"`
+	Routes     []string       `yaml:"routes"`
+	Disconnect bool           `yaml:"disconnect"`
+}
+
+// validate checks the rate limit fields are consistent
+func (rl RateLimitSettings) validate() error {
+	if !rl.Enabled {
+		return nil
+	}
+	if rl.Window < 0 {
+		return fmt.Errorf("window can't be negative, %d", rl.Window)
+	}
+	for entity, limit := range rl.Limits {
+		if !IsValidEntity(entity) {
+			return fmt.Errorf("entity is not supported, %s", entity)
+		}
+		if limit < 0 {
+			return fmt.Errorf("limit for %s can't be negative, %d", entity, limit)
+		}
+	}
+	for _, route := range rl.Routes {
+		supported := false
+		for _, r := range rateLimitRoutes {
+			supported = supported || r == route
+		}
+		if !supported {
+			return fmt.Errorf("route can't be rate limited, %s", route)
+		}
+	}
+	return nil
+}
+
+// removeEntityCb disconnects the client and removes the entity pair, returns false if it isn't stored
+type removeEntityCb func(ctx context.Context, ep EntityPair, rc ReasonCode) (bool, error)
+
+// RateLimiter is a sliding window rate limiter backed by the key value store,
+// the count of the previous fixed window is weighted by how much of it still overlaps
+type RateLimiter struct {
+	kv     KeyValueStore
+	window time.Duration
+	limits map[string]int
+	routes map[string]bool
+	remove removeEntityCb
+}
+
+// NewRateLimiter creates a rate limiter, remove is only used if settings enable disconnects
+func NewRateLimiter(settings RateLimitSettings, kv KeyValueStore, remove removeEntityCb) (*RateLimiter, error) {
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+	rl := &RateLimiter{
+		kv:     kv,
+		window: defaultRateLimitWindow,
+		limits: map[string]int{},
+		routes: map[string]bool{},
+	}
+	if settings.Window > 0 {
+		rl.window = time.Duration(settings.Window) * time.Second
+	}
+	for entity, limit := range settings.Limits {
+		rl.limits[strings.ToLower(entity)] = limit
+	}
+	routes := settings.Routes
+	if len(routes) == 0 {
+		routes = []string{ValidateRoute}
+	}
+	for _, route := range routes {
+		rl.routes[route] = true
+	}
+	if settings.Disconnect {
+		rl.remove = remove
+	}
+	return rl, nil
+}
+
+// rateDecision is the outcome of counting a request
+type rateDecision struct {
+	allowed bool
+	// crossed is set on the first request over the limit in the window
+	crossed    bool
+	retryAfter time.Duration
+}
+
+// Allow counts a request for the entity pair at time now
+func (rl *RateLimiter) Allow(ctx context.Context, ep EntityPair, now time.Time) (rateDecision, error) {
+	limit, ok := rl.limits[strings.ToLower(ep.Entity)]
+	if !ok {
+		return rateDecision{allowed: true}, nil
+	}
+	index := now.UnixNano() / int64(rl.window)
+	key := "rate:" + ep.CreateKey()
+
+	// keep the counter around for the next window to weigh it
+	current, err := rl.kv.Incr(ctx, fmt.Sprintf("%s:%d", key, index), 2*rl.window)
+	if err != nil {
+		return rateDecision{}, err
+	}
+	var previous int64
+	val, err := rl.kv.Get(ctx, fmt.Sprintf("%s:%d", key, index-1))
+	if err == nil {
+		previous, _ = strconv.ParseInt(val, 10, 64)
+	} else if err != ErrKeyNotFound {
+		return rateDecision{}, err
+	}
+
+	elapsed := time.Duration(now.UnixNano() - index*int64(rl.window))
+	overlap := 1 - float64(elapsed)/float64(rl.window)
+	estimate := float64(previous)*overlap + float64(current)
+	if estimate <= float64(limit) {
+		return rateDecision{allowed: true}, nil
+	}
+	return rateDecision{
+		crossed:    estimate-1 <= float64(limit),
+		retryAfter: rl.window - elapsed,
+	}, nil
+}
+
+// rateLimitHandler rejects requests over the limit for the decoded entity pair,
+// must run after the request has been decoded
+func rateLimitHandler(rl *RateLimiter, route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if rl == nil || !rl.routes[route] {
+			next(w, req)
+			return
+		}
+		ctx := req.Context()
+		eid, ok := ctx.Value(DecodedJSON).(EntityIdentifier)
+		if !ok {
+			ErrorLog("unable to retrieve decoded json from ctx")
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		ep := *eid.GetEntityPair()
+		decision, err := rl.Allow(ctx, ep, time.Now())
+		if err != nil {
+			// don't turn a store outage into an outage of the route
+			ErrorLog("unable to check rate limit for %s, %s", ep.CreateKey(), err)
+			next(w, req)
+			return
+		}
+		if decision.allowed {
+			next(w, req)
+			return
+		}
+		rateLimited.WithLabelValues(route, strings.ToLower(ep.Entity)).Inc()
+		// caas and the store are cleaned up the same way as any other disconnect
+		if decision.crossed && rl.remove != nil {
+			found, err := rl.remove(ctx, ep, RateTooHigh)
+			if err != nil {
+				ErrorLog("unable to disconnect %s for rate, %s", ep.CreateKey(), err)
+			} else if !found {
+				DebugLog("%s isn't stored, nothing to disconnect for rate", ep.CreateKey())
+			}
+		}
+		ErrorLog("rate limit exceeded for %s on %s", ep.CreateKey(), route)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(decision.retryAfter.Seconds()))))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,145 @@
+package cgw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestRateLimitSettings(t *testing.T) {
+	testTable := map[string]RateLimitSettings{
+		"window can't be negative":    {Enabled: true, Window: -1},
+		"entity is not supported":     {Enabled: true, Limits: map[string]int{"asd": 1}},
+		"limit for veh":               {Enabled: true, Limits: map[string]int{"veh": -1}},
+		"route can't be rate limited": {Enabled: true, Routes: []string{"debug"}},
+	}
+	for k, v := range testTable {
+		_, err := NewRateLimiter(v, nil, nil)
+		assert.ErrorContains(t, err, k)
+	}
+	assert.NilError(t, RateLimitSettings{Window: -1}.validate())
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	ctx := context.Background()
+	rl, err := NewRateLimiter(RateLimitSettings{
+		Enabled: true,
+		Limits:  map[string]int{"veh": 3},
+	}, NewMemoryStore(), nil)
+	assert.NilError(t, err)
+	ep := EntityPair{Entity: "veh", EntityID: "1234"}
+	start := time.Unix(6000, 0)
+
+	for i := 0; i < 3; i++ {
+		decision, err := rl.Allow(ctx, ep, start)
+		assert.NilError(t, err)
+		assert.Assert(t, decision.allowed)
+	}
+	decision, err := rl.Allow(ctx, ep, start.Add(10*time.Second))
+	assert.NilError(t, err)
+	assert.Assert(t, !decision.allowed)
+	assert.Assert(t, decision.crossed)
+	assert.Equal(t, decision.retryAfter, 50*time.Second)
+	decision, err = rl.Allow(ctx, ep, start.Add(10*time.Second))
+	assert.NilError(t, err)
+	assert.Assert(t, !decision.allowed)
+	assert.Assert(t, !decision.crossed)
+
+	// a sixth of the previous window still counts
+	for i := 0; i < 2; i++ {
+		decision, err = rl.Allow(ctx, ep, start.Add(110*time.Second))
+		assert.NilError(t, err)
+		assert.Assert(t, decision.allowed)
+	}
+	decision, err = rl.Allow(ctx, ep, start.Add(110*time.Second))
+	assert.NilError(t, err)
+	assert.Assert(t, !decision.allowed)
+	assert.Equal(t, decision.retryAfter, 10*time.Second)
+
+	// other entity pairs and unlimited entity types aren't affected
+	decision, err = rl.Allow(ctx, EntityPair{Entity: "veh", EntityID: "5678"}, start)
+	assert.NilError(t, err)
+	assert.Assert(t, decision.allowed)
+	for i := 0; i < 10; i++ {
+		decision, err = rl.Allow(ctx, EntityPair{Entity: "sw", EntityID: "1234"}, start)
+		assert.NilError(t, err)
+		assert.Assert(t, decision.allowed)
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	ms := NewMemoryStore()
+	rd := &recordingDisconnecter{}
+	cgw := gw
+	cgw.kv = ms
+	cgw.disconnecter = rd
+	updateSettings(&cgw, func(ls *liveSettings) {
+		ls.handlerTO = time.Second
+	})
+	rl, err := NewRateLimiter(RateLimitSettings{
+		Enabled:    true,
+		Window:     3600,
+		Limits:     map[string]int{"veh": 1},
+		Disconnect: true,
+	}, ms, func(ctx context.Context, ep EntityPair, rc ReasonCode) (bool, error) {
+		return cgw.removeEntity(ctx, ep, rc, nil)
+	})
+	assert.NilError(t, err)
+	next := func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	etr := EntityTokenRequest{
+		EntityPair: EntityPair{Entity: "VEH", EntityID: "1234"},
+		Token:      "test.test",
+	}
+
+	t.Run("unlimited_route", func(t *testing.T) {
+		handler := rateLimitHandler(rl, CreateRoute, next)
+		for i := 0; i < 3; i++ {
+			w := httptest.NewRecorder()
+			handler(w, createTestRequest(t, nil, &etr))
+			assert.Equal(t, w.Code, http.StatusOK)
+		}
+	})
+
+	t.Run("nil_limiter", func(t *testing.T) {
+		handler := rateLimitHandler(nil, ValidateRoute, next)
+		w := httptest.NewRecorder()
+		handler(w, createTestRequest(t, nil, nil))
+		assert.Equal(t, w.Code, http.StatusOK)
+	})
+
+	t.Run("limited", func(t *testing.T) {
+		assert.NilError(t, setRecord(context.Background(), ms, EntityRecord{EntityPair: etr.EntityPair, Token: etr.Token}))
+		handler := rateLimitHandler(rl, ValidateRoute, next)
+		w := httptest.NewRecorder()
+		handler(w, createTestRequest(t, nil, &etr))
+		assert.Equal(t, w.Code, http.StatusOK)
+		for i := 0; i < 2; i++ {
+			w = httptest.NewRecorder()
+			handler(w, createTestRequest(t, nil, &etr))
+			assert.Equal(t, w.Code, http.StatusTooManyRequests)
+			assert.Assert(t, w.Header().Get("Retry-After") != "")
+		}
+		// only the request crossing the limit disconnects
+		assert.Equal(t, len(rd.requests), 1)
+		assert.DeepEqual(t, rd.requests[0], DisconnectRequest{
+			EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+			ReasonCode: RateTooHigh,
+		})
+		exists, err := ms.Exists(context.Background(), etr.CreateKey())
+		assert.NilError(t, err)
+		assert.Assert(t, !exists)
+	})
+
+	t.Run("no_decoded_json", func(t *testing.T) {
+		handler := rateLimitHandler(rl, ValidateRoute, next)
+		w := httptest.NewRecorder()
+		handler(w, createTestRequest(t, nil, nil))
+		assert.Equal(t, w.Code, http.StatusBadRequest)
+	})
+}
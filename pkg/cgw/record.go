@@ -0,0 +1,135 @@
+package cgw
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// EntityRecord is the value stored for every entity pair, Token is only kept in plain
+// text when token hashing is disabled, otherwise TokenHash is the keyed hash of the token
+// under KeyID and SealedToken is the token encrypted under the same key
+// CreatedAt and RefreshedAt are unix times, MEC is where the entity was registered
+type EntityRecord struct {
+	EntityPair
+	Token       string `json:"token,omitempty"`
+	TokenHash   string `json:"tokenHash,omitempty"`
+	KeyID       string `json:"keyID,omitempty"`
+	SealedToken string `json:"sealedToken,omitempty"`
+	ExpiresAt   int64  `json:"expiresAt,omitempty"`
+	CreatedAt   int64  `json:"createdAt,omitempty"`
+	RefreshedAt int64  `json:"refreshedAt,omitempty"`
+	MEC         string `json:"mec,omitempty"`
+	// Previous is the token replaced by the last refresh while it's still accepted
+	Previous *PreviousToken `json:"previous,omitempty"`
+}
+
+// PreviousToken is a replaced token that validates until ValidUntil (unix time),
+// SealedToken lets the token be moved to a new hashing key like the current one
+type PreviousToken struct {
+	Token       string `json:"token,omitempty"`
+	TokenHash   string `json:"tokenHash,omitempty"`
+	KeyID       string `json:"keyID,omitempty"`
+	SealedToken string `json:"sealedToken,omitempty"`
+	ValidUntil  int64  `json:"validUntil"`
+}
+
+// retire keeps the current token of the record around until validUntil
+func (rec *EntityRecord) retire(validUntil time.Time) {
+	rec.Previous = &PreviousToken{
+		Token:       rec.Token,
+		TokenHash:   rec.TokenHash,
+		KeyID:       rec.KeyID,
+		SealedToken: rec.SealedToken,
+		ValidUntil:  validUntil.Unix(),
+	}
+}
+
+// replacePrevious swaps the token kept for the grace period, ValidUntil is unchanged
+func (rec *EntityRecord) replacePrevious(prev EntityRecord) {
+	rec.Previous.Token = prev.Token
+	rec.Previous.TokenHash = prev.TokenHash
+	rec.Previous.KeyID = prev.KeyID
+	rec.Previous.SealedToken = prev.SealedToken
+}
+
+// previous returns the replaced token as a record if it's still accepted at time now
+func (rec *EntityRecord) previous(now time.Time) (EntityRecord, bool) {
+	if rec.Previous == nil || now.Unix() >= rec.Previous.ValidUntil {
+		return EntityRecord{}, false
+	}
+	return EntityRecord{
+		EntityPair:  rec.EntityPair,
+		Token:       rec.Previous.Token,
+		TokenHash:   rec.Previous.TokenHash,
+		KeyID:       rec.Previous.KeyID,
+		SealedToken: rec.Previous.SealedToken,
+	}, true
+}
+
+// Expired checks if the token has lapsed at time now
+func (rec *EntityRecord) Expired(now time.Time) bool {
+	return rec.ExpiresAt != 0 && now.Unix() >= rec.ExpiresAt
+}
+
+// parseRecord decodes stored values, plain tokens written by older versions are still accepted
+func parseRecord(key string, value string) (EntityRecord, error) {
+	rec := EntityRecord{}
+	if !strings.HasPrefix(value, "{") {
+		rec.Token = value
+	} else if err := json.Unmarshal([]byte(value), &rec); err != nil {
+		return EntityRecord{}, err
+	}
+	if IsEmpty(rec.Entity) || IsEmpty(rec.EntityID) {
+		parts := strings.SplitN(key, "-", 2)
+		if len(parts) == 2 {
+			rec.Entity, rec.EntityID = parts[0], parts[1]
+		}
+	}
+	return rec, nil
+}
+
+// getRecord reads the record stored at key
+func getRecord(ctx context.Context, kv KeyValueStore, key string) (EntityRecord, error) {
+	val, err := kv.Get(ctx, key)
+	if err != nil {
+		return EntityRecord{}, err
+	}
+	return parseRecord(key, val)
+}
+
+// setRecord writes the record, the key doesn't expire in the store since the expiry
+// sweeper removes it once the token is also removed from caas
+func setRecord(ctx context.Context, kv KeyValueStore, rec EntityRecord) error {
+	jsBytes, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return kv.Set(ctx, rec.CreateKey(), string(jsBytes), 0)
+}
+
+// scanRecords calls fn for every record stored under the entity type
+func scanRecords(ctx context.Context, kv KeyValueStore, entity string, fn func(EntityRecord)) error {
+	var cursor uint64
+	for {
+		keys, next, err := kv.Scan(ctx, cursor, strings.ToLower(entity)+"-*", 100)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			rec, err := getRecord(ctx, kv, key)
+			if err == ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				ErrorLog("unable to read record %s, %s", key, err)
+				continue
+			}
+			fn(rec)
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
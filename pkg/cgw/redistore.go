@@ -4,107 +4,214 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bsm/redislock"
 	"github.com/go-redis/redis/v8"
 )
 
-// KeyValueStore is interface all db will implement
-// type KeyValueStore interface {
-// 	HGet(context.Context, string, string) (string, error)
-// 	HSet(context.Context, string, ...interface{}) (int64, error)
-// 	HSetNX(context.Context, string, string, ...interface{}) (bool, error)
-// 	Get(context.Context, string) (string, error)
-// 	Set(context.Context, string, string) error
-// 	SetIfNotExist(context.Context, string, string) (bool, error)
-// 	GetDelete(context.Context, string) (string, error)
-// 	Flush(context.Context) error
-// 	Close()
-// }
-
 // RedisStore represents redis storage
+// locks are single instance redislock locks, in sentinel mode they live on the current
+// master and in cluster mode on the node owning the lock key
 type RedisStore struct {
-	redisClient *redis.Client
+	redisClient redis.UniversalClient
 	redisLock   *redislock.Client
 }
 
-// NewRedisStore creates a new RedisStore instance
-func NewRedisStore(settings RedisSettings) (RedisStore, error) {
-	creds, err := FileCredentials(settings.AuthFile)
+// NewRedisStore creates a new RedisStore instance, it fails if redis can't be reached
+func NewRedisStore(settings RedisSettings) (*RedisStore, error) {
+	rdb, err := newRedisStore(settings)
 	if err != nil {
-		return RedisStore{}, err
-	}
-	rdb := RedisStore{
-		redisClient: redis.NewClient(&redis.Options{
-			Addr:     settings.Server,
-			Username: creds.user,
-			Password: creds.password,
-			DB:       settings.DBIndex,
-		}),
+		return nil, err
 	}
-	DebugLog("redis credentials, %v", creds)
-	rdb.redisLock = redislock.New(rdb.redisClient)
 
 	// make sure connection is up
 	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
 	defer cancel()
 	pong, err := rdb.redisClient.Ping(ctx).Result()
-	if err != nil && strings.ToLower(pong) == "pong" {
+	if err != nil || strings.ToLower(pong) != "pong" {
 		msg := fmt.Sprintf("didn't receive pong, %s, %s", pong, err)
 		ErrorLog(msg)
-		return RedisStore{}, errors.New(msg)
+		rdb.Close()
+		return nil, errors.New(msg)
 	}
 	DebugLog("received pong from redis")
 	return rdb, nil
 }
 
-// // Get returns a string of the value stored
-// func (rs RedisStore) Get(ctx context.Context, key string) (string, error) {
-// 	return rs.redisClient.Get(ctx, key).Result()
-// }
-
-// // Set returns set the value of the key to value
-// func (rs RedisStore) Set(ctx context.Context, key string, value string) error {
-// 	return rs.redisClient.Set(ctx, key, value, 0).Err()
-// }
-
-// // SetIfNotExist sets the value if the key value doesn't exist in a atomic fashion
-// func (rs RedisStore) SetIfNotExist(ctx context.Context, key string, value string) (bool, error) {
-// 	return rs.redisClient.SetNX(ctx, key, value, 0).Result()
-// }
-
-// // GetDelete gets and deletes values atomically
-// func (rs RedisStore) GetDelete(ctx context.Context, key string) (string, error) {
-// 	pipe := rs.redisClient.TxPipeline()
-// 	val, _ := pipe.Get(ctx, key).Result()
-// 	pipe.Del(ctx, key).Result()
-// 	_, err := pipe.Exec(ctx)
-// 	return val, err
-// }
-
-// // Flush gets rid of all the keys in DB
-// func (rs RedisStore) Flush(ctx context.Context) error {
-// 	return rs.redisClient.FlushDB(ctx).Err()
-// }
-
-// // HSet sets keys in a hash
-// func (rs RedisStore) HSet(ctx context.Context, key string, values ...interface{}) (int64, error) {
-// 	return rs.redisClient.HSet(ctx, key, values).Result()
-// }
-
-// // HSetNX sets key in hash if it doesn't exist
-// func (rs RedisStore) HSetNX(ctx context.Context, key string, field string, values ...interface{}) (bool, error) {
-// 	return rs.redisClient.HSetNX(ctx, key, field, values).Result()
-// }
-
-// // HGet gets keys in a hash
-// func (rs RedisStore) HGet(ctx context.Context, key string, field string) (string, error) {
-// 	return rs.redisClient.HGet(ctx, key, field).Result()
-// }
-
-// // Close the store
-// func (rs RedisStore) Close() error {
-// 	return rs.redisClient.Close()
-// }
+// newRedisStore creates the client for the redis topology without connecting
+func newRedisStore(settings RedisSettings) (*RedisStore, error) {
+	creds, err := FileCredentials(settings.AuthFile)
+	if err != nil {
+		return nil, err
+	}
+	DebugLog("redis credentials, %v", creds)
+	rdb := &RedisStore{}
+	switch settings.Mode {
+	case RedisSentinel:
+		// sentinel password is optional
+		sentinelCreds := UserPassword{}
+		if !IsEmpty(settings.Sentinel.AuthFile) {
+			sentinelCreds, err = FileCredentials(settings.Sentinel.AuthFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		rdb.redisClient = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       settings.Sentinel.MasterName,
+			SentinelAddrs:    settings.Sentinel.Addresses,
+			SentinelPassword: sentinelCreds.password,
+			Username:         creds.user,
+			Password:         creds.password,
+			DB:               settings.DBIndex,
+		})
+	case RedisCluster:
+		rdb.redisClient = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    settings.Cluster.Seeds,
+			Username: creds.user,
+			Password: creds.password,
+		})
+	default:
+		rdb.redisClient = redis.NewClient(&redis.Options{
+			Addr:     settings.Server,
+			Username: creds.user,
+			Password: creds.password,
+			DB:       settings.DBIndex,
+		})
+	}
+	rdb.redisClient.AddHook(redisMetricsHook{})
+	rdb.redisLock = redislock.New(rdb.redisClient)
+	return rdb, nil
+}
+
+// Get returns a string of the value stored
+func (rs *RedisStore) Get(ctx context.Context, key string) (string, error) {
+	val, err := rs.redisClient.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+	return val, err
+}
+
+// Set sets the value of the key to value, a zero ttl means the key never expires
+func (rs *RedisStore) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return rs.redisClient.Set(ctx, key, value, ttl).Err()
+}
+
+// Exists checks if the key is stored
+func (rs *RedisStore) Exists(ctx context.Context, key string) (bool, error) {
+	n, err := rs.redisClient.Exists(ctx, key).Result()
+	return n > 0, err
+}
+
+// Delete removes the key
+func (rs *RedisStore) Delete(ctx context.Context, key string) error {
+	return rs.redisClient.Del(ctx, key).Err()
+}
+
+// Incr increments the counter at key and refreshes its ttl
+func (rs *RedisStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	var incr *redis.IntCmd
+	_, err := rs.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// Scan iterates over keys matching the glob pattern, a returned cursor of 0 ends the iteration
+func (rs *RedisStore) Scan(ctx context.Context, cursor uint64, match string, count int64) ([]string, uint64, error) {
+	if cluster, ok := rs.redisClient.(*redis.ClusterClient); ok {
+		return clusterScan(ctx, cluster, cursor, match, count)
+	}
+	return rs.redisClient.Scan(ctx, cursor, match, count).Result()
+}
+
+// cluster cursors keep the index of the master being scanned in the top bits
+const clusterNodeShift = 48
+
+// clusterScan scans every master in turn since each node only knows its own keys
+func clusterScan(ctx context.Context, cluster *redis.ClusterClient,
+	cursor uint64, match string, count int64) ([]string, uint64, error) {
+	masters, err := clusterMasters(ctx, cluster)
+	if err != nil {
+		return nil, 0, err
+	}
+	node := int(cursor >> clusterNodeShift)
+	nodeCursor := cursor & (1<<clusterNodeShift - 1)
+	for ; node < len(masters); node++ {
+		keys, next, err := masters[node].Scan(ctx, nodeCursor, match, count).Result()
+		if err != nil {
+			return nil, 0, err
+		}
+		if next != 0 {
+			return keys, uint64(node)<<clusterNodeShift | next, nil
+		}
+		nodeCursor = 0
+		if len(keys) > 0 && node+1 < len(masters) {
+			return keys, uint64(node+1) << clusterNodeShift, nil
+		} else if len(keys) > 0 {
+			return keys, 0, nil
+		}
+	}
+	return []string{}, 0, nil
+}
+
+// clusterMasters returns the cluster masters in a stable order
+func clusterMasters(ctx context.Context, cluster *redis.ClusterClient) ([]*redis.Client, error) {
+	var mu sync.Mutex
+	masters := []*redis.Client{}
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		masters = append(masters, client)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(masters, func(i, j int) bool {
+		return masters[i].Options().Addr < masters[j].Options().Addr
+	})
+	return masters, nil
+}
+
+// Lock obtains a distributed lock on key that expires after ttl
+func (rs *RedisStore) Lock(ctx context.Context, key string, ttl time.Duration) (KeyLock, error) {
+	lock, err := rs.redisLock.Obtain(ctx, key, ttl, &redislock.Options{
+		RetryStrategy: redislock.LimitRetry(redislock.LinearBackoff(lockRetryBackoff), lockRetries),
+	})
+	if err == redislock.ErrNotObtained {
+		return nil, ErrLockNotObtained
+	} else if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Flush gets rid of all the keys in DB
+func (rs *RedisStore) Flush(ctx context.Context) error {
+	if cluster, ok := rs.redisClient.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return client.FlushAll(ctx).Err()
+		})
+	}
+	return rs.redisClient.FlushAll(ctx).Err()
+}
+
+// Ping checks the connection to redis
+func (rs *RedisStore) Ping(ctx context.Context) error {
+	return rs.redisClient.Ping(ctx).Err()
+}
+
+// Close the store
+func (rs *RedisStore) Close() error {
+	return rs.redisClient.Close()
+}
@@ -0,0 +1,55 @@
+package cgw
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"gotest.tools/assert"
+)
+
+func TestNewRedisStore(t *testing.T) {
+	testTable := map[RedisMode]RedisSettings{
+		RedisSingle: {
+			Server:   "localhost:6379",
+			AuthFile: "./test/auth/authFile",
+		},
+		RedisSentinel: {
+			Mode:     RedisSentinel,
+			AuthFile: "./test/auth/authFile",
+			Sentinel: SentinelSettings{
+				MasterName: "cgw-master",
+				Addresses:  []string{"localhost:26379"},
+				AuthFile:   "./test/auth/authFile",
+			},
+		},
+		RedisCluster: {
+			Mode:     RedisCluster,
+			AuthFile: "./test/auth/authFile",
+			Cluster: ClusterSettings{
+				Seeds: []string{"localhost:7000", "localhost:7001"},
+			},
+		},
+	}
+	for k, v := range testTable {
+		rs, err := newRedisStore(v)
+		assert.NilError(t, err)
+		switch k {
+		case RedisCluster:
+			cluster, ok := rs.redisClient.(*redis.ClusterClient)
+			assert.Assert(t, ok)
+			assert.DeepEqual(t, cluster.Options().Addrs, v.Cluster.Seeds)
+			assert.Equal(t, cluster.Options().Username, "user")
+		default:
+			// sentinel failover clients are plain clients that resolve the master
+			client, ok := rs.redisClient.(*redis.Client)
+			assert.Assert(t, ok)
+			assert.Equal(t, client.Options().Password, "password")
+		}
+		assert.Assert(t, rs.redisLock != nil)
+		rs.Close()
+
+		// nothing is listening on the test addresses
+		_, err = NewRedisStore(v)
+		assert.ErrorContains(t, err, "didn't receive pong")
+	}
+}
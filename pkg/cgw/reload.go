@@ -0,0 +1,252 @@
+package cgw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReloadSettings represents settings for reloading the configuration while running
+// WatchInterval is how often (seconds) the config file is checked for changes,
+// 0 only reloads on SIGHUP
+type ReloadSettings struct {
+	WatchInterval int `yaml:"watchInterval"`
+}
+
+// reloadableFields are the config keys a reload applies without a restart,
+// the mqtt disconnecter keeps the bearer token it was created with
+var reloadableFields = map[string]bool{
+	"upstreamReasonCode": true,
+	"handlerTimeout":     true,
+	"tokenFile":          true,
+	"tokenWatchInterval": true,
+	"oauth2":             true,
+	"caas":               true,
+	"debug":              true,
+}
+
+// ReloadReport lists what a reload changed, RestartRequired are the changed
+// keys that only take effect once the gateway is restarted
+type ReloadReport struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// liveSettings are the settings a reload swaps, they're replaced as a whole so
+// requests and background work read one consistent snapshot without locking
+type liveSettings struct {
+	handlerTO           time.Duration
+	upstreamReasonCodes map[ReasonCode]bool
+	caas                CAASClient
+	caasHealth          Pinger
+	debugSettings       DebugSettings
+}
+
+// newLiveSettings creates the snapshot of the reloadable settings in cfg
+func newLiveSettings(cfg Config, caas CAASClient, caasHealth Pinger) *liveSettings {
+	ls := &liveSettings{
+		handlerTO:           time.Duration(cfg.HandlerTimeout) * time.Millisecond,
+		upstreamReasonCodes: map[ReasonCode]bool{},
+		caas:                caas,
+		caasHealth:          caasHealth,
+		debugSettings:       cfg.DebugSettings,
+	}
+	for _, rc := range cfg.UpstreamReasonCode {
+		ls.upstreamReasonCodes[rc] = true
+	}
+	return ls
+}
+
+// settings returns the current snapshot of the reloadable settings, callers keep
+// using the snapshot they read even if a reload happens halfway through
+func (cgw *CAASGateway) settings() *liveSettings {
+	return cgw.live.Load().(*liveSettings)
+}
+
+// setSettings publishes a new snapshot of the reloadable settings
+func (cgw *CAASGateway) setSettings(ls *liveSettings) {
+	cgw.live.Store(ls)
+}
+
+// reloader swaps the settings and router of a running gateway, the router is
+// built from a single settings snapshot so every request sees one configuration
+type reloader struct {
+	path      string
+	overrides Overrides
+	// mu serializes reloads, requests never take it
+	mu      sync.Mutex
+	cfg     Config
+	modTime time.Time
+	bgCtx   context.Context
+	router  atomic.Value
+}
+
+// newReloader keeps track of the configuration loaded from path, the
+// overrides are applied again on every reload
+func newReloader(path string, overrides Overrides, cfg Config) *reloader {
+	rl := &reloader{
+		path:      path,
+		overrides: overrides,
+		cfg:       cfg,
+	}
+	if info, err := os.Stat(path); err == nil {
+		rl.modTime = info.ModTime()
+	}
+	return rl
+}
+
+// ServeHTTP serves the request with the current router
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rl.router.Load().(http.Handler).ServeHTTP(w, req)
+}
+
+// changed checks if the config file was modified since it was loaded
+func (rl *reloader) changed() bool {
+	info, err := os.Stat(rl.path)
+	if err != nil {
+		// file might be mid rotation, try again later
+		return false
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return !info.ModTime().Equal(rl.modTime)
+}
+
+// watchInterval is how often the config file is checked, 0 doesn't watch it
+func (rl *reloader) watchInterval() time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return time.Duration(rl.cfg.Reload.WatchInterval) * time.Second
+}
+
+// serve publishes the router and returns the handler that always serves the
+// latest one, bgCtx is kept for the routers built by later reloads
+func (cgw *CAASGateway) serve(bgCtx context.Context) http.Handler {
+	rl := cgw.reloader
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.bgCtx = bgCtx
+	rl.router.Store(cgw.routes(bgCtx))
+	return rl
+}
+
+// diffConfig lists the config keys that differ between old and new
+func diffConfig(old Config, new Config) ReloadReport {
+	report := ReloadReport{Applied: []string{}, RestartRequired: []string{}}
+	oldVal, newVal := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < oldVal.NumField(); i++ {
+		if reflect.DeepEqual(oldVal.Field(i).Interface(), newVal.Field(i).Interface()) {
+			continue
+		}
+		key := strings.Split(oldVal.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if reloadableFields[key] {
+			report.Applied = append(report.Applied, key)
+		} else {
+			report.RestartRequired = append(report.RestartRequired, key)
+		}
+	}
+	return report
+}
+
+// keepRestartRequired copies the keys that need a restart from old into new so
+// they're reported again on the next reload until the gateway is restarted
+func keepRestartRequired(old Config, new Config) Config {
+	oldVal, newVal := reflect.ValueOf(old), reflect.ValueOf(&new).Elem()
+	for i := 0; i < oldVal.NumField(); i++ {
+		key := strings.Split(oldVal.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if !reloadableFields[key] {
+			newVal.Field(i).Set(oldVal.Field(i))
+		}
+	}
+	return new
+}
+
+// Reload re-reads the config file and swaps the settings that can change
+// without a restart, nothing is changed if the new config is invalid
+func (cgw *CAASGateway) Reload() (ReloadReport, error) {
+	rl := cgw.reloader
+	if rl == nil {
+		return ReloadReport{}, errors.New("gateway wasn't created from a config file")
+	}
+	info, err := os.Stat(rl.path)
+	if err != nil {
+		return ReloadReport{}, err
+	}
+	cfg, err := LoadConfig(rl.path, rl.overrides)
+	if err != nil {
+		return ReloadReport{}, fmt.Errorf("unable to parse config file, %s", err)
+	}
+
+	// reloads are applied one at a time, requests keep being served meanwhile
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	report := diffConfig(rl.cfg, cfg)
+	caas := cgw.settings().caas
+	if !reflect.DeepEqual(rl.cfg.CAAS, cfg.CAAS) {
+		caas, err = NewCAASClient(cfg.CAAS)
+		if err != nil {
+			return ReloadReport{}, fmt.Errorf("can't create caas client, %s", err)
+		}
+	}
+	// the readiness probe checks the caas server in use, health settings need a restart
+	caasHealth, err := newCAASHealthPinger(cfg.CAAS, rl.cfg.Health)
+	if err != nil {
+		return ReloadReport{}, err
+	}
+	// the token file is watched, a new source is only needed when the settings change
+	if rl.cfg.TokenFile != cfg.TokenFile || rl.cfg.TokenWatchInterval != cfg.TokenWatchInterval ||
+		!reflect.DeepEqual(rl.cfg.OAuth2, cfg.OAuth2) {
+		token, err := NewBearerToken(cfg)
+		if err != nil {
+			return ReloadReport{}, fmt.Errorf("can't get bearer token, %s", err)
+		}
+		cgw.token.replace(token)
+	}
+
+	cgw.setSettings(newLiveSettings(cfg, caas, caasHealth))
+	cgw.state.SetDebugLog(cfg.DebugSettings.DebugLog)
+	// routes capture the settings so the router is rebuilt once the server is running,
+	// requests already being served finish with the router they started on
+	if rl.router.Load() != nil {
+		rl.router.Store(cgw.routes(rl.bgCtx))
+	}
+	rl.cfg = keepRestartRequired(rl.cfg, cfg)
+	rl.modTime = info.ModTime()
+	return report, nil
+}
+
+// reload reloads the configuration and logs the outcome
+func (cgw *CAASGateway) reload() {
+	report, err := cgw.Reload()
+	if err != nil {
+		ErrorLog("unable to reload configuration, keeping the current one, %s", err)
+		return
+	}
+	DebugLog("reloaded configuration, applied: %v", report.Applied)
+	if len(report.RestartRequired) > 0 {
+		ErrorLog("configuration changes need a restart to take effect, %v", report.RestartRequired)
+	}
+}
+
+// watchConfig reloads the configuration when the file changes until ctx is done
+func (cgw *CAASGateway) watchConfig(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if cgw.reloader.changed() {
+				cgw.reload()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package cgw
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gotest.tools/assert"
+)
+
+// writeTestConfig writes the test gateway config with replacements applied
+func writeTestConfig(t *testing.T, path string, replacements ...string) {
+	cfg, err := ioutil.ReadFile("./test/config/cgw.yaml")
+	assert.NilError(t, err)
+	data := strings.NewReplacer(replacements...).Replace(string(cfg))
+	assert.NilError(t, ioutil.WriteFile(path, []byte(data), 0644))
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgw")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	cfgPath := filepath.Join(dir, "cgw.yaml")
+	writeTestConfig(t, cfgPath)
+
+	cgw, err := NewCAASGateway(cfgPath, nil, gw.kv, &dsMock{})
+	assert.NilError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cgw.serve(ctx)
+
+	t.Run("unchanged", func(t *testing.T) {
+		report, err := cgw.Reload()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, report, ReloadReport{Applied: []string{}, RestartRequired: []string{}})
+	})
+
+	t.Run("invalid_config", func(t *testing.T) {
+		writeTestConfig(t, cfgPath, "handlerTimeout: 4000", "handlerTimeout: 4000\nstore: etcd")
+		_, err := cgw.Reload()
+		assert.ErrorContains(t, err, "store: store type is not supported, etcd")
+		assert.Equal(t, cgw.settings().handlerTO, 4000*time.Millisecond)
+	})
+
+	t.Run("apply_and_restart", func(t *testing.T) {
+		writeTestConfig(t, cfgPath,
+			"handlerTimeout: 4000", "handlerTimeout: 2000\ndebug:\n  tokenEndpoint: /cgw/v1/debug/token",
+			"upstreamReasonCode: [0x98, 0x87]", "upstreamReasonCode: [0x98]",
+			"deleteEndpoint: /caas/v1/token/entity/delete", "deleteEndpoint: /caas/v2/token/entity/delete",
+			"port: 8080", "port: 8081")
+		report, err := cgw.Reload()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, report, ReloadReport{
+			Applied:         []string{"handlerTimeout", "upstreamReasonCode", "caas", "debug"},
+			RestartRequired: []string{"port"},
+		})
+		ls := cgw.settings()
+		assert.Equal(t, ls.handlerTO, 2000*time.Millisecond)
+		assert.DeepEqual(t, ls.upstreamReasonCodes, map[ReasonCode]bool{0x98: true})
+		assert.Equal(t, ls.caas.(*caasV1Client).deleteURL, "http://localhost:9090/caas/v2/token/entity/delete")
+		assert.Equal(t, cgw.port, "8080")
+
+		// new debug endpoints are routed without a restart
+		w := httptest.NewRecorder()
+		cgw.reloader.ServeHTTP(w, httptest.NewRequest("GET", "/cgw/v1/debug/token?token=debug.test", nil))
+		assert.Equal(t, w.Code, http.StatusOK)
+		assert.Equal(t, cgw.GetToken(), "debug.test")
+
+		// everything else goes back and a new token file is read right away
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "token"), []byte("reload.test"), 0644))
+		writeTestConfig(t, cfgPath, "port: 8080", "port: 8081",
+			"tokenFile: ./test/auth/tokenFile", "tokenFile: "+filepath.Join(dir, "token"))
+		report, err = cgw.Reload()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, report.Applied, []string{"handlerTimeout", "tokenFile", "upstreamReasonCode", "caas", "debug"})
+		assert.DeepEqual(t, report.RestartRequired, []string{"port"})
+		assert.Equal(t, cgw.GetToken(), "reload.test")
+	})
+
+	t.Run("in_flight", func(t *testing.T) {
+		// a request still being served doesn't hold up the reload
+		started, release := make(chan struct{}), make(chan struct{})
+		blocking := mux.NewRouter()
+		blocking.HandleFunc(LivenessEndpoint, func(w http.ResponseWriter, req *http.Request) {
+			close(started)
+			<-release
+		})
+		cgw.reloader.router.Store(blocking)
+		done := make(chan struct{})
+		go func() {
+			cgw.reloader.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", LivenessEndpoint, nil))
+			close(done)
+		}()
+		<-started
+		writeTestConfig(t, cfgPath, "handlerTimeout: 4000", "handlerTimeout: 3000")
+		_, err := cgw.Reload()
+		assert.NilError(t, err)
+		assert.Equal(t, cgw.settings().handlerTO, 3000*time.Millisecond)
+
+		// new requests get the rebuilt router while the old one finishes
+		w := httptest.NewRecorder()
+		cgw.reloader.ServeHTTP(w, httptest.NewRequest("GET", LivenessEndpoint, nil))
+		assert.Equal(t, w.Code, http.StatusOK)
+		close(release)
+		<-done
+	})
+
+	t.Run("caas_health", func(t *testing.T) {
+		// readiness checks the caas server the reload switched to
+		paths := make(chan string, 1)
+		caas := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			paths <- req.URL.Path
+		}))
+		defer caas.Close()
+		writeTestConfig(t, cfgPath, "server: http://localhost:9090", "server: "+caas.URL)
+		_, err := cgw.Reload()
+		assert.NilError(t, err)
+		assert.NilError(t, cgw.ready.checks["caas"].Ping(context.Background()))
+		select {
+		case path := <-paths:
+			assert.Equal(t, path, "/")
+		default:
+			t.Fatal("caas health wasn't checked on the reloaded server")
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package cgw
+
+import (
+	"context"
+	"strings"
+)
+
+// stillApplies checks with the entity lock held that the record should still be removed,
+// it might have changed since the caller decided to remove it
+type stillApplies func(ctx context.Context, rec EntityRecord) (bool, error)
+
+// removeEntity disconnects the client with reason code rc and removes the entity from
+// the store, caas is updated if rc is an upstream reason code and always for expired
+// tokens, returns false if the entity isn't stored or applies turned it down
+func (cgw *CAASGateway) removeEntity(ctx context.Context, ep EntityPair, rc ReasonCode, applies stillApplies) (bool, error) {
+	// a reload halfway through doesn't change the settings used
+	ls := cgw.settings()
+	ctx, cancel := context.WithTimeout(ctx, ls.handlerTO)
+	defer cancel()
+
+	// take the same lock the handlers use so we don't race a refresh or validate
+	lock, err := cgw.kv.Lock(ctx, "lock:"+ep.CreateKey(), ls.handlerTO)
+	if err != nil {
+		return true, err
+	}
+	defer lock.Release(ctx)
+
+	rec, err := getRecord(ctx, cgw.kv, ep.CreateKey())
+	if err == ErrKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return true, err
+	}
+	if applies != nil {
+		ok, err := applies(ctx, rec)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	if ls.upstreamReasonCodes[rc] || rc == Expiration {
+		token, err := cgw.hasher.Open(rec)
+		if err != nil {
+			return true, err
+		}
+		_, err = caasDeleteEntity(ctx, ls.caas, rec.EntityPair, token, cgw.GetMEC(), cgw.GetToken())
+		if err != nil {
+			return true, err
+		}
+	}
+	err = cgw.disconnecter.Disconnect(ctx, DisconnectRequest{
+		EntityPair: EntityPair{
+			Entity:   strings.ToLower(rec.Entity),
+			EntityID: rec.EntityID,
+		},
+		ReasonCode: rc,
+	})
+	if err != nil {
+		return true, err
+	}
+	if err = cgw.kv.Delete(ctx, rec.CreateKey()); err != nil {
+		return true, err
+	}
+	if cgw.idle != nil {
+		return true, cgw.kv.Delete(ctx, activityKey(rec.EntityPair))
+	}
+	return true, nil
+}
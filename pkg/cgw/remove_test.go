@@ -0,0 +1,53 @@
+package cgw
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestRemoveEntity(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore()
+	ds := &recordingDisconnecter{}
+	cgw := gw
+	cgw.kv = ms
+	cgw.disconnecter = ds
+	updateSettings(&cgw, func(ls *liveSettings) {
+		ls.handlerTO = time.Second
+	})
+	var err error
+	cgw.idle, err = NewIdleTracker(IdleSettings{Enabled: true, Thresholds: map[string]int{"veh": 60}}, ms)
+	assert.NilError(t, err)
+
+	ep := EntityPair{Entity: "VEH", EntityID: "1234"}
+	assert.NilError(t, setRecord(ctx, ms, EntityRecord{EntityPair: ep, Token: "test.test"}))
+	assert.NilError(t, cgw.idle.Touch(ctx, ep, time.Now()))
+
+	// the record is left alone when it no longer applies
+	found, err := cgw.removeEntity(ctx, ep, Reauthenticate, func(context.Context, EntityRecord) (bool, error) {
+		return false, nil
+	})
+	assert.NilError(t, err)
+	assert.Assert(t, !found)
+	assert.Equal(t, len(ds.requests), 0)
+
+	found, err = cgw.removeEntity(ctx, ep, Reauthenticate, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, found)
+	assert.DeepEqual(t, ds.requests, []DisconnectRequest{{
+		EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+		ReasonCode: Reauthenticate,
+	}})
+	for _, key := range []string{ep.CreateKey(), activityKey(ep)} {
+		exists, err := ms.Exists(ctx, key)
+		assert.NilError(t, err)
+		assert.Assert(t, !exists, key)
+	}
+
+	found, err = cgw.removeEntity(ctx, ep, Reauthenticate, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, !found)
+}
@@ -0,0 +1,186 @@
+package cgw
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// default management api values, these match the emqx v5 api
+const (
+	defaultRESTMethod           = http.MethodDelete
+	defaultRESTEndpoint         = "/api/v5/clients/{clientid}"
+	defaultRESTClientIDTemplate = "{{.Entity}}-{{.EntityID}}"
+	restClientIDPlaceholder     = "{clientid}"
+)
+
+// management api auth types
+const (
+	RESTNoAuth     = ""
+	RESTBasicAuth  = "basic"
+	RESTBearerAuth = "bearer"
+)
+
+// errors returned by the rest disconnecter
+var (
+	ErrBrokerUnauthorized = errors.New("broker management api rejected the credentials")
+	ErrBrokerUnavailable  = errors.New("broker management api is unavailable")
+)
+
+// RESTSettings represents settings for disconnecting clients over a broker management api
+// ClientIDTemplate is a text/template executed with the EntityPair,
+// Endpoint has the "{clientid}" placeholder replaced with the escaped client id,
+// AuthFile has "user\npassword" for basic auth or the token for bearer auth
+type RESTSettings struct {
+	Server           string `yaml:"server"`
+	Method           string `yaml:"method"`
+	Endpoint         string `yaml:"endpoint"`
+	ClientIDTemplate string `yaml:"clientIDTemplate"`
+	AuthType         string `yaml:"authType"`
+	AuthFile         string `yaml:"authFile"`
+}
+
+// validate checks the rest fields are consistent, the server isn't checked since
+// brokers in the mqtt broker list bring their own
+func (rs RESTSettings) validate() error {
+	if !IsEmpty(rs.Endpoint) && !strings.Contains(rs.Endpoint, restClientIDPlaceholder) {
+		return fmt.Errorf("endpoint must contain %s", restClientIDPlaceholder)
+	}
+	if !IsEmpty(rs.ClientIDTemplate) {
+		if _, err := template.New("clientID").Parse(rs.ClientIDTemplate); err != nil {
+			return fmt.Errorf("invalid client id template, %s", err)
+		}
+	}
+	switch rs.AuthType {
+	case RESTNoAuth:
+	case RESTBasicAuth, RESTBearerAuth:
+		if IsEmpty(rs.AuthFile) {
+			return errors.New("missing management api auth file")
+		}
+	default:
+		return fmt.Errorf("auth type is not supported, %s", rs.AuthType)
+	}
+	return nil
+}
+
+// RESTDisconnecter kicks clients through a broker management api
+type RESTDisconnecter struct {
+	server   string
+	method   string
+	endpoint string
+	clientID *template.Template
+	header   map[string]string
+}
+
+// NewRESTDisconnecter creates a new management api disconnecter
+func NewRESTDisconnecter(settings MQTTSettings) (Disconnecter, error) {
+	rs := settings.REST
+	if err := rs.validate(); err != nil {
+		return nil, err
+	}
+	if IsEmpty(rs.Server) {
+		return nil, errors.New("missing management api server")
+	}
+	handler := &RESTDisconnecter{
+		server:   rs.Server,
+		method:   strings.ToUpper(rs.Method),
+		endpoint: rs.Endpoint,
+		header:   map[string]string{},
+	}
+	if IsEmpty(handler.method) {
+		handler.method = defaultRESTMethod
+	}
+	if IsEmpty(handler.endpoint) {
+		handler.endpoint = defaultRESTEndpoint
+	}
+	tmpl := rs.ClientIDTemplate
+	if IsEmpty(tmpl) {
+		tmpl = defaultRESTClientIDTemplate
+	}
+	var err error
+	handler.clientID, err = template.New("clientID").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	// read management api credentials
+	switch rs.AuthType {
+	case RESTBasicAuth:
+		mAuth, err := FileCredentials(rs.AuthFile)
+		if err != nil {
+			return nil, err
+		}
+		req := http.Request{Header: http.Header{}}
+		req.SetBasicAuth(mAuth.user, mAuth.password)
+		handler.header["Authorization"] = req.Header.Get("Authorization")
+	case RESTBearerAuth:
+		tBytes, err := ioutil.ReadFile(rs.AuthFile)
+		if err != nil {
+			return nil, err
+		}
+		if IsEmpty(string(tBytes)) {
+			return nil, errors.New("management api token is empty")
+		}
+		handler.header["Authorization"] = "Bearer " + strings.TrimSpace(string(tBytes))
+	}
+	return handler, nil
+}
+
+// buildURL renders the client id and joins it to the management api endpoint
+func (handler *RESTDisconnecter) buildURL(ep EntityPair) (string, error) {
+	var clientID bytes.Buffer
+	if err := handler.clientID.Execute(&clientID, ep); err != nil {
+		return "", fmt.Errorf("unable to render client id, %s", err)
+	}
+	if IsEmpty(clientID.String()) {
+		return "", errors.New("rendered client id is empty")
+	}
+	path := strings.Replace(handler.endpoint, restClientIDPlaceholder,
+		url.PathEscape(clientID.String()), -1)
+	return URLJoin(handler.server, path)
+}
+
+// Disconnect kicks the client, clients that aren't connected are treated as disconnected
+func (handler *RESTDisconnecter) Disconnect(ctx context.Context, req DisconnectRequest) error {
+	endpoint, err := handler.buildURL(req.EntityPair)
+	if err != nil {
+		return err
+	}
+	DebugLog("kicking client, %s %s", handler.method, endpoint)
+	resp, err := HTTPRequest(ctx, handler.method, endpoint, handler.header, nil, nil)
+	if err != nil {
+		return fmt.Errorf("unable to reach broker management api, %s", err)
+	}
+	switch {
+	case resp.status >= 200 && resp.status < 300:
+		return nil
+	case resp.status == http.StatusNotFound:
+		DebugLog("client is not connected, %s", endpoint)
+		return nil
+	case resp.status == http.StatusUnauthorized || resp.status == http.StatusForbidden:
+		return ErrBrokerUnauthorized
+	case resp.status >= 500:
+		ErrorLog("management api returned %d, %s", resp.status, string(resp.body))
+		return ErrBrokerUnavailable
+	default:
+		return fmt.Errorf("unexpected management api response %d, %s", resp.status, string(resp.body))
+	}
+}
+
+// Ping checks the management api is reachable
+func (handler *RESTDisconnecter) Ping(ctx context.Context) error {
+	resp, err := HTTPRequest(ctx, http.MethodGet, handler.server, handler.header, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.status >= http.StatusInternalServerError {
+		return ErrBrokerUnavailable
+	}
+	return nil
+}
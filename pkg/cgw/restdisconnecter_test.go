@@ -0,0 +1,100 @@
+package cgw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestRESTDisconnect(t *testing.T) {
+	var gotMethod, gotPath, gotAuth string
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotMethod, gotPath, gotAuth = req.Method, req.URL.EscapedPath(), req.Header.Get("Authorization")
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	ds, err := NewDisconnecter(RESTDisconnecterType, MQTTSettings{
+		REST: RESTSettings{
+			Server:   srv.URL,
+			AuthType: RESTBearerAuth,
+			AuthFile: "./test/auth/tokenFile",
+		},
+	}, "")
+	assert.NilError(t, err)
+	req := DisconnectRequest{
+		EntityPair: EntityPair{Entity: "veh", EntityID: "12/34"},
+		ReasonCode: Reauthenticate,
+	}
+
+	testTable := map[int]error{
+		http.StatusNoContent:           nil,
+		http.StatusNotFound:            nil,
+		http.StatusUnauthorized:        ErrBrokerUnauthorized,
+		http.StatusForbidden:           ErrBrokerUnauthorized,
+		http.StatusServiceUnavailable:  ErrBrokerUnavailable,
+		http.StatusInternalServerError: ErrBrokerUnavailable,
+	}
+	for code, expected := range testTable {
+		status = code
+		assert.Equal(t, ds.Disconnect(context.Background(), req), expected)
+		assert.Equal(t, gotMethod, http.MethodDelete)
+		assert.Equal(t, gotPath, "/api/v5/clients/veh-12%2F34")
+		assert.Equal(t, gotAuth, "Bearer test.test")
+	}
+	status = http.StatusBadRequest
+	assert.ErrorContains(t, ds.Disconnect(context.Background(), req), "unexpected management api response 400")
+}
+
+func TestRESTDisconnectTemplate(t *testing.T) {
+	var gotMethod, gotPath, gotUser, gotPassword string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotMethod, gotPath = req.Method, req.URL.Path
+		gotUser, gotPassword, _ = req.BasicAuth()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ds, err := NewRESTDisconnecter(MQTTSettings{
+		REST: RESTSettings{
+			Server:           srv.URL,
+			Method:           "delete",
+			Endpoint:         "/api/v1/mqtt/clients/{clientid}",
+			ClientIDTemplate: "{{.EntityID}}@{{.Entity}}",
+			AuthType:         RESTBasicAuth,
+			AuthFile:         "./test/auth/authFile",
+		},
+	})
+	assert.NilError(t, err)
+	err = ds.Disconnect(context.Background(), DisconnectRequest{
+		EntityPair: EntityPair{Entity: "sw", EntityID: "99"},
+		ReasonCode: Handover,
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, gotMethod, http.MethodDelete)
+	assert.Equal(t, gotPath, "/api/v1/mqtt/clients/99@sw")
+	assert.Equal(t, gotUser, "user")
+	assert.Equal(t, gotPassword, "password")
+}
+
+func TestRESTSettingsValidate(t *testing.T) {
+	testTable := map[string]RESTSettings{
+		"endpoint must contain {clientid}":   {Server: "http://emqx", Endpoint: "/api/v5/clients"},
+		"invalid client id template":         {Server: "http://emqx", ClientIDTemplate: "{{.Entity"},
+		"missing management api auth file":   {Server: "http://emqx", AuthType: RESTBasicAuth},
+		"auth type is not supported, apikey": {Server: "http://emqx", AuthType: "apikey"},
+	}
+	for k, v := range testTable {
+		assert.ErrorContains(t, v.validate(), k)
+	}
+	assert.NilError(t, RESTSettings{Server: "http://emqx"}.validate())
+
+	// brokers bring their own server so it's only needed when the disconnecter is created
+	assert.NilError(t, RESTSettings{}.validate())
+	_, err := NewRESTDisconnecter(MQTTSettings{})
+	assert.ErrorContains(t, err, "missing management api server")
+}
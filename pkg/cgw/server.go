@@ -4,10 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -16,109 +15,193 @@ import (
 
 // CAASGateway is the gateway to caas
 type CAASGateway struct {
-	port                  string
-	readTO                time.Duration
-	writeTO               time.Duration
-	handlerTO             time.Duration
-	maxHeaderBytes        int
-	token                 string
-	caasCreateURL         string
-	caasDeleteEntityIDURL string
-	upstreamReasonCodes   map[ReasonCode]bool
-	kv                    RedisStore
-	disconnecter          Disconnecter
-	mecID                 string
-	debugSettings         DebugSettings
-	requestLog            []interface{}
-	StopSignal            chan struct{}
+	port            string
+	readTO          time.Duration
+	writeTO         time.Duration
+	maxHeaderBytes  int
+	token           *BearerToken
+	expiry          ExpirySettings
+	refresh         RefreshSettings
+	kv              KeyValueStore
+	disconnecter    Disconnecter
+	certs           *certReloader
+	auth            *Authenticator
+	metricsEndpoint string
+	ready           *readinessProbe
+	handover        *HandoverClient
+	limiter         *RateLimiter
+	idle            *IdleTracker
+	bulkJobs        *BulkJobs
+	hasher          *TokenHasher
+	bulkConcurrency int
+	reloader        *reloader
+	live            atomic.Value
+	state           *gatewayState
+	StopSignal      chan struct{}
 }
 
-// NewCAASGateway creates a new gateway instance
-func NewCAASGateway(cfgPath string, redis RedisStore, disconnecter Disconnecter) (CAASGateway, error) {
+// NewCAASGateway creates a new gateway instance, overrides are the config flags
+// applied on top of the config file and environment
+func NewCAASGateway(cfgPath string, overrides Overrides, kv KeyValueStore, disconnecter Disconnecter) (*CAASGateway, error) {
 	// read yaml configuration file and create mqtt disconnector
-	cfg, err := NewConfig(cfgPath)
+	cfg, err := LoadConfig(cfgPath, overrides)
 	if err != nil {
 		ErrorLog("unable to parse config file %s", cfgPath)
-		return CAASGateway{}, fmt.Errorf("unable to parse config file, %s", err)
+		return nil, fmt.Errorf("unable to parse config file, %s", err)
 	}
-
-	caasGW := CAASGateway{
-		port:           cfg.Port,
-		readTO:         time.Duration(cfg.ReadTimeout) * time.Millisecond,
-		writeTO:        time.Duration(cfg.WriteTimeout) * time.Millisecond,
-		handlerTO:      time.Duration(cfg.HandlerTimeout) * time.Millisecond,
-		maxHeaderBytes: cfg.MaxHeaderBytes,
-		mecID:          cfg.MECID,
+	if dump, err := DumpConfig(cfg); err == nil {
+		DebugLog("effective config:\n%s", dump)
 	}
 
-	// set endpoints
-	caasGW.caasCreateURL, err = URLJoin(cfg.CAAS.Server, cfg.CAAS.CreateEndpoint)
-	if err != nil {
-		ErrorLog("unable to join get caas validate url %s, %s",
-			cfg.CAAS.Server, cfg.CAAS.CreateEndpoint)
-		return CAASGateway{}, fmt.Errorf("unable to caas validate url, %s", err)
+	caasGW := &CAASGateway{
+		port:            cfg.Port,
+		readTO:          time.Duration(cfg.ReadTimeout) * time.Millisecond,
+		writeTO:         time.Duration(cfg.WriteTimeout) * time.Millisecond,
+		maxHeaderBytes:  cfg.MaxHeaderBytes,
+		expiry:          cfg.Expiry,
+		refresh:         cfg.Refresh,
+		metricsEndpoint: cfg.MetricsEndpoint,
 	}
-	caasGW.caasDeleteEntityIDURL, err = URLJoin(cfg.CAAS.Server, cfg.CAAS.DeleteEndpoint)
-	if err != nil {
-		ErrorLog("unable to join caas delete entityid url %s, %s",
-			cfg.CAAS.Server, cfg.CAAS.DeleteEndpoint)
-		return CAASGateway{}, fmt.Errorf("unable to join caas delete entityid url, %s", err)
+	if IsEmpty(caasGW.metricsEndpoint) {
+		caasGW.metricsEndpoint = defaultMetricsEndpoint
 	}
 
-	// read token file
-	tFile, err := os.Open(cfg.TokenFile)
+	// keep one client for caas so connections are pooled and failures are tracked
+	caas, err := NewCAASClient(cfg.CAAS)
 	if err != nil {
-		msg := fmt.Sprintf("can't open the token file, %s", cfg.TokenFile)
+		msg := fmt.Sprintf("can't create caas client, %s", err)
 		ErrorLog(msg)
-		return CAASGateway{}, errors.New(msg)
+		return nil, errors.New(msg)
 	}
-	defer tFile.Close()
-	tBytes, err := ioutil.ReadAll(tFile)
+
+	// get the bearer token from the token file or oauth2
+	caasGW.token, err = NewBearerToken(cfg)
 	if err != nil {
-		msg := fmt.Sprintf("can't read the token file, %s", cfg.TokenFile)
+		msg := fmt.Sprintf("can't get bearer token, %s", err)
 		ErrorLog(msg)
-		return CAASGateway{}, errors.New(msg)
+		return nil, errors.New(msg)
 	}
-	if IsEmpty(string(tBytes)) {
-		msg := "token is empty"
-		ErrorLog(msg)
-		return CAASGateway{}, errors.New(msg)
-	}
-	caasGW.token = string(tBytes)
 
-	// set upstream reasoncodes
-	caasGW.upstreamReasonCodes = map[ReasonCode]bool{}
-	for _, rc := range cfg.UpstreamReasonCode {
-		caasGW.upstreamReasonCodes[rc] = true
+	// settings that can be swapped by a reload, like the upstream reasoncodes
+	caasHealth, err := newCAASHealthPinger(cfg.CAAS, cfg.Health)
+	if err != nil {
+		return nil, err
 	}
+	caasGW.setSettings(newLiveSettings(cfg, caas, caasHealth))
 
-	// assign disconnecter and redis to gateway, if not passed in
+	// assign disconnecter and store to gateway, if not passed in
 	if disconnecter == nil {
-		caasGW.disconnecter, err = NewMQTTDisconnecter(cfg.MQTT, caasGW.token)
+		caasGW.disconnecter, err = NewDisconnecter(cfg.Disconnecter, cfg.MQTT, caasGW.token.Get())
 		if err != nil {
 			msg := fmt.Sprintf("can't create disconnecter, %s", err)
 			ErrorLog(msg)
-			return CAASGateway{}, errors.New(msg)
+			return nil, errors.New(msg)
 		}
 	} else {
 		caasGW.disconnecter = disconnecter
 	}
 
-	if redis == (RedisStore{}) {
-		caasGW.kv, err = NewRedisStore(cfg.Redis)
+	if kv == nil {
+		caasGW.kv, err = NewKeyValueStore(cfg.Store, cfg.Redis)
 		if err != nil {
-			msg := fmt.Sprintf("can't create redis store, %s", err)
+			msg := fmt.Sprintf("can't create %s store, %s", cfg.Store, err)
 			ErrorLog(msg)
-			return CAASGateway{}, errors.New(msg)
+			return nil, errors.New(msg)
 		}
 	} else {
-		caasGW.kv = redis
+		caasGW.kv = kv
+	}
+
+	// readiness checks use the unwrapped disconnecter so broker pings aren't counted as disconnects
+	// and the caas check reads the live settings so it follows reloads of the caas server
+	checks := map[string]Pinger{
+		"redis": caasGW.kv,
+		"caas": PingerFunc(func(ctx context.Context) error {
+			return caasGW.settings().caasHealth.Ping(ctx)
+		}),
+	}
+	if pinger, ok := caasGW.disconnecter.(Pinger); ok && cfg.Health.CheckMQTT {
+		checks["mqtt"] = pinger
+	}
+	caasGW.ready = newReadinessProbe(cfg.Health, checks)
+	caasGW.disconnecter = metricsDisconnecter{caasGW.disconnecter}
+
+	// limit requests per entity pair when enabled
+	if cfg.RateLimit.Enabled {
+		caasGW.limiter, err = NewRateLimiter(cfg.RateLimit, caasGW.kv,
+			func(ctx context.Context, ep EntityPair, rc ReasonCode) (bool, error) {
+				return caasGW.removeEntity(ctx, ep, rc, nil)
+			})
+		if err != nil {
+			msg := fmt.Sprintf("can't create rate limiter, %s", err)
+			ErrorLog(msg)
+			return nil, errors.New(msg)
+		}
+	}
+
+	// track activity to disconnect idle entities when enabled
+	if cfg.Idle.Enabled {
+		caasGW.idle, err = NewIdleTracker(cfg.Idle, caasGW.kv)
+		if err != nil {
+			msg := fmt.Sprintf("can't create idle tracker, %s", err)
+			ErrorLog(msg)
+			return nil, errors.New(msg)
+		}
+	}
+
+	// hash tokens at rest when enabled
+	if cfg.TokenHash.Enabled {
+		caasGW.hasher, err = NewTokenHasher(cfg.TokenHash)
+		if err != nil {
+			msg := fmt.Sprintf("can't create token hasher, %s", err)
+			ErrorLog(msg)
+			return nil, errors.New(msg)
+		}
+	}
+
+	// keep track of bulk disconnects
+	caasGW.bulkJobs = NewBulkJobs(cfg.Bulk)
+	caasGW.bulkConcurrency = cfg.Bulk.Concurrency
+	if caasGW.bulkConcurrency <= 0 {
+		caasGW.bulkConcurrency = defaultBulkConcurrency
+	}
+
+	// load certificates when serving tls
+	if cfg.TLS.Enabled() {
+		caasGW.certs, err = newCertReloader(cfg.TLS)
+		if err != nil {
+			msg := fmt.Sprintf("can't load tls certificates, %s", err)
+			ErrorLog(msg)
+			return nil, errors.New(msg)
+		}
 	}
-	caasGW.debugSettings = cfg.DebugSettings
-	if caasGW.debugSettings.DebugLog {
-		caasGW.requestLog = make([]interface{}, 0)
+
+	// hand entities over to the next gateway when enabled
+	if cfg.Handover.Enabled {
+		caasGW.handover, err = NewHandoverClient(cfg.Handover)
+		if err != nil {
+			msg := fmt.Sprintf("can't create handover client, %s", err)
+			ErrorLog(msg)
+			return nil, errors.New(msg)
+		}
 	}
 
+	// authenticate callers when enabled
+	if cfg.Auth.Enabled {
+		caasGW.auth, err = NewAuthenticator(cfg.Auth)
+		if err != nil {
+			msg := fmt.Sprintf("can't create authenticator, %s", err)
+			ErrorLog(msg)
+			return nil, errors.New(msg)
+		}
+	}
+
+	// handlers and debug endpoints change the state concurrently
+	caasGW.state = newGatewayState(cfg.MECID, cfg.DebugSettings.DebugLog)
+
+	// keep the loaded config so reloads can tell what changed
+	caasGW.reloader = newReloader(cfgPath, overrides, cfg)
+
 	// stop signal
 	caasGW.StopSignal = make(chan struct{})
 	return caasGW, nil
@@ -126,45 +209,37 @@ func NewCAASGateway(cfgPath string, redis RedisStore, disconnecter Disconnecter)
 
 // AppendLog adds log to log history
 func (cgw *CAASGateway) AppendLog(key string, data interface{}) {
-	// append to request log
-	if cgw.debugSettings.DebugLog {
-		cgw.requestLog = append(cgw.requestLog, map[string]interface{}{
-			key: data,
-		})
-	}
+	cgw.state.AppendLog(key, data)
 }
 
 // ClearLogs erases logs
 func (cgw *CAASGateway) ClearLogs() {
-	if cgw.debugSettings.DebugLog {
-		cgw.requestLog = make([]interface{}, 0)
-	}
+	cgw.state.ClearLogs()
 }
 
 // GetLogs retrieves logs from log history
 func (cgw *CAASGateway) GetLogs() []interface{} {
-	// append to request log
-	return cgw.requestLog
+	return cgw.state.Logs()
 }
 
 // GetToken reads token
 func (cgw *CAASGateway) GetToken() string {
-	return cgw.token
+	return cgw.token.Get()
 }
 
 // SetToken writes token
 func (cgw *CAASGateway) SetToken(token string) {
-	cgw.token = token
+	cgw.token.Set(token)
 }
 
 // GetMEC reads MEC
 func (cgw *CAASGateway) GetMEC() string {
-	return cgw.mecID
+	return cgw.state.MEC()
 }
 
 // SetMEC writes to the MEC field
 func (cgw *CAASGateway) SetMEC(mec string) {
-	cgw.mecID = mec
+	cgw.state.SetMEC(mec)
 }
 
 // StartServer serves the ds service
@@ -172,88 +247,69 @@ func (cgw *CAASGateway) StartServer() {
 	httpServerExitDone := &sync.WaitGroup{}
 	httpServerExitDone.Add(1)
 
-	// define routing scheme
-	router := mux.NewRouter()
-	createTokenHandle := createNewTokenHandler(cgw.kv, cgw.caasCreateURL, cgw.GetMEC, cgw.GetToken)
-	disconnectHandle := disconnectHandler(cgw.disconnecter, cgw.kv,
-		cgw.caasDeleteEntityIDURL, cgw.upstreamReasonCodes, cgw.GetMEC, cgw.GetToken)
-
-	router.Handle("/cgw/v1/token",
-		http.TimeoutHandler(
-			jsonDecodeHandler(EntityTokenReq, redisLockHandler(cgw.kv, cgw.handlerTO, createTokenHandle), cgw.AppendLog),
-			cgw.handlerTO, "Timed out processing request")).Methods("POST")
-
-	router.Handle("/cgw/v1/token/validate",
-		http.TimeoutHandler(
-			jsonDecodeHandler(EntityTokenReq,
-				redisLockHandler(cgw.kv, cgw.handlerTO,
-					validateTokenHandler(cgw.kv)), cgw.AppendLog),
-			cgw.handlerTO, "Timed out processing request")).Methods("POST")
-
-	router.Handle("/cgw/v1/token/refresh",
-		http.TimeoutHandler(
-			jsonDecodeHandler(EntityTokenReq,
-				redisLockHandler(cgw.kv, cgw.handlerTO,
-					refreshTokenHandler(cgw.kv)), cgw.AppendLog),
-			cgw.handlerTO, "Timed out processing request")).Methods("POST")
+	// background workers run until the server is stopped
+	bgCtx, stopBackground := context.WithCancel(context.Background())
 
-	router.Handle("/cgw/v1/disconnect",
-		http.TimeoutHandler(
-			jsonDecodeHandler(DisconnectionReq,
-				redisLockHandler(cgw.kv, cgw.handlerTO, disconnectHandle), cgw.AppendLog),
-			cgw.handlerTO, "Timed out processing request")).Methods("POST")
-
-	if cgw.debugSettings != (DebugSettings{}) {
-		flushURL := cgw.debugSettings.FlushEndpoint
-		tokenURL := cgw.debugSettings.TokenEndpoint
-		mecURL := cgw.debugSettings.MECEndpoint
-		reqURL := cgw.debugSettings.ReqLogEndpoint
-
-		if !IsEmpty(flushURL) {
-			DebugLog("debug flush endpoint is enabled, %s", flushURL)
-			router.Handle(flushURL, http.TimeoutHandler(flushHandler(cgw.kv),
-				cgw.handlerTO, "Timed out processing request")).Methods("POST")
-		}
-
-		if !IsEmpty(tokenURL) {
-			DebugLog("debug token endpoint is enabled, %s", tokenURL)
-			router.Handle(tokenURL, http.TimeoutHandler(setTokenHandler(cgw.SetToken),
-				cgw.handlerTO, "Timed out processing request")).Methods("GET")
-		}
-
-		if !IsEmpty(mecURL) {
-			DebugLog("debug mec endpoint is enabled, %s", mecURL)
-			router.Handle(mecURL, http.TimeoutHandler(setMECHandler(cgw.SetMEC),
-				cgw.handlerTO, "Timed out processing request")).Methods("GET")
-		}
-
-		if !IsEmpty(reqURL) {
-			DebugLog("debug disconnection info endpoint is enabled, %s", reqURL)
-			router.Handle(reqURL, http.TimeoutHandler(getReqLogHandler(cgw.GetLogs),
-				cgw.handlerTO, "Timed out processing request")).Methods("GET")
-			router.Handle(reqURL, http.TimeoutHandler(delReqLogHandler(cgw.ClearLogs),
-				cgw.handlerTO, "Timed out processing request")).Methods("DELETE")
-		}
+	// route requests through the reloader so config changes swap the router
+	var handler http.Handler
+	if cgw.reloader != nil {
+		handler = cgw.serve(bgCtx)
+	} else {
+		handler = cgw.routes(bgCtx)
 	}
 
 	// create server instance
 	srv := &http.Server{
 		Addr:           ":" + cgw.port,
-		Handler:        router,
+		Handler:        handler,
 		ReadTimeout:    cgw.readTO,
 		WriteTimeout:   cgw.writeTO,
 		MaxHeaderBytes: cgw.maxHeaderBytes,
 	}
 
+	// expire lapsed tokens in the background
+	go cgw.sweepExpired(bgCtx)
+
+	// move existing tokens to the current hash key
+	if cgw.hasher != nil {
+		go cgw.migrateTokens(bgCtx)
+	}
+
+	// disconnect idle entities in the background
+	if cgw.idle != nil {
+		go cgw.sweepIdle(bgCtx)
+	}
+
+	// keep the bearer token up to date
+	go cgw.token.watch(bgCtx)
+
+	// reload the config when the file changes
+	if cgw.reloader != nil && cgw.reloader.watchInterval() > 0 {
+		go cgw.watchConfig(bgCtx, cgw.reloader.watchInterval())
+	}
+
+	// serve tls with certificates reloaded from disk
+	if cgw.certs != nil {
+		srv.TLSConfig = cgw.certs.TLSConfig()
+		go cgw.certs.watch(bgCtx)
+	}
+
 	go func() {
 		defer httpServerExitDone.Done()
 		// start server
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		var err error
+		if cgw.certs != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			log.Fatal().Msgf("ListenAndServe() failed: %+v", err)
 		}
 	}()
 
 	<-cgw.StopSignal
+	stopBackground()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -263,3 +319,148 @@ func (cgw *CAASGateway) StartServer() {
 	httpServerExitDone.Wait()
 	log.Info().Msg("finished shutting down server")
 }
+
+// routes builds the router from the current settings, bgCtx is used by work
+// that outlives the request
+func (cgw *CAASGateway) routes(bgCtx context.Context) http.Handler {
+	// every route uses the same snapshot of the settings
+	ls := cgw.settings()
+	router := mux.NewRouter()
+	createTokenHandle := createNewTokenHandler(cgw.kv, cgw.expiry, cgw.hasher, ls.caas, cgw.GetMEC, cgw.GetToken)
+	disconnectHandle := disconnectHandler(cgw.disconnecter, cgw.kv,
+		ls.caas, ls.upstreamReasonCodes, cgw.GetMEC, cgw.GetToken, cgw.handover, cgw.hasher)
+	var rotate rotateTokenCb
+	if cgw.refresh.NotifyCAAS {
+		rotate = caasRotateToken(ls.caas, cgw.GetMEC, cgw.GetToken)
+	}
+
+	router.Handle("/cgw/v1/token", instrumentHandler("/cgw/v1/token",
+		http.TimeoutHandler(
+			authenticateHandler(cgw.auth,
+				jsonDecodeHandler(EntityTokenReq,
+					authorizeHandler(cgw.auth, CreateRoute,
+						rateLimitHandler(cgw.limiter, CreateRoute,
+							redisLockHandler(cgw.kv, ls.handlerTO, createTokenHandle))), cgw.AppendLog)),
+			ls.handlerTO, "Timed out processing request"))).Methods("POST")
+
+	router.Handle("/cgw/v1/token/validate", instrumentHandler("/cgw/v1/token/validate",
+		http.TimeoutHandler(
+			authenticateHandler(cgw.auth,
+				jsonDecodeHandler(EntityTokenReq,
+					authorizeHandler(cgw.auth, ValidateRoute,
+						rateLimitHandler(cgw.limiter, ValidateRoute,
+							redisLockHandler(cgw.kv, ls.handlerTO,
+								validateTokenHandler(cgw.kv, cgw.hasher, cgw.idle)))), cgw.AppendLog)),
+			ls.handlerTO, "Timed out processing request"))).Methods("POST")
+
+	router.Handle("/cgw/v1/token/refresh", instrumentHandler("/cgw/v1/token/refresh",
+		http.TimeoutHandler(
+			authenticateHandler(cgw.auth,
+				jsonDecodeHandler(RefreshTokenReq,
+					authorizeHandler(cgw.auth, RefreshRoute,
+						rateLimitHandler(cgw.limiter, RefreshRoute,
+							redisLockHandler(cgw.kv, ls.handlerTO,
+								refreshTokenHandler(cgw.kv, cgw.expiry, cgw.hasher, cgw.idle, cgw.refresh, rotate)))), cgw.AppendLog)),
+			ls.handlerTO, "Timed out processing request"))).Methods("POST")
+
+	router.Handle("/cgw/v1/disconnect", instrumentHandler("/cgw/v1/disconnect",
+		http.TimeoutHandler(
+			authenticateHandler(cgw.auth,
+				jsonDecodeHandler(DisconnectionReq,
+					authorizeHandler(cgw.auth, DisconnectRoute,
+						rateLimitHandler(cgw.limiter, DisconnectRoute,
+							redisLockHandler(cgw.kv, ls.handlerTO, disconnectHandle))), cgw.AppendLog)),
+			ls.handlerTO, "Timed out processing request"))).Methods("POST")
+
+	// bulk jobs outlive the request that started them
+	router.Handle(BulkDisconnectEndpoint, instrumentHandler(BulkDisconnectEndpoint,
+		http.TimeoutHandler(
+			authenticateHandler(cgw.auth,
+				jsonDecodeHandler(BulkDisconnectReq,
+					authorizeHandler(cgw.auth, BulkRoute,
+						bulkDisconnectHandler(cgw.bulkJobs, func(id string, req BulkDisconnectRequest) {
+							cgw.runBulkDisconnect(bgCtx, id, req)
+						})), cgw.AppendLog)),
+			ls.handlerTO, "Timed out processing request"))).Methods("POST")
+
+	bulkJobEndpoint := BulkDisconnectEndpoint + "/{id}"
+	router.Handle(bulkJobEndpoint, instrumentHandler(bulkJobEndpoint,
+		http.TimeoutHandler(
+			authenticateHandler(cgw.auth,
+				authorizeHandler(cgw.auth, BulkRoute, bulkJobHandler(cgw.bulkJobs))),
+			ls.handlerTO, "Timed out processing request"))).Methods("GET")
+
+	entityEndpoint := EntitiesEndpoint + "/{entity}/{entityid}"
+	router.Handle(EntitiesEndpoint, instrumentHandler(EntitiesEndpoint,
+		http.TimeoutHandler(
+			authenticateHandler(cgw.auth,
+				authorizeHandler(cgw.auth, EntitiesRoute, listEntitiesHandler(cgw.kv, cgw.GetMEC))),
+			ls.handlerTO, "Timed out processing request"))).Methods("GET")
+	router.Handle(entityEndpoint, instrumentHandler(entityEndpoint,
+		http.TimeoutHandler(
+			authenticateHandler(cgw.auth,
+				authorizeHandler(cgw.auth, EntitiesRoute, getEntityHandler(cgw.kv, cgw.GetMEC))),
+			ls.handlerTO, "Timed out processing request"))).Methods("GET")
+
+	if breaker, ok := ls.caas.(BreakerReporter); ok {
+		router.Handle(CAASBreakerEndpoint, instrumentHandler(CAASBreakerEndpoint,
+			http.TimeoutHandler(
+				authenticateHandler(cgw.auth,
+					authorizeHandler(cgw.auth, CAASRoute, caasBreakerHandler(breaker))),
+				ls.handlerTO, "Timed out processing request"))).Methods("GET")
+	}
+
+	// handovers are accepted on the endpoint peers push to
+	if cgw.handover != nil {
+		handoverURL := cgw.handover.endpoint
+		router.Handle(handoverURL, instrumentHandler(handoverURL,
+			http.TimeoutHandler(
+				authenticateHandler(cgw.auth,
+					handoverPeerHandler(cgw.auth, cgw.handover,
+						jsonDecodeHandler(HandoverReq,
+							authorizeHandler(cgw.auth, HandoverRoute,
+								redisLockHandler(cgw.kv, ls.handlerTO,
+									handoverHandler(cgw.kv, cgw.hasher, cgw.GetMEC))), cgw.AppendLog))),
+				ls.handlerTO, "Timed out processing request"))).Methods("POST")
+	}
+
+	router.Handle(cgw.metricsEndpoint, metricsHandler()).Methods("GET")
+	router.Handle(LivenessEndpoint, livenessHandler()).Methods("GET")
+	router.Handle(ReadinessEndpoint, readinessHandler(cgw.ready)).Methods("GET")
+
+	if ls.debugSettings != (DebugSettings{}) {
+		flushURL := ls.debugSettings.FlushEndpoint
+		tokenURL := ls.debugSettings.TokenEndpoint
+		mecURL := ls.debugSettings.MECEndpoint
+		reqURL := ls.debugSettings.ReqLogEndpoint
+
+		// debug endpoints are restricted to the debug policy
+		debugHandler := func(url string, next http.HandlerFunc) http.Handler {
+			return instrumentHandler(url, http.TimeoutHandler(
+				authenticateHandler(cgw.auth, authorizeHandler(cgw.auth, DebugRoute, next)),
+				ls.handlerTO, "Timed out processing request"))
+		}
+
+		if !IsEmpty(flushURL) {
+			DebugLog("debug flush endpoint is enabled, %s", flushURL)
+			router.Handle(flushURL, debugHandler(flushURL, flushHandler(cgw.kv))).Methods("POST")
+		}
+
+		if !IsEmpty(tokenURL) {
+			DebugLog("debug token endpoint is enabled, %s", tokenURL)
+			router.Handle(tokenURL, debugHandler(tokenURL, setTokenHandler(cgw.SetToken))).Methods("GET")
+		}
+
+		if !IsEmpty(mecURL) {
+			DebugLog("debug mec endpoint is enabled, %s", mecURL)
+			router.Handle(mecURL, debugHandler(mecURL, setMECHandler(cgw.SetMEC))).Methods("GET")
+		}
+
+		if !IsEmpty(reqURL) {
+			DebugLog("debug disconnection info endpoint is enabled, %s", reqURL)
+			router.Handle(reqURL, debugHandler(reqURL, getReqLogHandler(cgw.GetLogs))).Methods("GET")
+			router.Handle(reqURL, debugHandler(reqURL, delReqLogHandler(cgw.ClearLogs))).Methods("DELETE")
+		}
+	}
+	return router
+}
@@ -2,9 +2,11 @@ package cgw
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,26 +15,55 @@ import (
 
 func TestNewGateway(t *testing.T) {
 	ds := &dsMock{}
-	cgw, err := NewCAASGateway("./test/config/cgw.yaml", gw.kv, ds)
+	cgw, err := NewCAASGateway("./test/config/cgw.yaml", nil, gw.kv, ds)
 	assert.NilError(t, err)
 	assert.Equal(t, cgw.port, "8080")
-	assert.Equal(t, cgw.mecID, "rkln")
+	assert.Equal(t, cgw.GetMEC(), "rkln")
 	assert.Equal(t, cgw.readTO, 1000*time.Millisecond)
 	assert.Equal(t, cgw.writeTO, 5000*time.Millisecond)
-	assert.Equal(t, cgw.handlerTO, 4000*time.Millisecond)
+	assert.Equal(t, cgw.settings().handlerTO, 4000*time.Millisecond)
 	assert.Equal(t, cgw.maxHeaderBytes, 1000)
-	assert.Equal(t, cgw.token, "test.test")
-	assert.Equal(t, cgw.caasCreateURL, "http://localhost:9090/caas/v1/token/entity")
-	assert.Equal(t, cgw.caasDeleteEntityIDURL, "http://localhost:9090/caas/v1/token/entity/delete")
-	assert.Equal(t, cgw.upstreamReasonCodes[0x98], true)
-	assert.Equal(t, cgw.upstreamReasonCodes[0x87], true)
+	assert.Equal(t, cgw.GetToken(), "test.test")
+	caas, ok := cgw.settings().caas.(*caasV1Client)
+	assert.Assert(t, ok)
+	assert.Equal(t, caas.createURL, "http://localhost:9090/caas/v1/token/entity")
+	assert.Equal(t, caas.deleteURL, "http://localhost:9090/caas/v1/token/entity/delete")
+	assert.Equal(t, cgw.settings().upstreamReasonCodes[0x98], true)
+	assert.Equal(t, cgw.settings().upstreamReasonCodes[0x87], true)
+}
+
+// releaseNotifyStore signals every released lock so tests can wait for
+// handlers that keep running after their request timed out
+type releaseNotifyStore struct {
+	KeyValueStore
+	released chan struct{}
+}
+
+func (rs releaseNotifyStore) Lock(ctx context.Context, key string, ttl time.Duration) (KeyLock, error) {
+	lock, err := rs.KeyValueStore.Lock(ctx, key, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return releaseNotifyLock{lock, rs.released}, nil
+}
+
+type releaseNotifyLock struct {
+	KeyLock
+	released chan struct{}
+}
+
+func (rl releaseNotifyLock) Release(ctx context.Context) error {
+	defer func() { rl.released <- struct{}{} }()
+	return rl.KeyLock.Release(ctx)
 }
 
 func TestStartServer(t *testing.T) {
 	ds := &dsMock{}
-	cgw, err := NewCAASGateway("./test/config/cgw.yaml", gw.kv, ds)
+	kv := releaseNotifyStore{gw.kv, make(chan struct{}, 16)}
+	cgw, err := NewCAASGateway("./test/config/cgw.yaml", nil, kv, ds)
 	assert.NilError(t, err)
 	go cgw.StartServer()
+	waitForServer("localhost:8080")
 	defer func() {
 		sm.ClearDB()
 		cgw.StopSignal <- struct{}{}
@@ -49,15 +80,15 @@ func TestStartServer(t *testing.T) {
 		assert.NilError(t, err)
 
 		// check create new token
-		redMock.Regexp().ExpectSetNX("lock:veh-1234", `[a-z1-9]*`, cgw.handlerTO).SetVal(true)
-		redMock.ExpectSet("veh-1234", "test.test", 0).SetVal("")
+		redMock.Regexp().ExpectSetNX("lock:veh-1234", `[a-z1-9]*`, cgw.settings().handlerTO).SetVal(true)
+		redMock.Regexp().ExpectSet("veh-1234", `\{"entity":"veh","entityid":"1234","token":"test\.test","createdAt":[0-9]+,"mec":"rkln"\}`, 0).SetVal("")
 		defer redMock.ClearExpect()
 		resp, err := http.Post("http://localhost:8080/cgw/v1/token", "application/json", bytes.NewBuffer(jBytes))
 		assert.NilError(t, err)
 		assert.Equal(t, resp.StatusCode, http.StatusOK)
 
 		// validate credentials
-		redMock.Regexp().ExpectSetNX("lock:veh-1234", `[a-z1-9]*`, cgw.handlerTO).SetVal(true)
+		redMock.Regexp().ExpectSetNX("lock:veh-1234", `[a-z1-9]*`, cgw.settings().handlerTO).SetVal(true)
 		redMock.ExpectGet("veh-1234").SetVal("test.test")
 		defer redMock.ClearExpect()
 		resp, err = http.Post("http://localhost:8080/cgw/v1/token/validate", "application/json", bytes.NewBuffer(jBytes))
@@ -65,11 +96,13 @@ func TestStartServer(t *testing.T) {
 		assert.Equal(t, resp.StatusCode, http.StatusOK)
 
 		// // refresh credentials
-		redMock.Regexp().ExpectSetNX("lock:veh-1234", `[a-z1-9]*`, cgw.handlerTO).SetVal(true)
-		redMock.ExpectExists("veh-1234").SetVal(1)
-		redMock.ExpectSet("veh-1234", "test.test", 0).SetVal("")
+		rBytes, err := json.Marshal(RefreshTokenRequest{EntityTokenRequest: etr, OldToken: "test.test"})
+		assert.NilError(t, err)
+		redMock.Regexp().ExpectSetNX("lock:veh-1234", `[a-z1-9]*`, cgw.settings().handlerTO).SetVal(true)
+		redMock.ExpectGet("veh-1234").SetVal("test.test")
+		redMock.Regexp().ExpectSet("veh-1234", `\{"entity":"veh","entityid":"1234","token":"test\.test","refreshedAt":[0-9]+\}`, 0).SetVal("")
 		defer redMock.ClearExpect()
-		resp, err = http.Post("http://localhost:8080/cgw/v1/token/refresh", "application/json", bytes.NewBuffer(jBytes))
+		resp, err = http.Post("http://localhost:8080/cgw/v1/token/refresh", "application/json", bytes.NewBuffer(rBytes))
 		assert.NilError(t, err)
 		assert.Equal(t, resp.StatusCode, http.StatusOK)
 
@@ -84,7 +117,7 @@ func TestStartServer(t *testing.T) {
 		}
 		jBytes, err = json.Marshal(dr)
 		assert.NilError(t, err)
-		redMock.Regexp().ExpectSetNX("lock:veh-1234", `[a-z1-9]*`, cgw.handlerTO).SetVal(true)
+		redMock.Regexp().ExpectSetNX("lock:veh-1234", `[a-z1-9]*`, cgw.settings().handlerTO).SetVal(true)
 		redMock.ExpectGet("veh-1234").SetVal("test.test")
 		redMock.ExpectDel("veh-1234").SetVal(1)
 		defer redMock.ClearExpect()
@@ -93,6 +126,16 @@ func TestStartServer(t *testing.T) {
 		assert.Equal(t, resp.StatusCode, http.StatusOK)
 	})
 
+	t.Run("metrics", func(t *testing.T) {
+		resp, err := http.Get("http://localhost:8080/metrics")
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NilError(t, err)
+		assert.Assert(t, strings.Contains(string(body), `cgw_http_requests_total{code="200",route="/cgw/v1/token"}`))
+		assert.Assert(t, strings.Contains(string(body), `cgw_caas_request_duration_seconds_count{code="200",operation="create"}`))
+	})
+
 	t.Run("timeout", func(t *testing.T) {
 		etr := &EntityTokenRequest{
 			Token: "sleep.test",
@@ -101,8 +144,13 @@ func TestStartServer(t *testing.T) {
 				EntityID: "1234",
 			},
 		}
-		redMock.Regexp().ExpectSetNX("lock:veh-1234", `[a-z1-9]*`, cgw.handlerTO).SetVal(true)
+		redMock.Regexp().ExpectSetNX("lock:veh-1234", `[a-z1-9]*`, cgw.settings().handlerTO).SetVal(true)
 		defer redMock.ClearExpect()
+		// the timed out handler still releases its lock, let it finish before the mock is cleared
+		for len(kv.released) > 0 {
+			<-kv.released
+		}
+		defer func() { <-kv.released }()
 		jBytes, err := json.Marshal(etr)
 		assert.NilError(t, err)
 		resp, err := http.Post("http://localhost:8080/cgw/v1/token", "application/json", bytes.NewBuffer(jBytes))
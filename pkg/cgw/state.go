@@ -0,0 +1,72 @@
+package cgw
+
+import "sync"
+
+// gatewayState is the gateway state that changes while requests are served,
+// the debug endpoints and handlers share it so every access goes through the lock
+type gatewayState struct {
+	mu         sync.RWMutex
+	mecID      string
+	debugLog   bool
+	requestLog []interface{}
+}
+
+// newGatewayState creates the state, requests are only logged when debugLog is set
+func newGatewayState(mecID string, debugLog bool) *gatewayState {
+	return &gatewayState{
+		mecID:      mecID,
+		debugLog:   debugLog,
+		requestLog: make([]interface{}, 0),
+	}
+}
+
+// MEC reads the mec id
+func (gs *gatewayState) MEC() string {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return gs.mecID
+}
+
+// SetMEC writes the mec id
+func (gs *gatewayState) SetMEC(mec string) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.mecID = mec
+}
+
+// AppendLog adds an entry to the request log
+func (gs *gatewayState) AppendLog(key string, data interface{}) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if gs.debugLog {
+		gs.requestLog = append(gs.requestLog, map[string]interface{}{
+			key: data,
+		})
+	}
+}
+
+// ClearLogs erases the request log
+func (gs *gatewayState) ClearLogs() {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.requestLog = make([]interface{}, 0)
+}
+
+// Logs returns a copy of the request log so callers can read it while requests are logged
+func (gs *gatewayState) Logs() []interface{} {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	logs := make([]interface{}, len(gs.requestLog))
+	copy(logs, gs.requestLog)
+	return logs
+}
+
+// SetDebugLog turns request logging on or off, the log is cleared when it's turned off
+func (gs *gatewayState) SetDebugLog(enabled bool) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.debugLog = enabled
+	if !enabled {
+		gs.requestLog = make([]interface{}, 0)
+	}
+}
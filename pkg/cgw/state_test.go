@@ -0,0 +1,151 @@
+package cgw
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestGatewayState(t *testing.T) {
+	gs := newGatewayState("local.mec", false)
+	gs.AppendLog("/url", "ignored")
+	assert.Equal(t, len(gs.Logs()), 0)
+
+	gs.SetDebugLog(true)
+	gs.SetMEC("other.mec")
+	assert.Equal(t, gs.MEC(), "other.mec")
+	gs.AppendLog("/url", "first")
+	logs := gs.Logs()
+	gs.AppendLog("/url", "second")
+	// callers get a copy that isn't changed by later requests
+	assert.Equal(t, len(logs), 1)
+	assert.Equal(t, len(gs.Logs()), 2)
+
+	gs.SetDebugLog(false)
+	assert.Equal(t, len(gs.Logs()), 0)
+}
+
+// testGatewayConfig is a gateway served from memory that talks to caasURL
+const testGatewayConfig = `mecID: rkln
+readTimeout: 1000
+writeTimeout: 5000
+handlerTimeout: 4000
+maxHeaderBytes: 1000
+port: 8080
+upstreamReasonCode: [0x98, 0x87]
+tokenFile: ./test/auth/tokenFile
+store: memory
+disconnecter: mqtt5
+caas:
+  server: %s
+  createEndpoint: /caas/v1/token/entity
+  deleteEndpoint: /caas/v1/token/entity/delete
+mqtt:
+  server: localhost:1883
+  successCode: 0x03
+  v5:
+    adminTopic: $CONTROL/cgw/v1/disconnect
+debug:
+  tokenEndpoint: /cgw/v1/debug/token
+  mecEndpoint: /cgw/v1/debug/mec
+  reqLogEndpoint: /cgw/v1/debug/reqlog
+  debugLog: true
+`
+
+// run with -race, handlers, debug endpoints and reloads all share the gateway state
+func TestConcurrentRequests(t *testing.T) {
+	caas := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer caas.Close()
+	dir, err := ioutil.TempDir("", "cgw")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	cfgPath := filepath.Join(dir, "cgw.yaml")
+	assert.NilError(t, ioutil.WriteFile(cfgPath, []byte(fmt.Sprintf(testGatewayConfig, caas.URL)), 0644))
+
+	cgw, err := NewCAASGateway(cfgPath, nil, nil, &dsMock{})
+	assert.NilError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := httptest.NewServer(cgw.serve(ctx))
+	defer srv.Close()
+
+	send := func(method string, path string, body interface{}) int {
+		jsBytes, err := json.Marshal(body)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewBuffer(jsBytes))
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		return resp.StatusCode
+	}
+	expect := func(step string, got int, want int) {
+		if got != want {
+			t.Errorf("%s returned %d, expected %d", step, got, want)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				etr := EntityTokenRequest{
+					EntityPair: EntityPair{Entity: "veh", EntityID: fmt.Sprintf("%d-%d", i, j)},
+					Token:      fmt.Sprintf("%d-%d.test", i, j),
+				}
+				expect("create", send("POST", "/cgw/v1/token", etr), http.StatusOK)
+				expect("validate", send("POST", "/cgw/v1/token/validate", etr), http.StatusOK)
+				refresh := RefreshTokenRequest{EntityTokenRequest: etr, OldToken: etr.Token}
+				refresh.Token = "new." + etr.Token
+				expect("refresh", send("POST", "/cgw/v1/token/refresh", refresh), http.StatusOK)
+				expect("disconnect", send("POST", "/cgw/v1/disconnect", DisconnectRequest{
+					EntityPair: etr.EntityPair,
+					ReasonCode: NotAuthorized,
+				}), http.StatusOK)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				expect("debug token", send("GET", fmt.Sprintf("/cgw/v1/debug/token?token=%d.test", j), nil), http.StatusOK)
+				expect("debug mec", send("GET", fmt.Sprintf("/cgw/v1/debug/mec?mec=%d.mec", i), nil), http.StatusOK)
+				expect("get request log", send("GET", "/cgw/v1/debug/reqlog", nil), http.StatusOK)
+				expect("clear request log", send("DELETE", "/cgw/v1/debug/reqlog", nil), http.StatusNoContent)
+				if j%5 == 0 {
+					if _, err := cgw.Reload(); err != nil {
+						t.Error(err)
+					}
+				}
+				cgw.GetToken()
+				cgw.GetMEC()
+			}
+		}(i)
+	}
+	wg.Wait()
+}
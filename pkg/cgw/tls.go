@@ -0,0 +1,212 @@
+package cgw
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// client auth modes for mtls
+const (
+	ClientAuthRequire  = "require"
+	ClientAuthOptional = "optional"
+)
+
+// default interval between certificate file checks
+const defaultCertReloadInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSSettings represents settings for serving https
+// ReloadInterval is in seconds
+type TLSSettings struct {
+	CertFile       string `yaml:"certFile"`
+	KeyFile        string `yaml:"keyFile"`
+	ClientCAFile   string `yaml:"clientCAFile"`
+	ClientAuth     string `yaml:"clientAuth"`
+	MinVersion     string `yaml:"minVersion"`
+	ReloadInterval int    `yaml:"reloadInterval"`
+}
+
+// Enabled checks if the listener should serve tls
+func (ts TLSSettings) Enabled() bool {
+	return !IsEmpty(ts.CertFile) || !IsEmpty(ts.KeyFile)
+}
+
+// validate checks the tls fields are consistent
+func (ts TLSSettings) validate() error {
+	if !ts.Enabled() {
+		if !IsEmpty(ts.ClientCAFile) {
+			return errors.New("client ca requires a server certificate")
+		}
+		return nil
+	}
+	if IsEmpty(ts.CertFile) || IsEmpty(ts.KeyFile) {
+		return errors.New("both certificate and key files are required")
+	}
+	if _, ok := tlsVersions[ts.MinVersion]; !ok && ts.MinVersion != "" {
+		return fmt.Errorf("tls version is not supported, %s", ts.MinVersion)
+	}
+	switch ts.ClientAuth {
+	case "":
+	case ClientAuthRequire, ClientAuthOptional:
+		if IsEmpty(ts.ClientCAFile) {
+			return fmt.Errorf("client auth %s requires a client ca", ts.ClientAuth)
+		}
+	default:
+		return fmt.Errorf("client auth mode is not supported, %s", ts.ClientAuth)
+	}
+	if ts.ReloadInterval < 0 {
+		return errors.New("reload interval can't be negative")
+	}
+	return nil
+}
+
+// certReloader serves the latest certificate and client ca found on disk
+type certReloader struct {
+	settings TLSSettings
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// newCertReloader loads the certificates specified in settings
+func newCertReloader(settings TLSSettings) (*certReloader, error) {
+	cr := &certReloader{
+		settings: settings,
+		modTimes: map[string]time.Time{},
+	}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// files returns all the files being watched
+func (cr *certReloader) files() []string {
+	files := []string{cr.settings.CertFile, cr.settings.KeyFile}
+	if !IsEmpty(cr.settings.ClientCAFile) {
+		files = append(files, cr.settings.ClientCAFile)
+	}
+	return files
+}
+
+// load reads the certificate, key and client ca from disk
+func (cr *certReloader) load() error {
+	modTimes := map[string]time.Time{}
+	for _, f := range cr.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(cr.settings.CertFile, cr.settings.KeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load key pair, %s", err)
+	}
+	var pool *x509.CertPool
+	if !IsEmpty(cr.settings.ClientCAFile) {
+		caBytes, err := ioutil.ReadFile(cr.settings.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return fmt.Errorf("no certificates found in %s", cr.settings.ClientCAFile)
+		}
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.clientCA = pool
+	cr.modTimes = modTimes
+	return nil
+}
+
+// changed checks if any of the files were modified since the last load
+func (cr *certReloader) changed() bool {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	for _, f := range cr.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			// file might be mid rotation, try again later
+			continue
+		}
+		if !info.ModTime().Equal(cr.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the certificates when the files change until ctx is done
+func (cr *certReloader) watch(ctx context.Context) {
+	interval := defaultCertReloadInterval
+	if cr.settings.ReloadInterval > 0 {
+		interval = time.Duration(cr.settings.ReloadInterval) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !cr.changed() {
+				continue
+			}
+			// keep serving the old certificate if the new one is bad
+			if err := cr.load(); err != nil {
+				ErrorLog("unable to reload certificates, %s", err)
+				continue
+			}
+			DebugLog("reloaded certificates from %s", cr.settings.CertFile)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// TLSConfig creates the server config that always uses the latest certificates
+func (cr *certReloader) TLSConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if v, ok := tlsVersions[cr.settings.MinVersion]; ok {
+		base.MinVersion = v
+	}
+	base.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cr.mu.RLock()
+		defer cr.mu.RUnlock()
+		return cr.cert, nil
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cr.mu.RLock()
+		defer cr.mu.RUnlock()
+		// keep everything else from the base config, alpn included so h2 is still offered
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		if cr.clientCA != nil {
+			cfg.ClientCAs = cr.clientCA
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			if cr.settings.ClientAuth == ClientAuthOptional {
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+		}
+		return cfg, nil
+	}
+	return base
+}
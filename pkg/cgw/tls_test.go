@@ -0,0 +1,157 @@
+package cgw
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// createTestCert creates a certificate signed by parent, self signed if parent is nil
+func createTestCert(t *testing.T, cn string, isCA bool, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.NilError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	assert.NilError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NilError(t, err)
+	return testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (tc testCert) keyPair(t *testing.T) tls.Certificate {
+	pair, err := tls.X509KeyPair(tc.certPEM, tc.keyPEM)
+	assert.NilError(t, err)
+	return pair
+}
+
+func TestTLSSettingsValidate(t *testing.T) {
+	assert.NilError(t, TLSSettings{}.validate())
+	assert.NilError(t, TLSSettings{CertFile: "cert", KeyFile: "key", MinVersion: "1.3"}.validate())
+	testTable := map[string]TLSSettings{
+		"client ca requires a server certificate":     {ClientCAFile: "ca"},
+		"both certificate and key files are required": {CertFile: "cert"},
+		"tls version is not supported, 1.4":           {CertFile: "cert", KeyFile: "key", MinVersion: "1.4"},
+		"client auth mode is not supported, always":   {CertFile: "cert", KeyFile: "key", ClientAuth: "always"},
+		"client auth optional requires a client ca":   {CertFile: "cert", KeyFile: "key", ClientAuth: ClientAuthOptional},
+	}
+	for k, v := range testTable {
+		assert.Error(t, v.validate(), k)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgwtls")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := createTestCert(t, "cgw-ca", true, nil)
+	server := createTestCert(t, "localhost", false, &ca)
+	client := createTestCert(t, "veh-1234", false, &ca)
+	settings := TLSSettings{
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	writeCerts := func(tc testCert) {
+		assert.NilError(t, ioutil.WriteFile(settings.CertFile, tc.certPEM, 0600))
+		assert.NilError(t, ioutil.WriteFile(settings.KeyFile, tc.keyPEM, 0600))
+	}
+	writeCerts(server)
+	assert.NilError(t, ioutil.WriteFile(settings.ClientCAFile, ca.certPEM, 0600))
+
+	cr, err := newCertReloader(settings)
+	assert.NilError(t, err)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = cr.TLSConfig()
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	newClient := func(certs []tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig: &tls.Config{
+				RootCAs:      roots,
+				Certificates: certs,
+				ServerName:   "localhost",
+			},
+		}}
+	}
+
+	t.Run("mtls", func(t *testing.T) {
+		resp, err := newClient([]tls.Certificate{client.keyPair(t)}).Get(srv.URL)
+		assert.NilError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.Equal(t, resp.ProtoMajor, 2)
+
+		// clients without certificates are rejected
+		_, err = newClient(nil).Get(srv.URL)
+		assert.Assert(t, err != nil)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		assert.Assert(t, !cr.changed())
+		rotated := createTestCert(t, "localhost", false, &ca)
+		writeCerts(rotated)
+		// make sure the modification time moves even on coarse filesystems
+		later := time.Now().Add(time.Minute)
+		assert.NilError(t, os.Chtimes(settings.CertFile, later, later))
+		assert.Assert(t, cr.changed())
+		assert.NilError(t, cr.load())
+
+		c := newClient([]tls.Certificate{client.keyPair(t)})
+		resp, err := c.Get(srv.URL)
+		assert.NilError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, resp.TLS.PeerCertificates[0].SerialNumber.Cmp(rotated.cert.SerialNumber), 0)
+	})
+}
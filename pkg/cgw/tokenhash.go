@@ -0,0 +1,256 @@
+package cgw
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// ErrTokenHashDisabled is returned for hashed records when hashing is turned off
+var ErrTokenHashDisabled = errors.New("token is hashed but token hashing is disabled")
+
+// ErrUnknownTokenKey is returned for records hashed with a key that isn't configured
+var ErrUnknownTokenKey = errors.New("unknown token key id")
+
+// TokenHashSettings represents settings for hashing tokens at rest
+// Keys maps key ids to files holding the secrets, KeyID is the key new tokens are
+// hashed with, records hashed with other keys are moved to KeyID on startup
+type TokenHashSettings struct {
+	Enabled bool              `yaml:"enabled"`
+	KeyID   string            `yaml:"keyID"`
+	Keys    map[string]string `yaml:"keys"`
+}
+
+// validate checks the token hash fields are consistent
+func (ts TokenHashSettings) validate() error {
+	if !ts.Enabled {
+		return nil
+	}
+	if IsEmpty(ts.KeyID) {
+		return errors.New("key id is required")
+	}
+	if _, ok := ts.Keys[ts.KeyID]; !ok {
+		return fmt.Errorf("key id has no key file, %s", ts.KeyID)
+	}
+	for id, file := range ts.Keys {
+		if IsEmpty(file) {
+			return fmt.Errorf("key file is empty for %s", id)
+		}
+	}
+	return nil
+}
+
+// tokenKey is a hashing secret along with the key used to seal tokens
+type tokenKey struct {
+	hash []byte
+	seal cipher.AEAD
+}
+
+// TokenHasher stores a keyed hash of tokens in records, along with a sealed copy
+// so the token can still be sent upstream when the entity is removed or handed over,
+// a nil hasher keeps tokens in plain text
+type TokenHasher struct {
+	keyID string
+	keys  map[string]tokenKey
+}
+
+// NewTokenHasher creates a token hasher from the secrets in the key files
+func NewTokenHasher(settings TokenHashSettings) (*TokenHasher, error) {
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+	th := &TokenHasher{
+		keyID: settings.KeyID,
+		keys:  map[string]tokenKey{},
+	}
+	for id, file := range settings.Keys {
+		kBytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		secret := []byte(strings.TrimSpace(string(kBytes)))
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("key is empty for %s", id)
+		}
+		// tokens are sealed with a key derived from the secret, never the secret itself
+		block, err := aes.NewCipher(th.mac(secret, "cgw token seal"))
+		if err != nil {
+			return nil, err
+		}
+		seal, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		th.keys[id] = tokenKey{hash: secret, seal: seal}
+	}
+	return th, nil
+}
+
+// mac computes the hmac of the parts under secret
+func (th *TokenHasher) mac(secret []byte, parts ...string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(strings.Join(parts, "\x00")))
+	return h.Sum(nil)
+}
+
+// hash binds the token to the entity pair so hashes can't be moved between records
+func (th *TokenHasher) hash(key tokenKey, ep EntityPair, token string) string {
+	return hex.EncodeToString(th.mac(key.hash, ep.CreateKey(), token))
+}
+
+// Seal sets the token on the record, hashed with the current key
+func (th *TokenHasher) Seal(rec *EntityRecord, token string) error {
+	if th == nil {
+		rec.Token, rec.TokenHash, rec.KeyID, rec.SealedToken = token, "", "", ""
+		return nil
+	}
+	key := th.keys[th.keyID]
+	nonce := make([]byte, key.seal.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := key.seal.Seal(nonce, nonce, []byte(token), []byte(rec.CreateKey()))
+	rec.Token = ""
+	rec.TokenHash = th.hash(key, rec.EntityPair, token)
+	rec.KeyID = th.keyID
+	rec.SealedToken = base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+
+// Verify checks token against the record in constant time, plain text records
+// from before hashing was enabled are still accepted
+func (th *TokenHasher) Verify(rec EntityRecord, token string) (bool, error) {
+	if IsEmpty(rec.TokenHash) {
+		return subtle.ConstantTimeCompare([]byte(rec.Token), []byte(token)) == 1, nil
+	}
+	if th == nil {
+		return false, ErrTokenHashDisabled
+	}
+	key, ok := th.keys[rec.KeyID]
+	if !ok {
+		return false, fmt.Errorf("%w, %s", ErrUnknownTokenKey, rec.KeyID)
+	}
+	expected := th.hash(key, rec.EntityPair, token)
+	return subtle.ConstantTimeCompare([]byte(rec.TokenHash), []byte(expected)) == 1, nil
+}
+
+// Open recovers the token for requests that have to present it upstream
+func (th *TokenHasher) Open(rec EntityRecord) (string, error) {
+	if IsEmpty(rec.TokenHash) {
+		return rec.Token, nil
+	}
+	if th == nil {
+		return "", ErrTokenHashDisabled
+	}
+	key, ok := th.keys[rec.KeyID]
+	if !ok {
+		return "", fmt.Errorf("%w, %s", ErrUnknownTokenKey, rec.KeyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(rec.SealedToken)
+	if err != nil {
+		return "", err
+	}
+	size := key.seal.NonceSize()
+	if len(sealed) < size {
+		return "", errors.New("sealed token is too short")
+	}
+	token, err := key.seal.Open(nil, sealed[:size], sealed[size:], []byte(rec.CreateKey()))
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// current checks if the record is already hashed with the current key
+func (th *TokenHasher) current(rec EntityRecord) bool {
+	if th == nil {
+		return IsEmpty(rec.TokenHash)
+	}
+	return rec.KeyID == th.keyID && !IsEmpty(rec.TokenHash)
+}
+
+// migrated checks if the record and the replaced token it still accepts use the current key
+func (th *TokenHasher) migrated(rec EntityRecord, now time.Time) bool {
+	prev, ok := rec.previous(now)
+	return th.current(rec) && (!ok || th.current(prev))
+}
+
+// migrateTokens hashes plain text records and moves records to the current key,
+// along with the tokens replaced by a refresh that are still in their grace period
+func (cgw *CAASGateway) migrateTokens(ctx context.Context) {
+	migrated := 0
+	for _, entity := range entityTypes {
+		err := scanRecords(ctx, cgw.kv, entity, func(rec EntityRecord) {
+			if cgw.hasher.migrated(rec, time.Now()) {
+				return
+			}
+			if err := cgw.migrateToken(ctx, rec.EntityPair); err != nil {
+				ErrorLog("unable to migrate token of %s, %s", rec.CreateKey(), err)
+				return
+			}
+			migrated++
+		})
+		if err != nil {
+			ErrorLog("unable to scan %s records, %s", entity, err)
+		}
+	}
+	DebugLog("migrated %d tokens", migrated)
+}
+
+// migrateToken rewrites the token of a single record with the current key
+func (cgw *CAASGateway) migrateToken(ctx context.Context, ep EntityPair) error {
+	ls := cgw.settings()
+	ctx, cancel := context.WithTimeout(ctx, ls.handlerTO)
+	defer cancel()
+
+	// take the same lock the handlers use so we don't race a refresh
+	lock, err := cgw.kv.Lock(ctx, "lock:"+ep.CreateKey(), ls.handlerTO)
+	if err != nil {
+		return err
+	}
+	defer lock.Release(ctx)
+
+	rec, err := getRecord(ctx, cgw.kv, ep.CreateKey())
+	if err == ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	now := time.Now()
+	if cgw.hasher.migrated(rec, now) || rec.Expired(now) {
+		return nil
+	}
+	if !cgw.hasher.current(rec) {
+		token, err := cgw.hasher.Open(rec)
+		if err != nil {
+			return err
+		}
+		if err = cgw.hasher.Seal(&rec, token); err != nil {
+			return err
+		}
+	}
+	if prev, ok := rec.previous(now); ok && !cgw.hasher.current(prev) {
+		token, err := cgw.hasher.Open(prev)
+		if err != nil {
+			// tokens replaced before they were sealed can't be moved, the grace period is cut short
+			ErrorLog("unable to migrate previous token of %s, %s", rec.CreateKey(), err)
+			rec.Previous = nil
+		} else if err = cgw.hasher.Seal(&prev, token); err != nil {
+			return err
+		} else {
+			rec.replacePrevious(prev)
+		}
+	}
+	return setRecord(ctx, cgw.kv, rec)
+}
@@ -0,0 +1,178 @@
+package cgw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func newTestHasher(t *testing.T, keyID string) *TokenHasher {
+	th, err := NewTokenHasher(TokenHashSettings{
+		Enabled: true,
+		KeyID:   keyID,
+		Keys: map[string]string{
+			"k1": "./test/auth/hashKey1",
+			"k2": "./test/auth/hashKey2",
+		},
+	})
+	assert.NilError(t, err)
+	return th
+}
+
+func TestTokenHashSettings(t *testing.T) {
+	testTable := map[string]TokenHashSettings{
+		"key id is required":         {Enabled: true},
+		"key id has no key file, k2": {Enabled: true, KeyID: "k2", Keys: map[string]string{"k1": "./test/auth/hashKey1"}},
+		"key is empty for k1":        {Enabled: true, KeyID: "k1", Keys: map[string]string{"k1": "./test/auth/emptyHashKey"}},
+		"no such file":               {Enabled: true, KeyID: "k1", Keys: map[string]string{"k1": "./test/auth/missing"}},
+	}
+	for k, v := range testTable {
+		_, err := NewTokenHasher(v)
+		assert.ErrorContains(t, err, k)
+	}
+}
+
+func TestTokenHasher(t *testing.T) {
+	th := newTestHasher(t, "k1")
+	rec := EntityRecord{EntityPair: EntityPair{Entity: "veh", EntityID: "1234"}}
+	assert.NilError(t, th.Seal(&rec, "test.test"))
+	assert.Equal(t, rec.Token, "")
+	assert.Equal(t, rec.KeyID, "k1")
+	assert.Assert(t, !strings.Contains(rec.SealedToken+rec.TokenHash, "test.test"))
+
+	match, err := th.Verify(rec, "test.test")
+	assert.NilError(t, err)
+	assert.Assert(t, match)
+	match, err = th.Verify(rec, "fail.test")
+	assert.NilError(t, err)
+	assert.Assert(t, !match)
+	token, err := th.Open(rec)
+	assert.NilError(t, err)
+	assert.Equal(t, token, "test.test")
+
+	// hashes can't be moved to another entity
+	moved := rec
+	moved.EntityID = "5678"
+	match, err = th.Verify(moved, "test.test")
+	assert.NilError(t, err)
+	assert.Assert(t, !match)
+	_, err = th.Open(moved)
+	assert.Assert(t, err != nil)
+
+	// plain text records are still accepted
+	plain := EntityRecord{EntityPair: rec.EntityPair, Token: "test.test"}
+	match, err = th.Verify(plain, "test.test")
+	assert.NilError(t, err)
+	assert.Assert(t, match)
+
+	// hashed records can't be used once hashing is turned off
+	var disabled *TokenHasher
+	_, err = disabled.Verify(rec, "test.test")
+	assert.Equal(t, err, ErrTokenHashDisabled)
+	_, err = disabled.Open(rec)
+	assert.Equal(t, err, ErrTokenHashDisabled)
+	assert.NilError(t, disabled.Seal(&rec, "test.test"))
+	assert.DeepEqual(t, rec, plain)
+}
+
+func TestMigrateTokens(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore()
+	cgw := gw
+	cgw.kv = ms
+	updateSettings(&cgw, func(ls *liveSettings) {
+		ls.handlerTO = time.Second
+	})
+	cgw.expiry = ExpirySettings{}
+
+	oldKey := EntityRecord{EntityPair: EntityPair{Entity: "veh", EntityID: "1"}}
+	assert.NilError(t, newTestHasher(t, "k1").Seal(&oldKey, "prev.test"))
+	oldKey.retire(time.Now().Add(time.Minute))
+	assert.NilError(t, newTestHasher(t, "k1").Seal(&oldKey, "old.test"))
+	plain := EntityRecord{EntityPair: EntityPair{Entity: "sw", EntityID: "1"}, Token: "plain.test"}
+	for _, rec := range []EntityRecord{oldKey, plain} {
+		assert.NilError(t, setRecord(ctx, ms, rec))
+	}
+
+	cgw.hasher = newTestHasher(t, "k2")
+	cgw.migrateTokens(ctx)
+	for key, token := range map[string]string{"veh-1": "old.test", "sw-1": "plain.test"} {
+		rec, err := getRecord(ctx, ms, key)
+		assert.NilError(t, err)
+		assert.Equal(t, rec.KeyID, "k2")
+		assert.Equal(t, rec.Token, "")
+		match, err := cgw.hasher.Verify(rec, token)
+		assert.NilError(t, err)
+		assert.Assert(t, match)
+	}
+
+	// the token kept for the refresh grace period is moved too
+	rec, err := getRecord(ctx, ms, "veh-1")
+	assert.NilError(t, err)
+	prev, ok := rec.previous(time.Now())
+	assert.Assert(t, ok)
+	assert.Equal(t, prev.KeyID, "k2")
+	match, err := cgw.hasher.Verify(prev, "prev.test")
+	assert.NilError(t, err)
+	assert.Assert(t, match)
+}
+
+func TestHashedTokenHandlers(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore()
+	th := newTestHasher(t, "k1")
+	etr := &EntityTokenRequest{
+		EntityPair: EntityPair{Entity: "veh", EntityID: "1234"},
+		Token:      "test.test",
+	}
+	assert.NilError(t, setRecord(ctx, ms, EntityRecord{EntityPair: etr.EntityPair, Token: "old.test"}))
+
+	w := httptest.NewRecorder()
+	refreshTokenHandler(ms, ExpirySettings{}, th, nil, RefreshSettings{}, nil)(w, createTestRequest(t, nil, &RefreshTokenRequest{
+		EntityTokenRequest: *etr,
+		OldToken:           "old.test",
+	}))
+	assert.Equal(t, w.Code, http.StatusOK)
+	val, err := ms.Get(ctx, etr.CreateKey())
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(val, "test.test"))
+
+	w = httptest.NewRecorder()
+	validateTokenHandler(ms, th, nil)(w, createTestRequest(t, nil, etr))
+	assert.Equal(t, w.Code, http.StatusOK)
+	w = httptest.NewRecorder()
+	validateTokenHandler(ms, th, nil)(w, createTestRequest(t, nil, &EntityTokenRequest{
+		EntityPair: etr.EntityPair,
+		Token:      "old.test",
+	}))
+	assert.Equal(t, w.Code, http.StatusForbidden)
+
+	// a replaced token hashed with a key that was dropped doesn't match
+	rec, err := getRecord(ctx, ms, etr.CreateKey())
+	assert.NilError(t, err)
+	rec.Previous = &PreviousToken{TokenHash: "dropped", KeyID: "k0", ValidUntil: time.Now().Add(time.Minute).Unix()}
+	assert.NilError(t, setRecord(ctx, ms, rec))
+	w = httptest.NewRecorder()
+	validateTokenHandler(ms, th, nil)(w, createTestRequest(t, nil, &EntityTokenRequest{
+		EntityPair: etr.EntityPair,
+		Token:      "old.test",
+	}))
+	assert.Equal(t, w.Code, http.StatusForbidden)
+
+	// caas gets the token itself when the entity is removed
+	rd := &recordingDisconnecter{}
+	handler := disconnectHandler(rd, ms, gw.settings().caas, map[ReasonCode]bool{NotAuthorized: true},
+		gw.GetMEC, gw.GetToken, nil, th)
+	w = httptest.NewRecorder()
+	handler(w, createTestRequest(t, nil, &DisconnectRequest{
+		EntityPair: etr.EntityPair,
+		ReasonCode: NotAuthorized,
+	}))
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Assert(t, strings.Contains(string(sm.GetTail(1).body), `"token":"test.test"`))
+}
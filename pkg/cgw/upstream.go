@@ -0,0 +1,306 @@
+package cgw
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CAASBreakerEndpoint reports the state of the caas circuit breaker
+const CAASBreakerEndpoint = "/cgw/v1/caas/breaker"
+
+// default caas client values
+const (
+	defaultCAASTimeout         = 10 * time.Second
+	defaultCAASMaxIdleConns    = 100
+	defaultCAASIdleConnTimeout = 90 * time.Second
+	defaultCAASRetryBackoff    = 100 * time.Millisecond
+	defaultBreakerCooldown     = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned without calling caas while the breaker is open
+var ErrCircuitOpen = errors.New("caas circuit breaker is open")
+
+// BreakerSettings represents settings for the caas circuit breaker
+// Threshold is the number of consecutive failures that open the breaker, 0 disables it,
+// Cooldown is how long (milliseconds) the breaker stays open before a call is let through
+type BreakerSettings struct {
+	Threshold int `yaml:"threshold"`
+	Cooldown  int `yaml:"cooldown"`
+}
+
+// validate checks the caas client fields are consistent
+func (cs CAASSettings) validate() error {
+	if cs.APIVersion != CAASv1 && cs.APIVersion != "" {
+		return fmt.Errorf("caas api version is not supported, %s", cs.APIVersion)
+	}
+	if cs.Timeout < 0 || cs.MaxIdleConns < 0 || cs.IdleConnTimeout < 0 {
+		return errors.New("timeouts and connection limits can't be negative")
+	}
+	if cs.Retries < 0 || cs.RetryBackoff < 0 {
+		return errors.New("retries and retry backoff can't be negative")
+	}
+	if cs.Breaker.Threshold < 0 || cs.Breaker.Cooldown < 0 {
+		return errors.New("breaker threshold and cooldown can't be negative")
+	}
+	return nil
+}
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+// States of the circuit breaker
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+// String returns the name of the state
+func (bs BreakerState) String() string {
+	switch bs {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+// BreakerStatus is the json returned for the breaker state
+type BreakerStatus struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	OpenedAt int64  `json:"openedAt,omitempty"`
+}
+
+// circuitBreaker opens after threshold consecutive failures, once the cooldown
+// passes a single probe is let through and its outcome closes or reopens it
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+// newCircuitBreaker creates a breaker, returns nil when the breaker is disabled
+func newCircuitBreaker(settings BreakerSettings) *circuitBreaker {
+	if settings.Threshold == 0 {
+		return nil
+	}
+	cb := &circuitBreaker{
+		threshold: settings.Threshold,
+		cooldown:  defaultBreakerCooldown,
+	}
+	if settings.Cooldown > 0 {
+		cb.cooldown = time.Duration(settings.Cooldown) * time.Millisecond
+	}
+	caasBreakerState.Set(float64(BreakerClosed))
+	return cb
+}
+
+// allow checks if a call can be made at time now
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case BreakerOpen:
+		if now.Sub(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.setState(BreakerHalfOpen)
+	case BreakerHalfOpen:
+		// only one probe at a time while we find out if caas is back
+		if cb.probing {
+			return false
+		}
+	default:
+		return true
+	}
+	cb.probing = true
+	return true
+}
+
+// record updates the breaker with the outcome of a call
+func (cb *circuitBreaker) record(failed bool, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.probing = false
+	if !failed {
+		cb.failures = 0
+		cb.setState(BreakerClosed)
+		return
+	}
+	cb.failures++
+	if cb.state == BreakerHalfOpen || cb.failures >= cb.threshold {
+		if cb.state != BreakerOpen {
+			ErrorLog("caas circuit breaker opened after %d failures", cb.failures)
+		}
+		cb.openedAt = now
+		cb.setState(BreakerOpen)
+	}
+}
+
+// release lets another probe through without recording an outcome
+func (cb *circuitBreaker) release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.probing = false
+}
+
+// setState changes the state, the lock must be held
+func (cb *circuitBreaker) setState(state BreakerState) {
+	if cb.state != state {
+		DebugLog("caas circuit breaker is %s", state)
+	}
+	cb.state = state
+	caasBreakerState.Set(float64(state))
+}
+
+// Status returns the current state of the breaker
+func (cb *circuitBreaker) Status() BreakerStatus {
+	if cb == nil {
+		return BreakerStatus{State: BreakerClosed.String()}
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	status := BreakerStatus{
+		State:    cb.state.String(),
+		Failures: cb.failures,
+	}
+	if cb.state != BreakerClosed {
+		status.OpenedAt = cb.openedAt.Unix()
+	}
+	return status
+}
+
+// UpstreamClient is the long lived client used for caas, connections are pooled,
+// idempotent calls are retried with jittered backoff and the breaker fails calls
+// fast once caas stops answering
+type UpstreamClient struct {
+	client  *http.Client
+	retries int
+	backoff time.Duration
+	breaker *circuitBreaker
+}
+
+// NewUpstreamClient creates the caas client from settings
+func NewUpstreamClient(settings CAASSettings) (*UpstreamClient, error) {
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = defaultCAASMaxIdleConns
+	if settings.MaxIdleConns > 0 {
+		transport.MaxIdleConns = settings.MaxIdleConns
+	}
+	// every call goes to the same host
+	transport.MaxIdleConnsPerHost = transport.MaxIdleConns
+	transport.IdleConnTimeout = defaultCAASIdleConnTimeout
+	if settings.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(settings.IdleConnTimeout) * time.Millisecond
+	}
+	uc := &UpstreamClient{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   defaultCAASTimeout,
+		},
+		retries: settings.Retries,
+		backoff: defaultCAASRetryBackoff,
+		breaker: newCircuitBreaker(settings.Breaker),
+	}
+	if settings.Timeout > 0 {
+		uc.client.Timeout = time.Duration(settings.Timeout) * time.Millisecond
+	}
+	if settings.RetryBackoff > 0 {
+		uc.backoff = time.Duration(settings.RetryBackoff) * time.Millisecond
+	}
+	return uc, nil
+}
+
+// Post sends body as json to endpoint, idempotent calls are retried on errors
+// and 5xx responses, operation labels the request in the metrics
+func (uc *UpstreamClient) Post(ctx context.Context, operation string, endpoint string,
+	bearerToken string, body interface{}, idempotent bool) (HTTPResponse, error) {
+	jsBytes, err := json.Marshal(body)
+	if err != nil {
+		return HTTPResponse{}, err
+	}
+	if uc.breaker != nil && !uc.breaker.allow(time.Now()) {
+		caasRejected.WithLabelValues(operation).Inc()
+		return HTTPResponse{}, ErrCircuitOpen
+	}
+	header := map[string]string{
+		"Content-Type":  "application/json",
+		"Authorization": "Bearer " + bearerToken,
+	}
+	attempts := 1
+	if idempotent {
+		attempts += uc.retries
+	}
+	var resp HTTPResponse
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err = uc.wait(ctx, attempt); err != nil {
+				break
+			}
+			DebugLog("retrying caas %s, attempt %d", operation, attempt+1)
+		}
+		start := time.Now()
+		resp, err = doHTTPRequest(ctx, uc.client, "POST", endpoint, header, nil, bytes.NewBuffer(jsBytes))
+		observeCAAS(operation, start, resp, err)
+		if err == nil && resp.status < http.StatusInternalServerError {
+			break
+		}
+	}
+	if uc.breaker != nil {
+		// the caller giving up says nothing about caas
+		if ctx.Err() != nil {
+			uc.breaker.release()
+		} else {
+			uc.breaker.record(err != nil || resp.status >= http.StatusInternalServerError, time.Now())
+		}
+	}
+	return resp, err
+}
+
+// wait sleeps before a retry, the backoff doubles every attempt and is jittered
+// so retries from many requests don't arrive together
+func (uc *UpstreamClient) wait(ctx context.Context, attempt int) error {
+	backoff := uc.backoff << uint(attempt-1)
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Breaker returns the state of the circuit breaker
+func (uc *UpstreamClient) Breaker() BreakerStatus {
+	return uc.breaker.Status()
+}
+
+// caasBreakerHandler reports the state of the caas circuit breaker
+// returns 200 with the state
+func caasBreakerHandler(caas BreakerReporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(caas.Breaker())
+	}
+}
@@ -0,0 +1,143 @@
+package cgw
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestCAASClientSettings(t *testing.T) {
+	testTable := map[string]CAASSettings{
+		"timeouts and connection limits can't be negative": {Timeout: -1},
+		"retries and retry backoff can't be negative":      {Retries: -1},
+		"breaker threshold and cooldown can't be negative": {Breaker: BreakerSettings{Cooldown: -1}},
+	}
+	for k, v := range testTable {
+		_, err := NewUpstreamClient(v)
+		assert.ErrorContains(t, err, k)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	assert.Assert(t, newCircuitBreaker(BreakerSettings{}) == nil)
+	cb := newCircuitBreaker(BreakerSettings{Threshold: 2, Cooldown: 1000})
+	now := time.Now()
+
+	// success resets the failure count
+	assert.Assert(t, cb.allow(now))
+	cb.record(true, now)
+	cb.record(false, now)
+	cb.record(true, now)
+	assert.Equal(t, cb.Status().State, "closed")
+
+	// consecutive failures open it until the cooldown passes
+	cb.record(true, now)
+	assert.Equal(t, cb.Status().State, "open")
+	assert.Assert(t, !cb.allow(now.Add(500*time.Millisecond)))
+
+	// a single probe is let through and reopens it on failure
+	assert.Assert(t, cb.allow(now.Add(time.Second)))
+	assert.Equal(t, cb.Status().State, "half-open")
+	assert.Assert(t, !cb.allow(now.Add(time.Second)))
+	cb.record(true, now.Add(time.Second))
+	assert.Equal(t, cb.Status().State, "open")
+	assert.Assert(t, !cb.allow(now.Add(1500*time.Millisecond)))
+
+	// a successful probe closes it
+	assert.Assert(t, cb.allow(now.Add(2*time.Second)))
+	cb.record(false, now.Add(2*time.Second))
+	assert.DeepEqual(t, cb.Status(), BreakerStatus{State: "closed"})
+}
+
+func TestUpstreamClient(t *testing.T) {
+	var calls int32
+	failures := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			// the connection is only watched for the caller going away once the body is read
+			ioutil.ReadAll(req.Body)
+			<-req.Context().Done()
+			return
+		}
+		if atomic.AddInt32(&calls, 1) <= atomic.LoadInt32(&failures) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	uc, err := NewUpstreamClient(CAASSettings{
+		Retries:      2,
+		RetryBackoff: 1,
+		Breaker:      BreakerSettings{Threshold: 2, Cooldown: 60000},
+	})
+	assert.NilError(t, err)
+
+	t.Run("retry_idempotent", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		atomic.StoreInt32(&failures, 2)
+		resp, err := uc.Post(ctx, "delete", srv.URL, "password", EntityPair{"veh", "1"}, true)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.status, http.StatusNoContent)
+		assert.Equal(t, atomic.LoadInt32(&calls), int32(3))
+	})
+
+	t.Run("no_retry", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		atomic.StoreInt32(&failures, 1)
+		resp, err := uc.Post(ctx, "create", srv.URL, "password", EntityPair{"veh", "1"}, false)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.status, http.StatusInternalServerError)
+		assert.Equal(t, atomic.LoadInt32(&calls), int32(1))
+	})
+
+	t.Run("caller_timeout", func(t *testing.T) {
+		before := uc.Breaker()
+		for i := 0; i < 3; i++ {
+			timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			_, err := uc.Post(timeout, "create", srv.URL+"/slow", "password", EntityPair{"veh", "1"}, false)
+			cancel()
+			assert.Assert(t, err != nil)
+		}
+		// callers timing out don't count against caas
+		assert.DeepEqual(t, uc.Breaker(), before)
+		assert.Equal(t, before.State, "closed")
+	})
+
+	t.Run("fail_fast", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		atomic.StoreInt32(&failures, 10)
+		_, err := uc.Post(ctx, "create", srv.URL, "password", EntityPair{"veh", "1"}, false)
+		assert.NilError(t, err)
+		assert.Equal(t, uc.Breaker().State, "open")
+		_, err = uc.Post(ctx, "create", srv.URL, "password", EntityPair{"veh", "1"}, false)
+		assert.Equal(t, err, ErrCircuitOpen)
+		assert.Equal(t, atomic.LoadInt32(&calls), int32(1))
+
+		// handlers tell clients caas is unavailable
+		handler := createNewTokenHandler(NewMemoryStore(), ExpirySettings{}, nil,
+			&caasV1Client{upstream: uc, createURL: srv.URL}, gw.GetMEC, gw.GetToken)
+		w := httptest.NewRecorder()
+		handler(w, createTestRequest(t, nil, &EntityTokenRequest{
+			EntityPair: EntityPair{"veh", "1"},
+			Token:      "test.test",
+		}))
+		assert.Equal(t, w.Code, http.StatusServiceUnavailable)
+
+		w = httptest.NewRecorder()
+		caasBreakerHandler(uc)(w, httptest.NewRequest("GET", CAASBreakerEndpoint, nil))
+		assert.Equal(t, w.Code, http.StatusOK)
+		status := BreakerStatus{}
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &status))
+		assert.Equal(t, status.State, "open")
+		assert.Equal(t, status.Failures, 2)
+	})
+}
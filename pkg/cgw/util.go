@@ -75,12 +75,19 @@ type HTTPResponse struct {
 	status int
 }
 
+// defaultHTTPClient is shared by requests that don't have their own client so connections are reused
+var defaultHTTPClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
 // HTTPRequest makes http requests
 func HTTPRequest(ctx context.Context, method string, endpoint string, header map[string]string, query map[string]string, body io.Reader) (HTTPResponse, error) {
-	// create request client to get entity ID from CRS
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
+	return doHTTPRequest(ctx, defaultHTTPClient, method, endpoint, header, query, body)
+}
+
+// doHTTPRequest makes http requests with client
+func doHTTPRequest(ctx context.Context, client *http.Client, method string, endpoint string,
+	header map[string]string, query map[string]string, body io.Reader) (HTTPResponse, error) {
 	req, err := http.NewRequest(method, endpoint, body)
 	if err != nil {
 		return HTTPResponse{}, err
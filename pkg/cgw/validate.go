@@ -0,0 +1,288 @@
+package cgw
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// reason codes the gateway knows how to handle
+var knownReasonCodes = map[ReasonCode]bool{
+	Reauthenticate: true,
+	Expiration:     true,
+	Handover:       true,
+	RateTooHigh:    true,
+	NotAuthorized:  true,
+	Idle:           true,
+}
+
+// ConfigProblem is a single problem with the config, Path is the yaml path of the field
+type ConfigProblem struct {
+	Path    string
+	Message string
+}
+
+// String returns the problem prefixed with its path
+func (cp ConfigProblem) String() string {
+	return cp.Path + ": " + cp.Message
+}
+
+// ValidationError lists every problem found in the config
+type ValidationError struct {
+	Problems []ConfigProblem
+}
+
+// Error joins the problems
+func (ve *ValidationError) Error() string {
+	problems := make([]string, len(ve.Problems))
+	for i, p := range ve.Problems {
+		problems[i] = p.String()
+	}
+	return "invalid config; " + strings.Join(problems, "; ")
+}
+
+// configCheck collects the problems found while checking a config
+type configCheck struct {
+	problems   []ConfigProblem
+	checkFiles bool
+}
+
+// add records a problem at path
+func (cc *configCheck) add(path string, format string, args ...interface{}) {
+	cc.problems = append(cc.problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// section records the error returned by a settings validate method
+func (cc *configCheck) section(path string, err error) {
+	if err != nil {
+		cc.add(path, "%s", err)
+	}
+}
+
+// required checks value is set
+func (cc *configCheck) required(path string, value string) {
+	if IsEmpty(value) {
+		cc.add(path, "missing required value")
+	}
+}
+
+// positive checks value is greater than zero
+func (cc *configCheck) positive(path string, value int) {
+	if value <= 0 {
+		cc.add(path, "must be greater than 0, %d", value)
+	}
+}
+
+// nonNegative checks value isn't negative
+func (cc *configCheck) nonNegative(path string, value int) {
+	if value < 0 {
+		cc.add(path, "can't be negative, %d", value)
+	}
+}
+
+// port checks value is a port number
+func (cc *configCheck) port(path string, value string) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		cc.add(path, "port must be between 1 and 65535, %s", value)
+	}
+}
+
+// url checks value is an http or https url, empty values are left to required
+func (cc *configCheck) url(path string, value string) {
+	if IsEmpty(value) {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		cc.add(path, "must be an http or https url, %s", value)
+	}
+}
+
+// file checks value can be read, the gateway always checks files when it loads
+// the config, validate skips them with -check-files=false when they aren't mounted
+func (cc *configCheck) file(path string, value string) {
+	if !cc.checkFiles || IsEmpty(value) {
+		return
+	}
+	info, err := os.Stat(value)
+	if err != nil {
+		cc.add(path, "can't read file, %s", err)
+		return
+	}
+	if info.IsDir() {
+		cc.add(path, "is a directory, %s", value)
+	}
+}
+
+// ValidateConfig checks every field of cfg and returns a *ValidationError with
+// all the problems found, checkFiles also makes sure the referenced files exist
+func ValidateConfig(cfg Config, checkFiles bool) error {
+	cc := &configCheck{checkFiles: checkFiles}
+
+	// required fields, the token file isn't needed when the token comes from oauth2
+	cc.required("mecID", cfg.MECID)
+	cc.required("port", cfg.Port)
+	if !IsEmpty(cfg.Port) {
+		cc.port("port", cfg.Port)
+	}
+	if !cfg.OAuth2.Enabled {
+		cc.required("tokenFile", cfg.TokenFile)
+		cc.file("tokenFile", cfg.TokenFile)
+	}
+
+	// server values
+	cc.positive("readTimeout", cfg.ReadTimeout)
+	cc.positive("writeTimeout", cfg.WriteTimeout)
+	cc.positive("maxHeaderBytes", cfg.MaxHeaderBytes)
+	cc.positive("handlerTimeout", cfg.HandlerTimeout)
+	for i, rc := range cfg.UpstreamReasonCode {
+		if !knownReasonCodes[rc] {
+			cc.add(fmt.Sprintf("upstreamReasonCode[%d]", i), "reason code is not supported, %#x", byte(rc))
+		}
+	}
+
+	// tls and inbound auth, mtls needs verified client certificates
+	cc.section("tls", cfg.TLS.validate())
+	cc.file("tls.certFile", cfg.TLS.CertFile)
+	cc.file("tls.keyFile", cfg.TLS.KeyFile)
+	cc.file("tls.clientCAFile", cfg.TLS.ClientCAFile)
+	cc.section("auth", cfg.Auth.validate())
+	if cfg.Auth.Enabled {
+		if cfg.Auth.MTLS && IsEmpty(cfg.TLS.ClientCAFile) {
+			cc.add("auth.mtls", "mtls requires tls client ca")
+		}
+		cc.file("auth.tokensFile", cfg.Auth.TokensFile)
+	}
+
+	if cfg.Handover.Enabled {
+		cc.section("handover", cfg.Handover.validate())
+		cc.file("handover.tokenFile", cfg.Handover.TokenFile)
+		// peers authenticate with the handover token when there's no inbound auth
+		if !cfg.Auth.Enabled && IsEmpty(cfg.Handover.TokenFile) {
+			cc.add("handover.tokenFile", "required to authenticate peers when auth is disabled")
+		}
+	}
+	cc.section("rateLimit", cfg.RateLimit.validate())
+	cc.section("idle", cfg.Idle.validate())
+	cc.section("bulk", cfg.Bulk.validate())
+	cc.section("health", cfg.Health.validate())
+	if cfg.TokenHash.Enabled {
+		cc.section("tokenHash", cfg.TokenHash.validate())
+		ids := make([]string, 0, len(cfg.TokenHash.Keys))
+		for id := range cfg.TokenHash.Keys {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			cc.file("tokenHash.keys."+id, cfg.TokenHash.Keys[id])
+		}
+	}
+
+	// token lifetimes
+	cc.nonNegative("expiry.defaultTTL", cfg.Expiry.DefaultTTL)
+	cc.nonNegative("expiry.maxTTL", cfg.Expiry.MaxTTL)
+	cc.nonNegative("expiry.sweepInterval", cfg.Expiry.SweepInterval)
+	cc.nonNegative("refresh.gracePeriod", cfg.Refresh.GracePeriod)
+
+	// bearer token and reloads
+	cc.nonNegative("tokenWatchInterval", cfg.TokenWatchInterval)
+	if cfg.OAuth2.Enabled {
+		cc.section("oauth2", cfg.OAuth2.validate())
+		cc.file("oauth2.clientSecretFile", cfg.OAuth2.ClientSecretFile)
+	}
+	cc.nonNegative("reload.watchInterval", cfg.Reload.WatchInterval)
+
+	// caas
+	cc.section("caas", cfg.CAAS.validate())
+	cc.required("caas.server", cfg.CAAS.Server)
+	cc.url("caas.server", cfg.CAAS.Server)
+	cc.required("caas.createEndpoint", cfg.CAAS.CreateEndpoint)
+	cc.required("caas.deleteEndpoint", cfg.CAAS.DeleteEndpoint)
+
+	// the disconnect mechanism, the rest disconnecter talks to the management api
+	// instead of the mqtt server and brokers in the list have their own servers
+	useREST := cfg.Disconnecter == RESTDisconnecterType
+	for _, b := range cfg.MQTT.Brokers {
+		useREST = useREST || b.Disconnecter == RESTDisconnecterType
+	}
+	if useREST {
+		cc.section("mqtt.rest", cfg.MQTT.REST.validate())
+		cc.file("mqtt.rest.authFile", cfg.MQTT.REST.AuthFile)
+	}
+	switch cfg.Disconnecter {
+	case ConnectDisconnecterType, MQTTv5DisconnecterType, "":
+	case DynSecDisconnecterType:
+		cc.section("mqtt.dynsec", cfg.MQTT.DynSec.validate())
+	case RESTDisconnecterType:
+		if len(cfg.MQTT.Brokers) == 0 {
+			cc.required("mqtt.rest.server", cfg.MQTT.REST.Server)
+			cc.url("mqtt.rest.server", cfg.MQTT.REST.Server)
+		}
+	default:
+		cc.add("disconnecter", "disconnecter type is not supported, %s", cfg.Disconnecter)
+	}
+	cc.section("mqtt.brokers", cfg.MQTT.validateBrokers())
+	if cfg.Disconnecter != RESTDisconnecterType && len(cfg.MQTT.Brokers) == 0 {
+		cc.required("mqtt.server", cfg.MQTT.Server)
+	}
+
+	// mqtt auth
+	switch cfg.MQTT.AuthType {
+	case NoAuth:
+	case FileBased:
+		cc.required("mqtt.authFile", cfg.MQTT.AuthFile)
+		cc.file("mqtt.authFile", cfg.MQTT.AuthFile)
+	case CRSBased:
+		cc.required("mqtt.crs.server", cfg.MQTT.CRS.Server)
+		cc.url("mqtt.crs.server", cfg.MQTT.CRS.Server)
+		cc.required("mqtt.crs.entity", cfg.MQTT.CRS.Entity)
+		cc.required("mqtt.crs.cfgPath", cfg.MQTT.CRS.CfgPath)
+		cc.file("mqtt.crs.cfgPath", cfg.MQTT.CRS.CfgPath)
+		cc.required("mqtt.crs.registrationEndpoint", cfg.MQTT.CRS.RegistrationEndpoint)
+	default:
+		cc.add("mqtt.authType", "auth type is not supported, %d", cfg.MQTT.AuthType)
+	}
+
+	// redis is only required when it's used as the store
+	switch cfg.Store {
+	case RedisStoreType, "":
+		validateRedis(cc, cfg.Redis)
+	case MemoryStoreType:
+	default:
+		cc.add("store", "store type is not supported, %s", cfg.Store)
+	}
+
+	if len(cc.problems) > 0 {
+		return &ValidationError{Problems: cc.problems}
+	}
+	return nil
+}
+
+// validateRedis checks the servers and auth for the redis topology
+func validateRedis(cc *configCheck, rs RedisSettings) {
+	switch rs.Mode {
+	case RedisSingle, "":
+		cc.required("redis.server", rs.Server)
+	case RedisSentinel:
+		if len(rs.Sentinel.Addresses) == 0 {
+			cc.add("redis.sentinel.addresses", "missing required value")
+		}
+		cc.required("redis.sentinel.masterName", rs.Sentinel.MasterName)
+		cc.file("redis.sentinel.authFile", rs.Sentinel.AuthFile)
+	case RedisCluster:
+		if len(rs.Cluster.Seeds) == 0 {
+			cc.add("redis.cluster.seeds", "missing required value")
+		}
+		if rs.DBIndex != 0 {
+			cc.add("redis.DBIndex", "redis cluster only supports db index 0, %d", rs.DBIndex)
+		}
+	default:
+		cc.add("redis.mode", "redis mode is not supported, %s", rs.Mode)
+	}
+	cc.required("redis.authFile", rs.AuthFile)
+	cc.file("redis.authFile", rs.AuthFile)
+}
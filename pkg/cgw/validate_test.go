@@ -0,0 +1,91 @@
+package cgw
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestValidateConfig(t *testing.T) {
+	cfg, err := ReadConfig("./test/config/memoryStore.yaml", nil)
+	assert.NilError(t, err)
+	assert.NilError(t, ValidateConfig(cfg, false))
+
+	t.Run("every_problem", func(t *testing.T) {
+		bad := cfg
+		bad.MECID = ""
+		bad.Port = "70000"
+		bad.ReadTimeout = 0
+		bad.UpstreamReasonCode = []ReasonCode{NotAuthorized, 0x42}
+		bad.Expiry.MaxTTL = -1
+		bad.CAAS.Server = "localhost:8989"
+		bad.CAAS.CreateEndpoint = ""
+		bad.Handover = HandoverSettings{Enabled: true}
+		bad.Store = RedisStoreType
+		bad.Redis = RedisSettings{Mode: RedisCluster, DBIndex: 1, AuthFile: "/etc/ds/auth"}
+		err := ValidateConfig(bad, false)
+		ve, ok := err.(*ValidationError)
+		assert.Assert(t, ok)
+		assert.DeepEqual(t, ve.Problems, []ConfigProblem{
+			{Path: "mecID", Message: "missing required value"},
+			{Path: "port", Message: "port must be between 1 and 65535, 70000"},
+			{Path: "readTimeout", Message: "must be greater than 0, 0"},
+			{Path: "upstreamReasonCode[1]", Message: "reason code is not supported, 0x42"},
+			{Path: "handover", Message: "handover requires at least one peer"},
+			{Path: "handover.tokenFile", Message: "required to authenticate peers when auth is disabled"},
+			{Path: "expiry.maxTTL", Message: "can't be negative, -1"},
+			{Path: "caas.server", Message: "must be an http or https url, localhost:8989"},
+			{Path: "caas.createEndpoint", Message: "missing required value"},
+			{Path: "redis.cluster.seeds", Message: "missing required value"},
+			{Path: "redis.DBIndex", Message: "redis cluster only supports db index 0, 1"},
+		})
+		assert.ErrorContains(t, err, "invalid config; mecID: missing required value; port: ")
+	})
+
+	t.Run("rest_brokers", func(t *testing.T) {
+		rest := cfg
+		rest.Disconnecter = RESTDisconnecterType
+		err := ValidateConfig(rest, false)
+		assert.ErrorContains(t, err, "mqtt.rest.server: missing required value")
+
+		// every broker has its own management api server
+		rest.MQTT.Brokers = []BrokerSettings{
+			{Name: "a", Server: "http://emqx-a:18083"},
+			{Name: "b", Server: "http://emqx-b:18083"},
+		}
+		assert.NilError(t, ValidateConfig(rest, false))
+	})
+
+	t.Run("check_files", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cgw")
+		assert.NilError(t, err)
+		defer os.RemoveAll(dir)
+		found := filepath.Join(dir, "token")
+		assert.NilError(t, ioutil.WriteFile(found, []byte("test.test"), 0644))
+
+		withFiles := cfg
+		withFiles.TokenFile = found
+		withFiles.MQTT.AuthType = CRSBased
+		withFiles.MQTT.CRS = CRSSettings{
+			Entity:               "sw",
+			Server:               "http://localhost:30413",
+			CfgPath:              filepath.Join(dir, "missing"),
+			RegistrationEndpoint: "/registration",
+		}
+		withFiles.TLS = TLSSettings{CertFile: dir, KeyFile: found}
+		// files aren't checked unless asked for
+		assert.NilError(t, ValidateConfig(withFiles, false))
+
+		err = ValidateConfig(withFiles, true)
+		ve, ok := err.(*ValidationError)
+		assert.Assert(t, ok)
+		assert.Equal(t, len(ve.Problems), 2)
+		assert.Equal(t, ve.Problems[0].Path, "tls.certFile")
+		assert.Equal(t, ve.Problems[0].Message, "is a directory, "+dir)
+		assert.Equal(t, ve.Problems[1].Path, "mqtt.crs.cfgPath")
+		assert.ErrorContains(t, ve, "mqtt.crs.cfgPath: can't read file")
+	})
+}